@@ -9,6 +9,7 @@ import (
 const (
   tableAccountBalance = "AccountBalance"
   columnBalance       = "Balance"
+  columnReserved      = "Reserved"
 )
 
 type accountBalanceHandler struct {
@@ -18,6 +19,8 @@ type BalanceMsg struct {
   AccountID string
   Symbol string
   Balance uint64
+  Available uint64
+  Reserved uint64
 }
 
 func NewAccountBalanceHandler() *accountBalanceHandler {
@@ -30,6 +33,7 @@ func (t *accountBalanceHandler) createTable(stub shim.ChaincodeStubInterface) er
     &shim.ColumnDefinition{Name: columnAccountID, Type: shim.ColumnDefinition_STRING, Key: true},
     &shim.ColumnDefinition{Name: columnSymbol, Type: shim.ColumnDefinition_STRING, Key: true},
     &shim.ColumnDefinition{Name: columnBalance, Type: shim.ColumnDefinition_UINT64, Key: false},
+    &shim.ColumnDefinition{Name: columnReserved, Type: shim.ColumnDefinition_UINT64, Key: false},
   })
 
   if err != nil {
@@ -41,7 +45,8 @@ func (t *accountBalanceHandler) createTable(stub shim.ChaincodeStubInterface) er
 
 }
 
-func (t *accountBalanceHandler) listHolderBySymbol(stub shim.ChaincodeStubInterface,symbol string) ([]byte,error) {
+// findHolderBySymbol returns every account with a balance in symbol.
+func (t *accountBalanceHandler) findHolderBySymbol(stub shim.ChaincodeStubInterface,symbol string) ([]BalanceMsg,error) {
   var balMsgs []BalanceMsg
   var columnsTx []shim.Column
 
@@ -60,12 +65,15 @@ func (t *accountBalanceHandler) listHolderBySymbol(stub shim.ChaincodeStubInterf
             tAccount := row.Columns[0].GetString_();
             tSymbol := row.Columns[1].GetString_();
             tBalance := row.Columns[2].GetUint64();
+            tReserved := row.Columns[3].GetUint64();
 
             if (tSymbol == symbol && tBalance > 0){
               balMsg := BalanceMsg{
                 tAccount,
                 tSymbol,
                 tBalance,
+                tBalance - tReserved,
+                tReserved,
               }
             balMsgs = append(balMsgs, balMsg)
           }
@@ -76,6 +84,45 @@ func (t *accountBalanceHandler) listHolderBySymbol(stub shim.ChaincodeStubInterf
     }
   }
 
+  return balMsgs, nil
+}
+
+// hasHoldings reports whether the account holds shares in any symbol.
+func (t *accountBalanceHandler) hasHoldings(stub shim.ChaincodeStubInterface,accountID string) (bool,error) {
+  var columnsTx []shim.Column
+  colAccountID := shim.Column{Value: &shim.Column_String_{String_: accountID}}
+  columnsTx = append(columnsTx, colAccountID)
+
+  rowChannel, err := stub.GetRows(tableAccountBalance, columnsTx)
+  if err != nil {
+    myLogger.Errorf("system error %v", err)
+    return false, errors.New("Cannot query account balance.")
+  }
+
+  holds := false
+  for {
+    select {
+    case row, ok := <-rowChannel:
+      if !ok {
+        rowChannel = nil
+      } else if row.Columns[2].GetUint64() > 0 {
+        holds = true
+      }
+    }
+    if rowChannel == nil {
+      break
+    }
+  }
+
+  return holds, nil
+}
+
+func (t *accountBalanceHandler) listHolderBySymbol(stub shim.ChaincodeStubInterface,symbol string) ([]byte,error) {
+  balMsgs, err := t.findHolderBySymbol(stub, symbol)
+  if err != nil {
+    return nil, err
+  }
+
   balMsgsJson, err := json.Marshal(balMsgs)
   myLogger.Debugf("Response : %s",  balMsgsJson)
   return balMsgsJson, nil
@@ -83,9 +130,9 @@ func (t *accountBalanceHandler) listHolderBySymbol(stub shim.ChaincodeStubInterf
 
 
 func (t *accountBalanceHandler) InitAccountBalance(stub shim.ChaincodeStubInterface) error {
-  t.updateAccountBalance(stub,"owner01","Ookbee", 100000)
-  t.updateAccountBalance(stub,"owner02","Wongnai", 200000)
-  t.updateAccountBalance(stub,"owner03","ClaimDi", 300000)
+  t.issueStock(stub,"owner01","Ookbee", 100000)
+  t.issueStock(stub,"owner02","Wongnai", 200000)
+  t.issueStock(stub,"owner03","ClaimDi", 300000)
 
 	  // t.updateAccountBalance(stub,"AA01","AAAA", 1000)
   	// t.updateAccountBalance(stub,"AA01","BBBB", 1000)
@@ -192,21 +239,23 @@ func (t *accountBalanceHandler) updateAccountBalance(stub shim.ChaincodeStubInte
       Columns: []*shim.Column{
         &shim.Column{Value: &shim.Column_String_{String_: accountID}},
         &shim.Column{Value: &shim.Column_String_{String_: symbol}},
-        &shim.Column{Value: &shim.Column_Uint64{Uint64: balance}}},
+        &shim.Column{Value: &shim.Column_Uint64{Uint64: balance}},
+        &shim.Column{Value: &shim.Column_Uint64{Uint64: 0}}},
     })
 
   	if err != nil {
     	myLogger.Errorf("system error %v", err)
     	return errors.New("Cannot insert account balance.")
   	}
-  	return nil
+  	return capHandler.record(stub, accountID, symbol, balance)
   }
 
    _, err = stub.ReplaceRow(tableAccountBalance, shim.Row{
     Columns: []*shim.Column{
       &shim.Column{Value: &shim.Column_String_{String_: row.Columns[0].GetString_()}},//accountID
       &shim.Column{Value: &shim.Column_String_{String_: row.Columns[1].GetString_()}},//symbol
-      &shim.Column{Value: &shim.Column_Uint64{Uint64: balance}}},//balance
+      &shim.Column{Value: &shim.Column_Uint64{Uint64: balance}},//balance
+      &shim.Column{Value: &shim.Column_Uint64{Uint64: row.Columns[3].GetUint64()}}},//reserved
   })
 
   if err != nil {
@@ -214,7 +263,7 @@ func (t *accountBalanceHandler) updateAccountBalance(stub shim.ChaincodeStubInte
     return errors.New("Cannot update account balance.")
   }
 
-  return nil
+  return capHandler.record(stub, accountID, symbol, balance)
 }
 
 
@@ -242,6 +291,8 @@ func (t *accountBalanceHandler) query(stub shim.ChaincodeStubInterface, accountI
           row.Columns[0].GetString_(),//accountID
           row.Columns[1].GetString_(),//symbol
           row.Columns[2].GetUint64(),//balance
+          row.Columns[2].GetUint64() - row.Columns[3].GetUint64(),//available
+          row.Columns[3].GetUint64(),//reserved
         }
         balMsgs = append(balMsgs, balMsg)
 
@@ -300,11 +351,93 @@ func (t *accountBalanceHandler) transferAccountBalance(stub shim.ChaincodeStubIn
   }
   myLogger.Infof("+++++++++++++++++++   BuyerBal %v" , buyerBal)
   buyerBal = volume + buyerBal;
-  t.updateAccountBalance(stub,sellerID,symbol,seller.Columns[2].GetUint64() - volume)
-  t.updateAccountBalance(stub,buyerID,symbol,buyerBal)
+  err = t.updateAccountBalance(stub,sellerID,symbol,seller.Columns[2].GetUint64() - volume)
+  if err != nil {
+    return err
+  }
+  return t.updateAccountBalance(stub,buyerID,symbol,buyerBal)
+}
+
+// getAvailableBalance returns the shares an account can still commit, i.e.
+// its balance less whatever is reserved by open sell offers and orders.
+func (t *accountBalanceHandler) getAvailableBalance(stub shim.ChaincodeStubInterface, accountID string, symbol string) (uint64, error) {
+  balance, reserved, err := t.getBalanceReserved(stub, accountID, symbol)
+  if err != nil {
+    return 0, err
+  }
+  return balance - reserved, nil
+}
+
+func (t *accountBalanceHandler) getBalanceReserved(stub shim.ChaincodeStubInterface, accountID string, symbol string) (uint64, uint64, error) {
+  var columnsTx []shim.Column
+  colAccountID := shim.Column{Value: &shim.Column_String_{String_: accountID}}
+  columnsTx = append(columnsTx, colAccountID)
+  colSymbol := shim.Column{Value: &shim.Column_String_{String_: symbol}}
+  columnsTx = append(columnsTx, colSymbol)
+
+  row, err := stub.GetRow(tableAccountBalance, columnsTx)
+  if err != nil {
+    myLogger.Errorf("system error %v", err)
+    return 0, 0, errors.New("Cannot query account balance.")
+  }
+  if len(row.Columns) == 0 {
+    return 0, 0, nil
+  }
+  return row.Columns[2].GetUint64(), row.Columns[3].GetUint64(), nil
+}
+
+func (t *accountBalanceHandler) updateReserved(stub shim.ChaincodeStubInterface, accountID string, symbol string, reserved uint64) error {
+  balance, _, err := t.getBalanceReserved(stub, accountID, symbol)
+  if err != nil {
+    return err
+  }
+  if reserved > balance {
+    return errors.New("Cannot reserve more than account balance.")
+  }
+
+  ok, err := stub.ReplaceRow(tableAccountBalance, shim.Row{
+    Columns: []*shim.Column{
+      &shim.Column{Value: &shim.Column_String_{String_: accountID}},
+      &shim.Column{Value: &shim.Column_String_{String_: symbol}},
+      &shim.Column{Value: &shim.Column_Uint64{Uint64: balance}},
+      &shim.Column{Value: &shim.Column_Uint64{Uint64: reserved}}},
+  })
+
+  if !ok || err != nil {
+    myLogger.Errorf("system error %v", err)
+    return errors.New("Cannot update reserved balance.")
+  }
   return nil
 }
 
+// reserve sets aside volume shares of the account so they cannot be offered
+// twice. It fails when the available balance is too small.
+func (t *accountBalanceHandler) reserve(stub shim.ChaincodeStubInterface, accountID string, symbol string, volume uint64) error {
+  myLogger.Debugf("reserve balance %v , %v , %v",accountID,symbol,volume)
+
+  balance, reserved, err := t.getBalanceReserved(stub, accountID, symbol)
+  if err != nil {
+    return err
+  }
+  if balance - reserved < volume {
+    return errors.New("Not enough available balance to reserve.")
+  }
+  return t.updateReserved(stub, accountID, symbol, reserved + volume)
+}
+
+func (t *accountBalanceHandler) release(stub shim.ChaincodeStubInterface, accountID string, symbol string, volume uint64) error {
+  myLogger.Debugf("release balance %v , %v , %v",accountID,symbol,volume)
+
+  _, reserved, err := t.getBalanceReserved(stub, accountID, symbol)
+  if err != nil {
+    return err
+  }
+  if reserved < volume {
+    return errors.New("Cannot release more than reserved balance.")
+  }
+  return t.updateReserved(stub, accountID, symbol, reserved - volume)
+}
+
 func (t *accountBalanceHandler) issueStock(stub shim.ChaincodeStubInterface, accountid string, symbol string, volume uint64) error {
   myLogger.Debugf("issue stock %v , %v , %v",accountid,symbol,volume)
 
@@ -323,8 +456,38 @@ func (t *accountBalanceHandler) issueStock(stub shim.ChaincodeStubInterface, acc
   if len(account.Columns) > 0 {
     bal = account.Columns[2].GetUint64()
   }
+  err = secProHandler.issue(stub, symbol, accountid, volume)
+  if err != nil {
+    return err
+  }
   bal = volume + bal;
   myLogger.Infof("+++++++++++++++++++  Total Bal %v" , bal)
-  t.updateAccountBalance(stub,accountid,symbol,bal)
-  return nil
+  err = t.updateAccountBalance(stub,accountid,symbol,bal)
+  if err != nil {
+    return err
+  }
+  return auditHandler.addSupply(stub, symbol, volume)
+}
+
+// redeemStock takes volume shares of the account out of circulation. Only
+// shares that are not reserved can be redeemed.
+func (t *accountBalanceHandler) redeemStock(stub shim.ChaincodeStubInterface, accountid string, symbol string, volume uint64) error {
+  myLogger.Debugf("redeem stock %v , %v , %v",accountid,symbol,volume)
+
+  balance, reserved, err := t.getBalanceReserved(stub, accountid, symbol)
+  if err != nil {
+    return err
+  }
+  if balance - reserved < volume {
+    return errors.New("Cannot redeem more than available balance.")
+  }
+  err = secProHandler.redeem(stub, symbol, accountid, volume)
+  if err != nil {
+    return err
+  }
+  err = t.updateAccountBalance(stub,accountid,symbol,balance - volume)
+  if err != nil {
+    return err
+  }
+  return auditHandler.removeSupply(stub, symbol, volume)
 }
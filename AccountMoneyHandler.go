@@ -9,6 +9,7 @@ import (
 const (
 	tableAccountMoney = "AccountMoney"
 	columnAmount      = "Amount"
+	columnHeld        = "Held"
 )
 
 type accountMoneyHandler struct {
@@ -18,6 +19,8 @@ type accountMoneyHandler struct {
 type AccountMoneyMsg struct {
 	AccountID string
 	Amount    uint64
+	Available uint64
+	Held      uint64
 }
 
 //
@@ -31,17 +34,19 @@ func (t *accountMoneyHandler) createTable(stub shim.ChaincodeStubInterface) erro
 	stub.CreateTable(tableAccountMoney, []*shim.ColumnDefinition{
 		&shim.ColumnDefinition{Name: columnAccountID, Type: shim.ColumnDefinition_STRING, Key: true},
 		&shim.ColumnDefinition{Name: columnAmount, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnHeld, Type: shim.ColumnDefinition_UINT64, Key: false},
 	})
 	return t.initAccountMoney(stub)
 }
 
 func (t *accountMoneyHandler) initAccountMoney(stub shim.ChaincodeStubInterface) error {
-	t.assign(stub, "investor01", 10000)
-	t.assign(stub, "investor02", 20000)
-	t.assign(stub, "investor03", 30000)
-	t.assign(stub, "owner01", 0)
-	t.assign(stub, "owner02", 0)
-	t.assign(stub, "owner03", 0)
+	// amounts are in minor currency units, see Money.go
+	t.addMoney(stub, "investor01", 10000*MONEY_SCALE)
+	t.addMoney(stub, "investor02", 20000*MONEY_SCALE)
+	t.addMoney(stub, "investor03", 30000*MONEY_SCALE)
+	t.addMoney(stub, "owner01", 0)
+	t.addMoney(stub, "owner02", 0)
+	t.addMoney(stub, "owner03", 0)
 
 	// t.assign(stub, "AA01", 100000)
 	// t.assign(stub, "AA02", 100000)
@@ -66,7 +71,8 @@ func (t *accountMoneyHandler) assign(stub shim.ChaincodeStubInterface,
 	ok, err := stub.InsertRow(tableAccountMoney, shim.Row{
 		Columns: []*shim.Column{
 			&shim.Column{Value: &shim.Column_String_{String_: accountID}},
-			&shim.Column{Value: &shim.Column_Uint64{Uint64: amount}}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: amount}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: 0}}},
 	})
 
 	// you can only assign balances to new account IDs
@@ -84,31 +90,104 @@ func (t *accountMoneyHandler) updateAccountBalance(stub shim.ChaincodeStubInterf
 
 	myLogger.Debugf("update accountID= %v", accountID)
 
+	held, err := t.queryHeld(stub, accountID)
+	if err != nil {
+		return err
+	}
+
+	return t.replace(stub, accountID, amount, held)
+}
+
+func (t *accountMoneyHandler) replace(stub shim.ChaincodeStubInterface,
+	accountID string,
+	amount uint64,
+	held uint64) error {
+
+	if held > amount {
+		return errors.New("held money exceeds balance of account Id." + accountID)
+	}
+
 	ok, err := stub.ReplaceRow(tableAccountMoney, shim.Row{
 		Columns: []*shim.Column{
 			&shim.Column{Value: &shim.Column_String_{String_: accountID}},
-			&shim.Column{Value: &shim.Column_Uint64{Uint64: amount}}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: amount}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: held}}},
 	})
 
-	if !ok && err == nil {
+	if !ok || err != nil {
 		myLogger.Errorf("system error %v", err)
 		return errors.New("failed to replace row with account Id." + accountID)
 	}
 	return nil
 }
 
+// hold sets aside amount of the account's money for a trade it has committed
+// to. Held money stays in the balance but cannot be committed again.
+func (t *accountMoneyHandler) hold(stub shim.ChaincodeStubInterface,
+	accountID string,
+	amount uint64) error {
+
+	myLogger.Debugf("hold params= %v , %v ", accountID, amount)
+
+	balance, err := t.queryBalance(stub, accountID)
+	if err != nil {
+		return err
+	}
+	held, err := t.queryHeld(stub, accountID)
+	if err != nil {
+		return err
+	}
+	if balance-held < amount {
+		return errors.New("not enough money to hold")
+	}
+
+	return t.replace(stub, accountID, balance, held+amount)
+}
+
+func (t *accountMoneyHandler) releaseHold(stub shim.ChaincodeStubInterface,
+	accountID string,
+	amount uint64) error {
+
+	myLogger.Debugf("release hold params= %v , %v ", accountID, amount)
+
+	balance, err := t.queryBalance(stub, accountID)
+	if err != nil {
+		return err
+	}
+	held, err := t.queryHeld(stub, accountID)
+	if err != nil {
+		return err
+	}
+	if held < amount {
+		return errors.New("cannot release more than held money")
+	}
+
+	return t.replace(stub, accountID, balance, held-amount)
+}
+
 func (t *accountMoneyHandler) addMoney(stub shim.ChaincodeStubInterface,
 	accountID string,
 	amount uint64) error {
 
 	myLogger.Debugf("addMoney accountID= %v", accountID)
 
+	// every deposit is counted so the auditor can check cash is conserved
+	err := auditHandler.addDeposit(stub, amount)
+	if err != nil {
+		return err
+	}
+
 	currentAmt, err := t.queryBalance(stub, accountID)
 	if err != nil {
 		return t.assign(stub, accountID, amount)
 	}
 
-	return t.updateAccountBalance(stub, accountID, amount+currentAmt)
+	total, err := addAmount(currentAmt, amount)
+	if err != nil {
+		return err
+	}
+
+	return t.updateAccountBalance(stub, accountID, total)
 }
 
 func (t *accountMoneyHandler) deleteAccountRecord(stub shim.ChaincodeStubInterface, accountID string) error {
@@ -162,7 +241,10 @@ func (t *accountMoneyHandler) transfer(stub shim.ChaincodeStubInterface, fromAcc
 			return errors.New("error in transfer money to fromAccount ")
 		}
 
-		acctBalanceT += remaining
+		acctBalanceT, err = addAmount(acctBalanceT, remaining)
+		if err != nil {
+			return err
+		}
 		err = t.updateAccountBalance(stub, toAccount, acctBalanceT)
 		if err != nil {
 			return errors.New("error in transfer money to toAccount ")
@@ -188,6 +270,35 @@ func (t *accountMoneyHandler) queryBalance(stub shim.ChaincodeStubInterface, acc
 	return row.Columns[1].GetUint64(), nil
 }
 
+func (t *accountMoneyHandler) queryHeld(stub shim.ChaincodeStubInterface, accountID string) (uint64, error) {
+
+	row, err := t.queryTable(stub, accountID)
+	if err != nil {
+		return 0, err
+	}
+	if len(row.Columns) == 0 || row.Columns[2] == nil {
+		return 0, errors.New("row or column value not found")
+	}
+
+	return row.Columns[2].GetUint64(), nil
+}
+
+// queryAvailable returns the money an account can still commit, its balance
+// less whatever is held for open bids and orders.
+func (t *accountMoneyHandler) queryAvailable(stub shim.ChaincodeStubInterface, accountID string) (uint64, error) {
+
+	balance, err := t.queryBalance(stub, accountID)
+	if err != nil {
+		return 0, err
+	}
+	held, err := t.queryHeld(stub, accountID)
+	if err != nil {
+		return 0, err
+	}
+
+	return balance - held, nil
+}
+
 func (t *accountMoneyHandler) queryTable(stub shim.ChaincodeStubInterface, accountID string) (shim.Row, error) {
 
 	var columns []shim.Column
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	tableAuction        = "Auction"
+	tableAuctionBid     = "AuctionBid"
+	columnAuctionID     = "AuctionID"
+	columnIssuerID      = "IssuerID"
+	columnMinPrice      = "MinPrice"
+	columnCloseTime     = "CloseTime"
+	columnClearingPrice = "ClearingPrice"
+	columnAllocated     = "Allocated"
+	columnBidderID      = "BidderID"
+
+	stateCurrAuctionID = "CurrAuctionID"
+
+	AUCTION_OPEN      = "Open"
+	AUCTION_CLOSED    = "Closed"
+	AUCTION_CANCELLED = "Cancelled"
+)
+
+type auctionHandler struct {
+}
+
+// AuctionMsg is a Dutch auction of a new tranche of Volume shares of Symbol.
+// Bids are taken until CloseTime; closing it allocates the tranche at a
+// single ClearingPrice, the lowest price among the winning bids.
+type AuctionMsg struct {
+	AuctionID     uint64
+	Symbol        string
+	IssuerID      string
+	Volume        uint64
+	MinPrice      string
+	CloseTime     string
+	Status        string
+	ClearingPrice string
+	Allocated     uint64
+	LastUpdated   string
+	Bids          []AuctionBidMsg
+}
+
+// AuctionBidMsg is an investor's sealed bid. Price times Volume is held from
+// the bidder's money until the auction is closed. Seq orders bids at the
+// same price by the time they were placed.
+type AuctionBidMsg struct {
+	AuctionID   uint64
+	BidderID    string
+	Price       string
+	Volume      uint64
+	Allocated   uint64
+	Seq         uint64
+	LastUpdated string
+}
+
+// bidQueue ranks bids for allocation, best price first and then first come.
+type bidQueue []*AuctionBidMsg
+
+func (q bidQueue) Len() int      { return len(q) }
+func (q bidQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q bidQueue) Less(i, j int) bool {
+	pi, _, _ := parsePrice(q[i].Price)
+	pj, _, _ := parsePrice(q[j].Price)
+	if pi != pj {
+		return pi > pj
+	}
+	return q[i].Seq < q[j].Seq
+}
+
+//
+func NewAuctionHandler() *auctionHandler {
+	return &auctionHandler{}
+}
+
+func (t *auctionHandler) createTable(stub shim.ChaincodeStubInterface) error {
+
+	err := stub.CreateTable(tableAuction, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnAuctionID, Type: shim.ColumnDefinition_UINT64, Key: true},
+		&shim.ColumnDefinition{Name: columnSymbol, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnIssuerID, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnVolume, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnMinPrice, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnCloseTime, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnStatus, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnClearingPrice, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnAllocated, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnLastUpdated, Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		myLogger.Errorf("system error create table auction %v", err)
+		return errors.New("Cannot create table auction.")
+	}
+
+	err = stub.CreateTable(tableAuctionBid, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnAuctionID, Type: shim.ColumnDefinition_UINT64, Key: true},
+		&shim.ColumnDefinition{Name: columnBidderID, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnPrice, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnVolume, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnAllocated, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnSeq, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnLastUpdated, Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		myLogger.Errorf("system error create table auction bid %v", err)
+		return errors.New("Cannot create table auction bid.")
+	}
+
+	return nil
+}
+
+func (t *auctionHandler) nextAuctionID(stub shim.ChaincodeStubInterface) (uint64, error) {
+	var auctionID uint64 = 1
+
+	tmpbytes, err := stub.GetState(stateCurrAuctionID)
+	if err == nil && tmpbytes != nil {
+		auctionID, err = strconv.ParseUint(string(tmpbytes), 10, 64)
+		if err != nil {
+			return 0, errors.New("Cannot get auction ID.")
+		}
+		auctionID++
+	}
+
+	return auctionID, stub.PutState(stateCurrAuctionID, []byte(strconv.FormatUint(auctionID, 10)))
+}
+
+// insert opens an auction.
+func (t *auctionHandler) insert(stub shim.ChaincodeStubInterface, auction *AuctionMsg) (uint64, error) {
+
+	auctionID, err := t.nextAuctionID(stub)
+	if err != nil {
+		return 0, err
+	}
+	auction.AuctionID = auctionID
+	auction.Status = AUCTION_OPEN
+
+	err = t.putAuction(stub, auction, true)
+	if err != nil {
+		return 0, err
+	}
+
+	myLogger.Debugf("insert auction [%v]", auctionID)
+	return auctionID, nil
+}
+
+func (t *auctionHandler) putAuction(stub shim.ChaincodeStubInterface, auction *AuctionMsg, insert bool) error {
+
+	lastUpdated, err := txHandler.getCurrentTime(stub)
+	if err != nil {
+		return err
+	}
+	auction.LastUpdated = lastUpdated
+
+	row := shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: auction.AuctionID}},
+			&shim.Column{Value: &shim.Column_String_{String_: auction.Symbol}},
+			&shim.Column{Value: &shim.Column_String_{String_: auction.IssuerID}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: auction.Volume}},
+			&shim.Column{Value: &shim.Column_String_{String_: auction.MinPrice}},
+			&shim.Column{Value: &shim.Column_String_{String_: auction.CloseTime}},
+			&shim.Column{Value: &shim.Column_String_{String_: auction.Status}},
+			&shim.Column{Value: &shim.Column_String_{String_: auction.ClearingPrice}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: auction.Allocated}},
+			&shim.Column{Value: &shim.Column_String_{String_: auction.LastUpdated}}},
+	}
+
+	var ok bool
+	if insert {
+		ok, err = stub.InsertRow(tableAuction, row)
+	} else {
+		ok, err = stub.ReplaceRow(tableAuction, row)
+	}
+	if !ok || err != nil {
+		myLogger.Errorf("system error %v", err)
+		return errors.New("Cannot save auction.")
+	}
+	return nil
+}
+
+func (t *auctionHandler) putBid(stub shim.ChaincodeStubInterface, bid *AuctionBidMsg, insert bool) error {
+
+	lastUpdated, err := txHandler.getCurrentTime(stub)
+	if err != nil {
+		return err
+	}
+	bid.LastUpdated = lastUpdated
+
+	row := shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: bid.AuctionID}},
+			&shim.Column{Value: &shim.Column_String_{String_: bid.BidderID}},
+			&shim.Column{Value: &shim.Column_String_{String_: bid.Price}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: bid.Volume}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: bid.Allocated}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: bid.Seq}},
+			&shim.Column{Value: &shim.Column_String_{String_: bid.LastUpdated}}},
+	}
+
+	var ok bool
+	if insert {
+		ok, err = stub.InsertRow(tableAuctionBid, row)
+	} else {
+		ok, err = stub.ReplaceRow(tableAuctionBid, row)
+	}
+	if !ok || err != nil {
+		myLogger.Errorf("system error %v", err)
+		return errors.New("Cannot save auction bid.")
+	}
+	return nil
+}
+
+// getAuction returns an auction with all of its bids, or nil if there is
+// none.
+func (t *auctionHandler) getAuction(stub shim.ChaincodeStubInterface, auctionID uint64) (*AuctionMsg, error) {
+
+	var columns []shim.Column
+	colAuctionID := shim.Column{Value: &shim.Column_Uint64{Uint64: auctionID}}
+	columns = append(columns, colAuctionID)
+
+	row, err := stub.GetRow(tableAuction, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot get auction.")
+	}
+	if len(row.Columns) == 0 {
+		return nil, nil
+	}
+
+	auction := AuctionMsg{
+		row.Columns[0].GetUint64(),  //auctionID
+		row.Columns[1].GetString_(), //symbol
+		row.Columns[2].GetString_(), //issuerID
+		row.Columns[3].GetUint64(),  //volume
+		row.Columns[4].GetString_(), //minPrice
+		row.Columns[5].GetString_(), //closeTime
+		row.Columns[6].GetString_(), //status
+		row.Columns[7].GetString_(), //clearingPrice
+		row.Columns[8].GetUint64(),  //allocated
+		row.Columns[9].GetString_(), //lastUpdated
+		nil,
+	}
+
+	rowChannel, err := stub.GetRows(tableAuctionBid, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot query auction bid.")
+	}
+
+	for {
+		select {
+		case row, ok := <-rowChannel:
+			if !ok {
+				rowChannel = nil
+			} else {
+				auction.Bids = append(auction.Bids, AuctionBidMsg{
+					row.Columns[0].GetUint64(),  //auctionID
+					row.Columns[1].GetString_(), //bidderID
+					row.Columns[2].GetString_(), //price
+					row.Columns[3].GetUint64(),  //volume
+					row.Columns[4].GetUint64(),  //allocated
+					row.Columns[5].GetUint64(),  //seq
+					row.Columns[6].GetString_(), //lastUpdated
+				})
+			}
+		}
+		if rowChannel == nil {
+			break
+		}
+	}
+
+	return &auction, nil
+}
+
+// bidOf returns the bid of an investor on an auction, or nil if it has not
+// bid.
+func (t *auctionHandler) bidOf(auction *AuctionMsg, bidderID string) *AuctionBidMsg {
+	for i := range auction.Bids {
+		if auction.Bids[i].BidderID == bidderID {
+			return &auction.Bids[i]
+		}
+	}
+	return nil
+}
+
+// nextSeq is the sequence number of a bid placed now.
+func (t *auctionHandler) nextSeq(auction *AuctionMsg) uint64 {
+	var seq uint64
+	for _, bid := range auction.Bids {
+		if bid.Seq > seq {
+			seq = bid.Seq
+		}
+	}
+	return seq + 1
+}
+
+// bidAmount is the money held for a bid, price times volume.
+func (t *auctionHandler) bidAmount(bid *AuctionBidMsg) (uint64, error) {
+	price, _, err := parsePrice(bid.Price)
+	if err != nil {
+		return 0, errors.New("Unable to parse Price " + bid.Price)
+	}
+	return mulAmount(price, bid.Volume)
+}
+
+// placeBid records an investor's bid, replacing its earlier one, and holds
+// the money for it.
+func (t *auctionHandler) placeBid(stub shim.ChaincodeStubInterface, auction *AuctionMsg, bidderID string, price string, volume uint64) error {
+
+	bid := t.bidOf(auction, bidderID)
+	insert := bid == nil
+	if insert {
+		bid = &AuctionBidMsg{AuctionID: auction.AuctionID, BidderID: bidderID}
+	} else {
+		held, err := t.bidAmount(bid)
+		if err != nil {
+			return err
+		}
+		err = actMonHandler.releaseHold(stub, bidderID, held)
+		if err != nil {
+			return err
+		}
+	}
+
+	// a new bid goes to the back of the queue at its price
+	bid.Seq = t.nextSeq(auction)
+	bid.Price = price
+	bid.Volume = volume
+
+	amount, err := t.bidAmount(bid)
+	if err != nil {
+		return err
+	}
+	err = actMonHandler.hold(stub, bidderID, amount)
+	if err != nil {
+		return err
+	}
+
+	return t.putBid(stub, bid, insert)
+}
+
+// allocate fills the tranche from the best bids down and sets the clearing
+// price to the lowest winning price. A bidder who does not hold the symbol
+// yet is passed over once the security's holder limit is reached.
+func (t *auctionHandler) allocate(stub shim.ChaincodeStubInterface, auction *AuctionMsg) error {
+
+	noOfHolderAllowed, err := secProHandler.getMaxNumberHolder(stub, auction.Symbol)
+	if err != nil {
+		return err
+	}
+
+	holders, err := actBalHandler.findHolderBySymbol(stub, auction.Symbol)
+	if err != nil {
+		return err
+	}
+	isHolder := make(map[string]bool)
+	for _, holder := range holders {
+		isHolder[holder.AccountID] = true
+	}
+	noOfHolders := uint64(len(holders))
+
+	queue := make(bidQueue, len(auction.Bids))
+	for i := range auction.Bids {
+		queue[i] = &auction.Bids[i]
+	}
+	sort.Sort(queue)
+
+	remaining := auction.Volume
+	for _, bid := range queue {
+		bid.Allocated = 0
+		if remaining == 0 {
+			continue
+		}
+		if !isHolder[bid.BidderID] {
+			if noOfHolders >= noOfHolderAllowed {
+				myLogger.Infof("auction [%v] bidder [%v] over holder limit", auction.AuctionID, bid.BidderID)
+				continue
+			}
+			isHolder[bid.BidderID] = true
+			noOfHolders++
+		}
+
+		bid.Allocated = bid.Volume
+		if bid.Allocated > remaining {
+			bid.Allocated = remaining
+		}
+		remaining -= bid.Allocated
+		auction.ClearingPrice = bid.Price
+	}
+
+	auction.Allocated = auction.Volume - remaining
+	return nil
+}
+
+// close allocates the tranche, collects the clearing price from every
+// winning bidder for the issuer, issues the shares and releases all the
+// money held for bids.
+func (t *auctionHandler) close(stub shim.ChaincodeStubInterface, auction *AuctionMsg) error {
+
+	err := t.allocate(stub, auction)
+	if err != nil {
+		return err
+	}
+
+	var clearingPrice uint64
+	if auction.Allocated > 0 {
+		clearingPrice, _, err = parsePrice(auction.ClearingPrice)
+		if err != nil {
+			return errors.New("Unable to parse Price " + auction.ClearingPrice)
+		}
+	}
+
+	for i := range auction.Bids {
+		bid := &auction.Bids[i]
+
+		held, err := t.bidAmount(bid)
+		if err != nil {
+			return err
+		}
+		err = actMonHandler.releaseHold(stub, bid.BidderID, held)
+		if err != nil {
+			return err
+		}
+
+		if bid.Allocated > 0 {
+			amount, err := mulAmount(clearingPrice, bid.Allocated)
+			if err != nil {
+				return err
+			}
+			err = actMonHandler.transfer(stub, bid.BidderID, auction.IssuerID, amount)
+			if err != nil {
+				return err
+			}
+			err = actBalHandler.issueStock(stub, bid.BidderID, auction.Symbol, bid.Allocated)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = t.putBid(stub, bid, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	myLogger.Infof("auction [%v] closed at [%v] allocated [%v]", auction.AuctionID, auction.ClearingPrice, auction.Allocated)
+	auction.Status = AUCTION_CLOSED
+	return t.putAuction(stub, auction, false)
+}
+
+// cancel withdraws an open auction and releases the money held for bids.
+func (t *auctionHandler) cancel(stub shim.ChaincodeStubInterface, auction *AuctionMsg) error {
+
+	for i := range auction.Bids {
+		held, err := t.bidAmount(&auction.Bids[i])
+		if err != nil {
+			return err
+		}
+		err = actMonHandler.releaseHold(stub, auction.Bids[i].BidderID, held)
+		if err != nil {
+			return err
+		}
+	}
+
+	auction.Status = AUCTION_CANCELLED
+	return t.putAuction(stub, auction, false)
+}
+
+// visibleTo keeps bids sealed: a bidder only sees its own bid and the issuer
+// sees all of them once the auction is closed.
+func (t *auctionHandler) visibleTo(auction *AuctionMsg, accountID string) *AuctionMsg {
+	if accountID == auction.IssuerID && auction.Status == AUCTION_CLOSED {
+		return auction
+	}
+	var bids []AuctionBidMsg
+	if bid := t.bidOf(auction, accountID); bid != nil {
+		bids = append(bids, *bid)
+	}
+	auction.Bids = bids
+	return auction
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOpenAuctionIssuer(t *testing.T) {
+	defer restoreClock()
+
+	tests := []struct {
+		name     string
+		issuerID string
+		symbol   string
+		wantErr  bool
+	}{
+		{"own symbol", "owner01", "Ookbee", false},
+		{"another issuer's symbol", "owner02", "Ookbee", true},
+		{"unknown symbol", "owner01", "Nope", true},
+	}
+
+	for _, tc := range tests {
+		stub := newTestStub(t)
+		err := stub.as(tc.issuerID, ROLE_ISSUER).invoke("openAuction", tc.symbol, "1000", "1", formatTime(testEpoch.Add(time.Hour)))
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%v: error %v, want error %v", tc.name, err, tc.wantErr)
+		}
+		if auction, _ := auctHandler.getAuction(stub, 1); (auction != nil) == tc.wantErr {
+			t.Errorf("%v: auction %v", tc.name, auction)
+		}
+	}
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	tableBalanceHistory   = "BalanceHistory"
+	tableBalanceTx        = "BalanceTx"
+	tableCapTableSnapshot = "CapTableSnapshot"
+	columnLedgerTxID      = "LedgerTxID"
+	columnSnapshotName    = "SnapshotName"
+	columnAsOf            = "AsOf"
+
+	stateCurrBalanceSeq = "CurrBalanceSeq"
+)
+
+type capTableHandler struct {
+}
+
+// BalanceChangeMsg is one entry in the balance history of a symbol: the
+// balance an account held after a change, the ledger transaction that made
+// it and when. Seq numbers every change on the ledger in the order made.
+type BalanceChangeMsg struct {
+	Symbol      string
+	AccountID   string
+	Seq         uint64
+	Balance     uint64
+	LedgerTxID  string
+	LastUpdated string
+}
+
+// HoldingMsg is the balance an account held in a symbol at some point.
+type HoldingMsg struct {
+	AccountID string
+	Symbol    string
+	Balance   uint64
+}
+
+// CapTableMsg is the register of a symbol rebuilt from its balance history.
+// AsOf is the timestamp or ledger transaction it was rebuilt at and Snapshot
+// the name of the pinned snapshot, if it was asked for by name.
+type CapTableMsg struct {
+	Symbol      string
+	AsOf        string
+	Snapshot    string
+	TotalShares uint64
+	Holders     []HoldingMsg
+}
+
+// CapTableSnapshotMsg pins the register of a symbol under a name. A
+// snapshot taken at a ledger transaction keeps the Seq of its last change,
+// one taken at a timestamp keeps Seq 0 and is rebuilt from AsOf.
+type CapTableSnapshotMsg struct {
+	Symbol      string
+	Name        string
+	AsOf        string
+	Seq         uint64
+	AccountID   string
+	LastUpdated string
+}
+
+// balanceCut is the point in the balance history a register is rebuilt at,
+// either the change Seq or, when Seq is 0, the time At.
+type balanceCut struct {
+	Seq uint64
+	At  time.Time
+}
+
+func (c *balanceCut) includes(change *BalanceChangeMsg) (bool, error) {
+	if c.Seq > 0 {
+		return change.Seq <= c.Seq, nil
+	}
+	changed, err := time.Parse(time.RFC3339Nano, change.LastUpdated)
+	if err != nil {
+		return false, errors.New("Cannot parse balance history time " + change.LastUpdated)
+	}
+	return !changed.After(c.At), nil
+}
+
+// holdingQueue orders holdings by account, then symbol.
+type holdingQueue []HoldingMsg
+
+func (q holdingQueue) Len() int      { return len(q) }
+func (q holdingQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q holdingQueue) Less(i, j int) bool {
+	if q[i].AccountID != q[j].AccountID {
+		return q[i].AccountID < q[j].AccountID
+	}
+	return q[i].Symbol < q[j].Symbol
+}
+
+// snapshotQueue orders the snapshots of a symbol by name.
+type snapshotQueue []CapTableSnapshotMsg
+
+func (q snapshotQueue) Len() int           { return len(q) }
+func (q snapshotQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q snapshotQueue) Less(i, j int) bool { return q[i].Name < q[j].Name }
+
+//
+func NewCapTableHandler() *capTableHandler {
+	return &capTableHandler{}
+}
+
+func (t *capTableHandler) createTable(stub shim.ChaincodeStubInterface) error {
+
+	err := stub.CreateTable(tableBalanceHistory, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnSymbol, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnAccountID, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnSeq, Type: shim.ColumnDefinition_UINT64, Key: true},
+		&shim.ColumnDefinition{Name: columnBalance, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnLedgerTxID, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnLastUpdated, Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		myLogger.Errorf("system error create table balance history %v", err)
+		return errors.New("Cannot create table balance history.")
+	}
+
+	// the last change each ledger transaction made
+	err = stub.CreateTable(tableBalanceTx, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnLedgerTxID, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnSeq, Type: shim.ColumnDefinition_UINT64, Key: false},
+	})
+	if err != nil {
+		myLogger.Errorf("system error create table balance tx %v", err)
+		return errors.New("Cannot create table balance tx.")
+	}
+
+	err = stub.CreateTable(tableCapTableSnapshot, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnSymbol, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnSnapshotName, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnAsOf, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnSeq, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnAccountID, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnLastUpdated, Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		myLogger.Errorf("system error create table cap table snapshot %v", err)
+		return errors.New("Cannot create table cap table snapshot.")
+	}
+
+	return nil
+}
+
+func (t *capTableHandler) currSeq(stub shim.ChaincodeStubInterface) (uint64, error) {
+	tmpbytes, err := stub.GetState(stateCurrBalanceSeq)
+	if err != nil || tmpbytes == nil {
+		return 0, nil
+	}
+	seq, err := strconv.ParseUint(string(tmpbytes), 10, 64)
+	if err != nil {
+		return 0, errors.New("Cannot get balance history sequence.")
+	}
+	return seq, nil
+}
+
+// record appends the new balance of an account to the history of symbol.
+// Every change to an account balance is recorded here.
+func (t *capTableHandler) record(stub shim.ChaincodeStubInterface, accountID string, symbol string, balance uint64) error {
+
+	seq, err := t.currSeq(stub)
+	if err != nil {
+		return err
+	}
+	seq++
+	err = stub.PutState(stateCurrBalanceSeq, []byte(strconv.FormatUint(seq, 10)))
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return errors.New("Cannot put balance history sequence.")
+	}
+
+	lastUpdated, err := txHandler.getCurrentTime(stub)
+	if err != nil {
+		return err
+	}
+	ledgerTxID := stub.GetTxID()
+
+	ok, err := stub.InsertRow(tableBalanceHistory, shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: symbol}},
+			&shim.Column{Value: &shim.Column_String_{String_: accountID}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: seq}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: balance}},
+			&shim.Column{Value: &shim.Column_String_{String_: ledgerTxID}},
+			&shim.Column{Value: &shim.Column_String_{String_: lastUpdated}}},
+	})
+	if !ok || err != nil {
+		myLogger.Errorf("system error %v", err)
+		return errors.New("Cannot insert balance history.")
+	}
+
+	row := shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: ledgerTxID}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: seq}}},
+	}
+	ok, err = stub.ReplaceRow(tableBalanceTx, row)
+	if err == nil && !ok {
+		ok, err = stub.InsertRow(tableBalanceTx, row)
+	}
+	if !ok || err != nil {
+		myLogger.Errorf("system error %v", err)
+		return errors.New("Cannot update balance tx.")
+	}
+
+	return nil
+}
+
+// findBalanceChange returns the balance history of symbol, of a single
+// account if accountID is set, in no particular order.
+func (t *capTableHandler) findBalanceChange(stub shim.ChaincodeStubInterface, symbol string, accountID string) ([]BalanceChangeMsg, error) {
+
+	var columns []shim.Column
+	colSymbol := shim.Column{Value: &shim.Column_String_{String_: symbol}}
+	columns = append(columns, colSymbol)
+	if accountID != "" {
+		colAccountID := shim.Column{Value: &shim.Column_String_{String_: accountID}}
+		columns = append(columns, colAccountID)
+	}
+
+	rowChannel, err := stub.GetRows(tableBalanceHistory, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot query balance history.")
+	}
+
+	var changes []BalanceChangeMsg
+
+	for {
+		select {
+		case row, ok := <-rowChannel:
+			if !ok {
+				rowChannel = nil
+			} else {
+				changes = append(changes, BalanceChangeMsg{
+					row.Columns[0].GetString_(), //symbol
+					row.Columns[1].GetString_(), //accountID
+					row.Columns[2].GetUint64(),  //seq
+					row.Columns[3].GetUint64(),  //balance
+					row.Columns[4].GetString_(), //ledgerTxID
+					row.Columns[5].GetString_(), //lastUpdated
+				})
+			}
+		}
+		if rowChannel == nil {
+			break
+		}
+	}
+
+	return changes, nil
+}
+
+// resolve turns asOf, a timestamp or the ID of a ledger transaction that
+// changed a balance, into a point in the balance history.
+func (t *capTableHandler) resolve(stub shim.ChaincodeStubInterface, asOf string) (*balanceCut, error) {
+
+	at, err := time.Parse(time.RFC3339Nano, asOf)
+	if err == nil {
+		return &balanceCut{At: at}, nil
+	}
+
+	var columns []shim.Column
+	colTxID := shim.Column{Value: &shim.Column_String_{String_: asOf}}
+	columns = append(columns, colTxID)
+
+	row, err := stub.GetRow(tableBalanceTx, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot query balance tx.")
+	}
+	if len(row.Columns) == 0 {
+		return nil, errors.New("No balance changed in ledger transaction " + asOf)
+	}
+
+	return &balanceCut{Seq: row.Columns[1].GetUint64()}, nil
+}
+
+// balancesAt replays changes up to cut and returns the balance each account
+// was left with, leaving out accounts that held nothing.
+func (t *capTableHandler) balancesAt(changes []BalanceChangeMsg, cut *balanceCut) ([]HoldingMsg, error) {
+
+	latest := make(map[[2]string]*BalanceChangeMsg)
+	for i := range changes {
+		change := &changes[i]
+		included, err := cut.includes(change)
+		if err != nil {
+			return nil, err
+		}
+		if !included {
+			continue
+		}
+		key := [2]string{change.Symbol, change.AccountID}
+		if last, ok := latest[key]; !ok || change.Seq > last.Seq {
+			latest[key] = change
+		}
+	}
+
+	var holdings holdingQueue
+	for _, change := range latest {
+		if change.Balance > 0 {
+			holdings = append(holdings, HoldingMsg{change.AccountID, change.Symbol, change.Balance})
+		}
+	}
+	sort.Sort(holdings)
+
+	return holdings, nil
+}
+
+// capTable rebuilds the register of symbol at cut.
+func (t *capTableHandler) capTable(stub shim.ChaincodeStubInterface, symbol string, cut *balanceCut) (*CapTableMsg, error) {
+
+	changes, err := t.findBalanceChange(stub, symbol, "")
+	if err != nil {
+		return nil, err
+	}
+	holders, err := t.balancesAt(changes, cut)
+	if err != nil {
+		return nil, err
+	}
+
+	capTable := CapTableMsg{Symbol: symbol, Holders: holders}
+	for _, holder := range holders {
+		capTable.TotalShares += holder.Balance
+	}
+	return &capTable, nil
+}
+
+// holdingsOf rebuilds the balance accountID held in every symbol at cut.
+func (t *capTableHandler) holdingsOf(stub shim.ChaincodeStubInterface, accountID string, cut *balanceCut) ([]HoldingMsg, error) {
+
+	var columns []shim.Column
+	colAccountID := shim.Column{Value: &shim.Column_String_{String_: accountID}}
+	columns = append(columns, colAccountID)
+
+	// an account keeps its balance row once it has held a symbol
+	rowChannel, err := stub.GetRows(tableAccountBalance, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot query account balance.")
+	}
+
+	var symbols []string
+
+	for {
+		select {
+		case row, ok := <-rowChannel:
+			if !ok {
+				rowChannel = nil
+			} else {
+				symbols = append(symbols, row.Columns[1].GetString_())
+			}
+		}
+		if rowChannel == nil {
+			break
+		}
+	}
+
+	var changes []BalanceChangeMsg
+	for _, symbol := range symbols {
+		symbolChanges, err := t.findBalanceChange(stub, symbol, accountID)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, symbolChanges...)
+	}
+
+	return t.balancesAt(changes, cut)
+}
+
+// pin keeps the register of symbol at asOf under name. Without asOf the
+// register is pinned as it stands now.
+func (t *capTableHandler) pin(stub shim.ChaincodeStubInterface, symbol string, name string, asOf string, accountID string) error {
+
+	snapshot, err := t.getSnapshot(stub, symbol, name)
+	if err != nil {
+		return err
+	}
+	if snapshot != nil {
+		return errors.New("Snapshot " + name + " of " + symbol + " is already pinned")
+	}
+
+	now, err := ledgerClock.Now(stub)
+	if err != nil {
+		return err
+	}
+
+	var cut *balanceCut
+	if asOf == "" {
+		seq, err := t.currSeq(stub)
+		if err != nil {
+			return err
+		}
+		cut = &balanceCut{Seq: seq, At: now}
+		asOf = formatTime(now)
+	} else {
+		cut, err = t.resolve(stub, asOf)
+		if err != nil {
+			return err
+		}
+		// changes made later at the same time would move the register
+		if cut.Seq == 0 && !cut.At.Before(now) {
+			return errors.New("Snapshot time must be in the past")
+		}
+	}
+
+	ok, err := stub.InsertRow(tableCapTableSnapshot, shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: symbol}},
+			&shim.Column{Value: &shim.Column_String_{String_: name}},
+			&shim.Column{Value: &shim.Column_String_{String_: asOf}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: cut.Seq}},
+			&shim.Column{Value: &shim.Column_String_{String_: accountID}},
+			&shim.Column{Value: &shim.Column_String_{String_: formatTime(now)}}},
+	})
+	if !ok || err != nil {
+		myLogger.Errorf("system error %v", err)
+		return errors.New("Cannot insert cap table snapshot.")
+	}
+
+	return nil
+}
+
+func (t *capTableHandler) getSnapshot(stub shim.ChaincodeStubInterface, symbol string, name string) (*CapTableSnapshotMsg, error) {
+
+	var columns []shim.Column
+	colSymbol := shim.Column{Value: &shim.Column_String_{String_: symbol}}
+	columns = append(columns, colSymbol)
+	colName := shim.Column{Value: &shim.Column_String_{String_: name}}
+	columns = append(columns, colName)
+
+	row, err := stub.GetRow(tableCapTableSnapshot, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot query cap table snapshot.")
+	}
+	if len(row.Columns) == 0 {
+		return nil, nil
+	}
+
+	return &CapTableSnapshotMsg{
+		row.Columns[0].GetString_(), //symbol
+		row.Columns[1].GetString_(), //name
+		row.Columns[2].GetString_(), //asOf
+		row.Columns[3].GetUint64(),  //seq
+		row.Columns[4].GetString_(), //accountID
+		row.Columns[5].GetString_(), //lastUpdated
+	}, nil
+}
+
+// findSnapshot returns the pinned snapshots of symbol ordered by name.
+func (t *capTableHandler) findSnapshot(stub shim.ChaincodeStubInterface, symbol string) ([]CapTableSnapshotMsg, error) {
+
+	var columns []shim.Column
+	colSymbol := shim.Column{Value: &shim.Column_String_{String_: symbol}}
+	columns = append(columns, colSymbol)
+
+	rowChannel, err := stub.GetRows(tableCapTableSnapshot, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot query cap table snapshot.")
+	}
+
+	var snapshots snapshotQueue
+
+	for {
+		select {
+		case row, ok := <-rowChannel:
+			if !ok {
+				rowChannel = nil
+			} else {
+				snapshots = append(snapshots, CapTableSnapshotMsg{
+					row.Columns[0].GetString_(), //symbol
+					row.Columns[1].GetString_(), //name
+					row.Columns[2].GetString_(), //asOf
+					row.Columns[3].GetUint64(),  //seq
+					row.Columns[4].GetString_(), //accountID
+					row.Columns[5].GetString_(), //lastUpdated
+				})
+			}
+		}
+		if rowChannel == nil {
+			break
+		}
+	}
+	sort.Sort(snapshots)
+
+	return snapshots, nil
+}
+
+// query returns the register of symbol as of a timestamp or a ledger
+// transaction.
+func (t *capTableHandler) query(stub shim.ChaincodeStubInterface, symbol string, asOf string) ([]byte, error) {
+	cut, err := t.resolve(stub, asOf)
+	if err != nil {
+		return nil, err
+	}
+	capTable, err := t.capTable(stub, symbol, cut)
+	if err != nil {
+		return nil, err
+	}
+	capTable.AsOf = asOf
+
+	capTableJson, err := json.Marshal(capTable)
+	myLogger.Debugf("Response : %s", capTableJson)
+
+	return capTableJson, nil
+}
+
+// querySnapshot returns the register of symbol pinned under name.
+func (t *capTableHandler) querySnapshot(stub shim.ChaincodeStubInterface, symbol string, name string) ([]byte, error) {
+	snapshot, err := t.getSnapshot(stub, symbol, name)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot == nil {
+		return nil, errors.New("No snapshot " + name + " of " + symbol)
+	}
+
+	cut := &balanceCut{Seq: snapshot.Seq}
+	if snapshot.Seq == 0 {
+		cut.At, err = time.Parse(time.RFC3339Nano, snapshot.AsOf)
+		if err != nil {
+			return nil, errors.New("Cannot parse snapshot time " + snapshot.AsOf)
+		}
+	}
+	capTable, err := t.capTable(stub, symbol, cut)
+	if err != nil {
+		return nil, err
+	}
+	capTable.AsOf = snapshot.AsOf
+	capTable.Snapshot = snapshot.Name
+
+	capTableJson, err := json.Marshal(capTable)
+	myLogger.Debugf("Response : %s", capTableJson)
+
+	return capTableJson, nil
+}
+
+// queryHoldings returns the balances of an account as of a timestamp or a
+// ledger transaction.
+func (t *capTableHandler) queryHoldings(stub shim.ChaincodeStubInterface, accountID string, asOf string) ([]byte, error) {
+	cut, err := t.resolve(stub, asOf)
+	if err != nil {
+		return nil, err
+	}
+	holdings, err := t.holdingsOf(stub, accountID, cut)
+	if err != nil {
+		return nil, err
+	}
+
+	holdingsJson, err := json.Marshal(holdings)
+	myLogger.Debugf("Response : %s", holdingsJson)
+
+	return holdingsJson, nil
+}
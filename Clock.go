@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Clock tells the chaincode what time it is. Every peer has to see the same
+// value for the same transaction, so the default reads the transaction
+// timestamp from the stub instead of the local wall clock.
+type Clock interface {
+	Now(stub shim.ChaincodeStubInterface) (time.Time, error)
+}
+
+type txTimestampClock struct {
+}
+
+// ledgerClock is the clock used by every handler. Tests may replace it with
+// a fixed clock.
+var ledgerClock Clock = NewTxTimestampClock()
+
+//
+func NewTxTimestampClock() *txTimestampClock {
+	return &txTimestampClock{}
+}
+
+func (c *txTimestampClock) Now(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil || ts == nil {
+		myLogger.Errorf("system error %v", err)
+		return time.Time{}, errors.New("Cannot get transaction timestamp")
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC(), nil
+}
+
+// formatTime is the string form used for every time stored on the ledger.
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// timestampStub only answers GetTxTimestamp.
+type timestampStub struct {
+	shim.ChaincodeStubInterface
+	ts *timestamp.Timestamp
+}
+
+func (s *timestampStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return s.ts, nil
+}
+
+func TestTxTimestampClock(t *testing.T) {
+	tests := []struct {
+		name    string
+		ts      *timestamp.Timestamp
+		want    time.Time
+		wantErr bool
+	}{
+		{"seconds", &timestamp.Timestamp{Seconds: testEpoch.Unix()}, testEpoch, false},
+		{"nanos", &timestamp.Timestamp{Seconds: testEpoch.Unix(), Nanos: 500}, testEpoch.Add(500), false},
+		{"no timestamp", nil, time.Time{}, true},
+	}
+
+	for _, tc := range tests {
+		got, err := NewTxTimestampClock().Now(&timestampStub{ts: tc.ts})
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%v: error %v, want error %v", tc.name, err, tc.wantErr)
+		} else if !got.Equal(tc.want) || got.Location() != time.UTC {
+			t.Errorf("%v: now %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestLedgerTimesFromClock(t *testing.T) {
+	defer restoreClock()
+
+	stub := newTestStub(t)
+	stub.as("owner01", ROLE_ISSUER).mustInvoke("sell", "Ookbee", "investor01", "1", "10")
+	if txMsg := stub.transaction(1); txMsg.LastUpdated != formatTime(testEpoch) {
+		t.Errorf("offer stamped %v, want %v", txMsg.LastUpdated, formatTime(testEpoch))
+	}
+
+	stub.clock.advance(90 * time.Minute)
+	stub.as("owner01", ROLE_ISSUER).mustInvoke("sell", "Ookbee", "investor01", "1", "10")
+	if txMsg := stub.transaction(2); txMsg.LastUpdated != formatTime(testEpoch.Add(90*time.Minute)) {
+		t.Errorf("offer stamped %v, want %v", txMsg.LastUpdated, formatTime(testEpoch.Add(90*time.Minute)))
+	}
+}
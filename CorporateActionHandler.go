@@ -0,0 +1,480 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	tableCorporateAction = "CorporateAction"
+	columnActionID       = "ActionID"
+	columnActionType     = "ActionType"
+	columnRatio          = "Ratio"
+	columnPolicy         = "Policy"
+	columnSupplyBefore   = "SupplyBefore"
+	columnSupplyAfter    = "SupplyAfter"
+
+	stateCurrActionID = "CurrActionID"
+
+	CORP_ACTION_SPLIT         = "Split"
+	CORP_ACTION_REVERSE_SPLIT = "ReverseSplit"
+	CORP_ACTION_RIGHTS        = "RightsOffering"
+	CORP_ACTION_REDEMPTION    = "Redemption"
+
+	// what a holder gets for the fraction of a share a split leaves over
+	FRACTION_ROUND        = "Round"      // rounded half up to a whole share
+	FRACTION_CASH_IN_LIEU = "CashInLieu" // dropped and paid for in cash
+)
+
+type corporateActionHandler struct {
+}
+
+// CorporateActionMsg is one entry in a symbol's corporate action history.
+// Ratio is new shares to old shares. Price is the price per share of any
+// cash that changed hands, AccountID the account paying or raising it and
+// Amount the total. HolderID and Volume are set by actions on a single
+// holding, such as a redemption.
+type CorporateActionMsg struct {
+	ActionID     uint64
+	Symbol       string
+	ActionType   string
+	Ratio        string
+	Policy       string
+	Price        string
+	AccountID    string
+	HolderID     string
+	Volume       uint64
+	SupplyBefore uint64
+	SupplyAfter  uint64
+	Amount       uint64
+	LastUpdated  string
+}
+
+// actionQueue orders a symbol's history as the actions happened.
+type actionQueue []CorporateActionMsg
+
+func (q actionQueue) Len() int           { return len(q) }
+func (q actionQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q actionQueue) Less(i, j int) bool { return q[i].ActionID < q[j].ActionID }
+
+//
+func NewCorporateActionHandler() *corporateActionHandler {
+	return &corporateActionHandler{}
+}
+
+func (t *corporateActionHandler) createTable(stub shim.ChaincodeStubInterface) error {
+
+	err := stub.CreateTable(tableCorporateAction, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnSymbol, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnActionID, Type: shim.ColumnDefinition_UINT64, Key: true},
+		&shim.ColumnDefinition{Name: columnActionType, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnRatio, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnPolicy, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnPrice, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnAccountID, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnHolderID, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnVolume, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnSupplyBefore, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnSupplyAfter, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnAmount, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnLastUpdated, Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		myLogger.Errorf("system error create table corporate action %v", err)
+		return errors.New("Cannot create table corporate action.")
+	}
+
+	return nil
+}
+
+func (t *corporateActionHandler) nextActionID(stub shim.ChaincodeStubInterface) (uint64, error) {
+	var actionID uint64 = 1
+
+	tmpbytes, err := stub.GetState(stateCurrActionID)
+	if err == nil && tmpbytes != nil {
+		actionID, err = strconv.ParseUint(string(tmpbytes), 10, 64)
+		if err != nil {
+			return 0, errors.New("Cannot get corporate action ID.")
+		}
+		actionID++
+	}
+
+	return actionID, stub.PutState(stateCurrActionID, []byte(strconv.FormatUint(actionID, 10)))
+}
+
+// record adds an action to the history of its symbol.
+func (t *corporateActionHandler) record(stub shim.ChaincodeStubInterface, action *CorporateActionMsg) (uint64, error) {
+
+	actionID, err := t.nextActionID(stub)
+	if err != nil {
+		return 0, err
+	}
+	action.ActionID = actionID
+
+	lastUpdated, err := txHandler.getCurrentTime(stub)
+	if err != nil {
+		return 0, err
+	}
+	action.LastUpdated = lastUpdated
+
+	ok, err := stub.InsertRow(tableCorporateAction, shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: action.Symbol}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: action.ActionID}},
+			&shim.Column{Value: &shim.Column_String_{String_: action.ActionType}},
+			&shim.Column{Value: &shim.Column_String_{String_: action.Ratio}},
+			&shim.Column{Value: &shim.Column_String_{String_: action.Policy}},
+			&shim.Column{Value: &shim.Column_String_{String_: action.Price}},
+			&shim.Column{Value: &shim.Column_String_{String_: action.AccountID}},
+			&shim.Column{Value: &shim.Column_String_{String_: action.HolderID}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: action.Volume}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: action.SupplyBefore}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: action.SupplyAfter}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: action.Amount}},
+			&shim.Column{Value: &shim.Column_String_{String_: action.LastUpdated}}},
+	})
+	if !ok || err != nil {
+		myLogger.Errorf("system error %v", err)
+		return 0, errors.New("Cannot insert corporate action.")
+	}
+
+	myLogger.Infof("corporate action [%v] %v on [%v]", actionID, action.ActionType, action.Symbol)
+	return actionID, nil
+}
+
+// findCorporateAction returns the history of a symbol, oldest first.
+func (t *corporateActionHandler) findCorporateAction(stub shim.ChaincodeStubInterface, symbol string) ([]CorporateActionMsg, error) {
+
+	var columns []shim.Column
+	colSymbol := shim.Column{Value: &shim.Column_String_{String_: symbol}}
+	columns = append(columns, colSymbol)
+
+	rowChannel, err := stub.GetRows(tableCorporateAction, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot query corporate action.")
+	}
+
+	var actions []CorporateActionMsg
+
+	for {
+		select {
+		case row, ok := <-rowChannel:
+			if !ok {
+				rowChannel = nil
+			} else {
+				actions = append(actions, CorporateActionMsg{
+					row.Columns[1].GetUint64(),   //actionID
+					row.Columns[0].GetString_(),  //symbol
+					row.Columns[2].GetString_(),  //actionType
+					row.Columns[3].GetString_(),  //ratio
+					row.Columns[4].GetString_(),  //policy
+					row.Columns[5].GetString_(),  //price
+					row.Columns[6].GetString_(),  //accountID
+					row.Columns[7].GetString_(),  //holderID
+					row.Columns[8].GetUint64(),   //volume
+					row.Columns[9].GetUint64(),   //supplyBefore
+					row.Columns[10].GetUint64(),  //supplyAfter
+					row.Columns[11].GetUint64(),  //amount
+					row.Columns[12].GetString_(), //lastUpdated
+				})
+			}
+		}
+		if rowChannel == nil {
+			break
+		}
+	}
+
+	sort.Sort(actionQueue(actions))
+	return actions, nil
+}
+
+// findWaitingTransaction returns the waiting offers and bids on a symbol.
+func (t *corporateActionHandler) findWaitingTransaction(stub shim.ChaincodeStubInterface, symbol string) ([]TransactionMsg, error) {
+	return txHandler.findTransactionAt(stub, func(txMsg *TransactionMsg, now time.Time) bool {
+		return txMsg.Symbol == symbol && txMsg.Status == STATUS_WAITING &&
+			(txMsg.TxType == TXTYPE_OFFER || txMsg.TxType == TXTYPE_BID)
+	})
+}
+
+// findReservingTransaction lists the waiting baskets and the trades pending
+// settlement with a leg in a symbol, which keep its shares reserved.
+func (t *corporateActionHandler) findReservingTransaction(stub shim.ChaincodeStubInterface, symbol string) ([]string, error) {
+
+	txMsgs, err := txHandler.findTransactionAt(stub, func(txMsg *TransactionMsg, now time.Time) bool {
+		return (txMsg.Status == STATUS_WAITING && txMsg.TxType == TXTYPE_BASKET) || txMsg.Status == STATUS_CLEARING
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var sources []string
+	for i := range txMsgs {
+		txMsg := &txMsgs[i]
+		legs, err := txHandler.findLegsOf(stub, txMsg)
+		if err != nil {
+			return nil, err
+		}
+		for _, leg := range legs {
+			if leg.Symbol != symbol {
+				continue
+			}
+			if txMsg.Status == STATUS_CLEARING {
+				sources = append(sources, "trade "+strconv.FormatUint(txMsg.TransactionID, 10)+" pending settlement")
+			} else {
+				sources = append(sources, "basket "+strconv.FormatUint(txMsg.TransactionID, 10))
+			}
+			break
+		}
+	}
+	return sources, nil
+}
+
+// split multiplies every holding of the action's symbol by newShares over
+// oldShares. Waiting offers and bids are carried over at the new volume,
+// rounded down, and the equivalent price per new share rounded to the tick
+// size in the counterparty's favour, each under a new revision. Open RFQs on
+// the symbol are cancelled. Shares committed anywhere else, to a basket, the
+// order book or a trade pending settlement, have to be freed before the
+// split.
+func (t *corporateActionHandler) split(stub shim.ChaincodeStubInterface, action *CorporateActionMsg, newShares uint64, oldShares uint64) error {
+
+	symbol := action.Symbol
+
+	orders, err := orderHandler.findOpenOrderBySymbol(stub, symbol)
+	if err != nil {
+		return err
+	}
+	if len(orders) > 0 {
+		return errors.New("Open orders on " + symbol + " must be cancelled before the split")
+	}
+
+	// take the waiting transactions off their reservations and holds
+	txMsgs, err := t.findWaitingTransaction(stub, symbol)
+	if err != nil {
+		return err
+	}
+	for i := range txMsgs {
+		txMsg := &txMsgs[i]
+		if TXTYPE_OFFER == txMsg.TxType {
+			err = actBalHandler.release(stub, txMsg.SellerID, symbol, txMsg.Volume)
+		} else {
+			var amount uint64
+			amount, err = settleHandler.notional(txMsg)
+			if err == nil {
+				err = actMonHandler.releaseHold(stub, txMsg.BuyerID, amount)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// quotes are for old shares, the requester has to ask again
+	rfqs, err := rfqHandler.findOpenRFQBySymbol(stub, symbol)
+	if err != nil {
+		return err
+	}
+	for i := range rfqs {
+		err = rfqHandler.close(stub, &rfqs[i], RFQ_CANCELLED)
+		if err != nil {
+			return err
+		}
+	}
+
+	holders, err := actBalHandler.findHolderBySymbol(stub, symbol)
+	if err != nil {
+		return err
+	}
+	for _, holder := range holders {
+		if holder.Reserved > 0 {
+			sources, err := t.findReservingTransaction(stub, symbol)
+			if err != nil {
+				return err
+			}
+			if len(sources) == 0 {
+				return errors.New("Shares of " + symbol + " reserved by " + holder.AccountID + " must be released before the split")
+			}
+			return errors.New("Shares of " + symbol + " must be released before the split, reserved by " + strings.Join(sources, ", "))
+		}
+	}
+
+	var price uint64
+	if FRACTION_CASH_IN_LIEU == action.Policy {
+		price, _, err = parsePrice(action.Price)
+		if err != nil {
+			return errors.New("Unable to parse Price " + action.Price)
+		}
+	}
+
+	// rescale every holding and settle the fractions
+	for _, holder := range holders {
+		scaled, err := mulAmount(holder.Balance, newShares)
+		if err != nil {
+			return err
+		}
+		balance := scaled / oldShares
+		fraction := scaled % oldShares
+
+		if FRACTION_ROUND == action.Policy && 2*fraction >= oldShares {
+			balance++
+		}
+		if FRACTION_CASH_IN_LIEU == action.Policy && fraction > 0 && holder.AccountID != action.AccountID {
+			amount, err := mulAmount(price, fraction)
+			if err != nil {
+				return err
+			}
+			amount = amount / oldShares
+			if amount > 0 {
+				available, err := actMonHandler.queryAvailable(stub, action.AccountID)
+				if err != nil {
+					return err
+				}
+				if available < amount {
+					return errors.New("not enough money to pay cash in lieu")
+				}
+				err = actMonHandler.transfer(stub, action.AccountID, holder.AccountID, amount)
+				if err != nil {
+					return err
+				}
+				action.Amount += amount
+			}
+		}
+
+		err = actBalHandler.updateAccountBalance(stub, holder.AccountID, symbol, balance)
+		if err != nil {
+			return err
+		}
+		action.SupplyBefore += holder.Balance
+		action.SupplyAfter += balance
+	}
+
+	if action.SupplyAfter > action.SupplyBefore {
+		err = auditHandler.addSupply(stub, symbol, action.SupplyAfter-action.SupplyBefore)
+	} else {
+		err = auditHandler.removeSupply(stub, symbol, action.SupplyBefore-action.SupplyAfter)
+	}
+	if err != nil {
+		return err
+	}
+	err = secProHandler.split(stub, symbol, newShares, oldShares, action.SupplyAfter)
+	if err != nil {
+		return err
+	}
+
+	// carry the waiting transactions over to the new shares
+	for i := range txMsgs {
+		txMsg := &txMsgs[i]
+
+		scaled, err := mulAmount(txMsg.Volume, newShares)
+		if err != nil {
+			return err
+		}
+		volume := scaled / oldShares
+		if volume == 0 {
+			myLogger.Infof("transaction [%v] has no whole shares left after the split", txMsg.TransactionID)
+			err = txHandler.updateStatus(stub, txMsg.TransactionID, STATUS_EXPIRED)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		oldPrice, _, err := parsePrice(txMsg.Price)
+		if err != nil {
+			return errors.New("Unable to parse Price " + txMsg.Price)
+		}
+		scaled, err = mulAmount(oldPrice, oldShares)
+		if err != nil {
+			return err
+		}
+		// a seller does not ask less, nor a buyer bid more, than before
+		price, err := secProHandler.roundToTick(stub, symbol, scaled/newShares, TXTYPE_OFFER == txMsg.TxType)
+		if err != nil {
+			return err
+		}
+
+		err = txHandler.amend(stub, txMsg, formatAmount(price), volume)
+		if err != nil {
+			return err
+		}
+
+		if TXTYPE_OFFER == txMsg.TxType {
+			err = actBalHandler.reserve(stub, txMsg.SellerID, symbol, txMsg.Volume)
+		} else {
+			var amount uint64
+			amount, err = settleHandler.notional(txMsg)
+			if err == nil {
+				err = actMonHandler.hold(stub, txMsg.BuyerID, amount)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = t.record(stub, action)
+	return err
+}
+
+// redeem takes shares of a holder out of circulation, paying the holder
+// Price a share from AccountID when a price is given.
+func (t *corporateActionHandler) redeem(stub shim.ChaincodeStubInterface, action *CorporateActionMsg) error {
+
+	supplyBefore, err := auditHandler.getSupply(stub, action.Symbol)
+	if err != nil {
+		return err
+	}
+
+	err = actBalHandler.redeemStock(stub, action.HolderID, action.Symbol, action.Volume)
+	if err != nil {
+		return err
+	}
+
+	if action.Price != "" {
+		price, _, err := parsePrice(action.Price)
+		if err != nil {
+			return errors.New("Unable to parse Price " + action.Price)
+		}
+		action.Amount, err = mulAmount(price, action.Volume)
+		if err != nil {
+			return err
+		}
+		if action.AccountID != action.HolderID {
+			available, err := actMonHandler.queryAvailable(stub, action.AccountID)
+			if err != nil {
+				return err
+			}
+			if available < action.Amount {
+				return errors.New("not enough money to pay for the redemption")
+			}
+			err = actMonHandler.transfer(stub, action.AccountID, action.HolderID, action.Amount)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	action.SupplyBefore = supplyBefore
+	action.SupplyAfter = supplyBefore - action.Volume
+	_, err = t.record(stub, action)
+	return err
+}
+
+func (t *corporateActionHandler) query(stub shim.ChaincodeStubInterface, symbol string) ([]byte, error) {
+	actions, err := t.findCorporateAction(stub, symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	actionsJson, err := json.Marshal(actions)
+	myLogger.Debugf("Response : %s", actionsJson)
+
+	return actionsJson, nil
+}
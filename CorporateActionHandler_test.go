@@ -0,0 +1,88 @@
+package main
+
+import "testing"
+
+func TestSplit(t *testing.T) {
+	defer restoreClock()
+
+	// investor01 holds 5 ClaimDi (tick size 0.10) and owner03 offers 3 more
+	// at 1.00 when the split is applied; the issuer's own fraction is dropped
+	tests := []struct {
+		name        string
+		args        []string
+		want        map[string]uint64
+		wantMoney   uint64 // investor01's cash in lieu
+		wantPrice   string
+		wantVolume  uint64
+		wantReserve uint64
+	}{
+		{
+			"two for one",
+			[]string{"ClaimDi", "2", "1", FRACTION_ROUND},
+			map[string]uint64{"investor01": 10, "owner03": 599990},
+			0, "0.50", 6, 6,
+		},
+		{
+			"offer price rounded up to the tick size",
+			[]string{"ClaimDi", "3", "1", FRACTION_ROUND},
+			map[string]uint64{"investor01": 15, "owner03": 899985},
+			0, "0.40", 9, 9,
+		},
+		{
+			"reverse split rounds half a share up",
+			[]string{"ClaimDi", "1", "2", FRACTION_ROUND},
+			map[string]uint64{"investor01": 3, "owner03": 149998},
+			0, "2.00", 1, 1,
+		},
+		{
+			"reverse split pays cash in lieu of half a share",
+			[]string{"ClaimDi", "1", "2", FRACTION_CASH_IN_LIEU, "3", "owner03"},
+			map[string]uint64{"investor01": 2, "owner03": 149997},
+			150, "2.00", 1, 1,
+		},
+	}
+
+	for _, tc := range tests {
+		stub := newTestStub(t)
+		stub.as("tsd01", ROLE_TSD).mustInvoke("setSettlementCycle", "0")
+		stub.as("owner03", ROLE_ISSUER).mustInvoke("sell", "ClaimDi", "investor01", "1", "5")
+		stub.as("investor01", ROLE_TRADER).mustInvoke("confirmBuy", "1", "1")
+		stub.as("bot01", ROLE_BOT).mustInvoke("settleTrades")
+		stub.as("bot01", ROLE_BOT).mustInvoke("addMoney", "owner03", "1000")
+		stub.as("owner03", ROLE_ISSUER).mustInvoke("sell", "ClaimDi", "investor02", "1", "3")
+		moneyBefore := stub.money("investor01")
+
+		stub.as("tsd01", ROLE_TSD).mustInvoke("splitStock", tc.args...)
+
+		for accountID, want := range tc.want {
+			if balance, _ := stub.balance(accountID, "ClaimDi"); balance != want {
+				t.Errorf("%v: %v holds %v, want %v", tc.name, accountID, balance, want)
+			}
+		}
+		if paid := stub.money("investor01") - moneyBefore; paid != tc.wantMoney {
+			t.Errorf("%v: investor01 was paid %v, want %v", tc.name, formatAmount(paid), formatAmount(tc.wantMoney))
+		}
+		txMsg := stub.transaction(2)
+		if txMsg.Price != tc.wantPrice || txMsg.Volume != tc.wantVolume || txMsg.Revision != 2 {
+			t.Errorf("%v: offer is %v at %v revision %v, want %v at %v revision 2",
+				tc.name, txMsg.Volume, txMsg.Price, txMsg.Revision, tc.wantVolume, tc.wantPrice)
+		}
+		if _, reserved := stub.balance("owner03", "ClaimDi"); reserved != tc.wantReserve {
+			t.Errorf("%v: owner03 has %v reserved, want %v", tc.name, reserved, tc.wantReserve)
+		}
+	}
+}
+
+func TestSplitBlockedByClearing(t *testing.T) {
+	defer restoreClock()
+
+	stub := newTestStub(t)
+	stub.as("owner03", ROLE_ISSUER).mustInvoke("sell", "ClaimDi", "investor01", "1", "5")
+	stub.as("investor01", ROLE_TRADER).mustInvoke("confirmBuy", "1", "1")
+
+	err := stub.as("tsd01", ROLE_TSD).invoke("splitStock", "ClaimDi", "2", "1", FRACTION_ROUND)
+	want := "Shares of ClaimDi must be released before the split, reserved by trade 1 pending settlement"
+	if err == nil || err.Error() != want {
+		t.Errorf("split with a trade in clearing: %v, want %v", err, want)
+	}
+}
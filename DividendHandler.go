@@ -0,0 +1,560 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	tableDividend        = "Dividend"
+	tableDividendPayment = "DividendPayment"
+	tableAccountDividend = "AccountDividend"
+	columnDividendID     = "DividendID"
+	columnRecordDate     = "RecordDate"
+	columnShares         = "Shares"
+	columnTotalShares    = "TotalShares"
+	columnTotalAmount    = "TotalAmount"
+
+	stateCurrDividendID = "CurrDividendID"
+
+	// dividend rates are quoted per share with more decimals than cash so
+	// that e.g. 0.3333 THB a share can be declared
+	DIVIDEND_PRECISION = 6
+
+	DIVIDEND_DECLARED  = "Declared"
+	DIVIDEND_PAID      = "Paid"
+	DIVIDEND_FAILED    = "Failed" // the issuer could not fund the payout
+	DIVIDEND_CANCELLED = "Cancelled"
+)
+
+type dividendHandler struct {
+}
+
+// DividendMsg is a cash dividend of Rate per share of Symbol paid by the
+// issuer to whoever holds the shares on RecordDate. TotalShares and
+// TotalAmount are filled in when the holders are snapshotted and paid.
+type DividendMsg struct {
+	DividendID  uint64
+	Symbol      string
+	IssuerID    string
+	Rate        string
+	RecordDate  string
+	Status      string
+	TotalShares uint64
+	TotalAmount uint64
+	LastUpdated string
+	Payments    []DividendPaymentMsg
+}
+
+// DividendPaymentMsg is what one holder was paid for the Shares it held on
+// the record date.
+type DividendPaymentMsg struct {
+	DividendID  uint64
+	AccountID   string
+	Shares      uint64
+	Amount      uint64
+	LastUpdated string
+}
+
+// dividendQueue pays due dividends in the order they were declared.
+type dividendQueue []DividendMsg
+
+func (q dividendQueue) Len() int           { return len(q) }
+func (q dividendQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q dividendQueue) Less(i, j int) bool { return q[i].DividendID < q[j].DividendID }
+
+// remainderQueue ranks payments for the minor units left over after every
+// holder's amount was rounded down: largest remainder first, then by account.
+type remainderQueue struct {
+	payments   []DividendPaymentMsg
+	remainders []uint64
+}
+
+func (q remainderQueue) Len() int { return len(q.payments) }
+func (q remainderQueue) Swap(i, j int) {
+	q.payments[i], q.payments[j] = q.payments[j], q.payments[i]
+	q.remainders[i], q.remainders[j] = q.remainders[j], q.remainders[i]
+}
+func (q remainderQueue) Less(i, j int) bool {
+	if q.remainders[i] != q.remainders[j] {
+		return q.remainders[i] > q.remainders[j]
+	}
+	return q.payments[i].AccountID < q.payments[j].AccountID
+}
+
+//
+func NewDividendHandler() *dividendHandler {
+	return &dividendHandler{}
+}
+
+func (t *dividendHandler) createTable(stub shim.ChaincodeStubInterface) error {
+
+	err := stub.CreateTable(tableDividend, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnDividendID, Type: shim.ColumnDefinition_UINT64, Key: true},
+		&shim.ColumnDefinition{Name: columnSymbol, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnIssuerID, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnRate, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnRecordDate, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnStatus, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnTotalShares, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnTotalAmount, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnLastUpdated, Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		myLogger.Errorf("system error create table dividend %v", err)
+		return errors.New("Cannot create table dividend.")
+	}
+
+	err = stub.CreateTable(tableDividendPayment, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnDividendID, Type: shim.ColumnDefinition_UINT64, Key: true},
+		&shim.ColumnDefinition{Name: columnAccountID, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnShares, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnAmount, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnLastUpdated, Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		myLogger.Errorf("system error create table dividend payment %v", err)
+		return errors.New("Cannot create table dividend payment.")
+	}
+
+	// dividends by issuer and by holder paid
+	err = stub.CreateTable(tableAccountDividend, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnAccountID, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnDividendID, Type: shim.ColumnDefinition_UINT64, Key: true},
+	})
+	if err != nil {
+		myLogger.Errorf("system error create table account dividend %v", err)
+		return errors.New("Cannot create table account dividend.")
+	}
+
+	return nil
+}
+
+func (t *dividendHandler) nextDividendID(stub shim.ChaincodeStubInterface) (uint64, error) {
+	var dividendID uint64 = 1
+
+	tmpbytes, err := stub.GetState(stateCurrDividendID)
+	if err == nil && tmpbytes != nil {
+		dividendID, err = strconv.ParseUint(string(tmpbytes), 10, 64)
+		if err != nil {
+			return 0, errors.New("Cannot get dividend ID.")
+		}
+		dividendID++
+	}
+
+	return dividendID, stub.PutState(stateCurrDividendID, []byte(strconv.FormatUint(dividendID, 10)))
+}
+
+// insert declares a dividend.
+func (t *dividendHandler) insert(stub shim.ChaincodeStubInterface, dividend *DividendMsg) (uint64, error) {
+
+	dividendID, err := t.nextDividendID(stub)
+	if err != nil {
+		return 0, err
+	}
+	dividend.DividendID = dividendID
+	dividend.Status = DIVIDEND_DECLARED
+
+	err = t.putDividend(stub, dividend, true)
+	if err != nil {
+		return 0, err
+	}
+	err = t.index(stub, dividend.IssuerID, dividendID)
+	if err != nil {
+		return 0, err
+	}
+
+	myLogger.Debugf("insert dividend [%v]", dividendID)
+	return dividendID, nil
+}
+
+func (t *dividendHandler) index(stub shim.ChaincodeStubInterface, accountID string, dividendID uint64) error {
+	ok, err := stub.InsertRow(tableAccountDividend, shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: accountID}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: dividendID}}},
+	})
+	if !ok || err != nil {
+		myLogger.Errorf("system error %v", err)
+		return errors.New("Cannot insert dividend index.")
+	}
+	return nil
+}
+
+func (t *dividendHandler) putDividend(stub shim.ChaincodeStubInterface, dividend *DividendMsg, insert bool) error {
+
+	lastUpdated, err := txHandler.getCurrentTime(stub)
+	if err != nil {
+		return err
+	}
+	dividend.LastUpdated = lastUpdated
+
+	row := shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: dividend.DividendID}},
+			&shim.Column{Value: &shim.Column_String_{String_: dividend.Symbol}},
+			&shim.Column{Value: &shim.Column_String_{String_: dividend.IssuerID}},
+			&shim.Column{Value: &shim.Column_String_{String_: dividend.Rate}},
+			&shim.Column{Value: &shim.Column_String_{String_: dividend.RecordDate}},
+			&shim.Column{Value: &shim.Column_String_{String_: dividend.Status}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: dividend.TotalShares}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: dividend.TotalAmount}},
+			&shim.Column{Value: &shim.Column_String_{String_: dividend.LastUpdated}}},
+	}
+
+	var ok bool
+	if insert {
+		ok, err = stub.InsertRow(tableDividend, row)
+	} else {
+		ok, err = stub.ReplaceRow(tableDividend, row)
+	}
+	if !ok || err != nil {
+		myLogger.Errorf("system error %v", err)
+		return errors.New("Cannot save dividend.")
+	}
+	return nil
+}
+
+func (t *dividendHandler) insertPayment(stub shim.ChaincodeStubInterface, payment *DividendPaymentMsg) error {
+
+	lastUpdated, err := txHandler.getCurrentTime(stub)
+	if err != nil {
+		return err
+	}
+	payment.LastUpdated = lastUpdated
+
+	ok, err := stub.InsertRow(tableDividendPayment, shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: payment.DividendID}},
+			&shim.Column{Value: &shim.Column_String_{String_: payment.AccountID}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: payment.Shares}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: payment.Amount}},
+			&shim.Column{Value: &shim.Column_String_{String_: payment.LastUpdated}}},
+	})
+	if !ok || err != nil {
+		myLogger.Errorf("system error %v", err)
+		return errors.New("Cannot insert dividend payment.")
+	}
+	return nil
+}
+
+func (t *dividendHandler) toDividendMsg(row shim.Row) DividendMsg {
+	return DividendMsg{
+		row.Columns[0].GetUint64(),  //dividendID
+		row.Columns[1].GetString_(), //symbol
+		row.Columns[2].GetString_(), //issuerID
+		row.Columns[3].GetString_(), //rate
+		row.Columns[4].GetString_(), //recordDate
+		row.Columns[5].GetString_(), //status
+		row.Columns[6].GetUint64(),  //totalShares
+		row.Columns[7].GetUint64(),  //totalAmount
+		row.Columns[8].GetString_(), //lastUpdated
+		nil,
+	}
+}
+
+// getDividend returns a dividend with all of its payments, or nil if there
+// is none.
+func (t *dividendHandler) getDividend(stub shim.ChaincodeStubInterface, dividendID uint64) (*DividendMsg, error) {
+
+	var columns []shim.Column
+	colDividendID := shim.Column{Value: &shim.Column_Uint64{Uint64: dividendID}}
+	columns = append(columns, colDividendID)
+
+	row, err := stub.GetRow(tableDividend, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot get dividend.")
+	}
+	if len(row.Columns) == 0 {
+		return nil, nil
+	}
+
+	dividend := t.toDividendMsg(row)
+
+	rowChannel, err := stub.GetRows(tableDividendPayment, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot query dividend payment.")
+	}
+
+	for {
+		select {
+		case row, ok := <-rowChannel:
+			if !ok {
+				rowChannel = nil
+			} else {
+				dividend.Payments = append(dividend.Payments, DividendPaymentMsg{
+					row.Columns[0].GetUint64(),  //dividendID
+					row.Columns[1].GetString_(), //accountID
+					row.Columns[2].GetUint64(),  //shares
+					row.Columns[3].GetUint64(),  //amount
+					row.Columns[4].GetString_(), //lastUpdated
+				})
+			}
+		}
+		if rowChannel == nil {
+			break
+		}
+	}
+
+	return &dividend, nil
+}
+
+// findDueDividend returns the declared dividends whose record date has come.
+func (t *dividendHandler) findDueDividend(stub shim.ChaincodeStubInterface) ([]DividendMsg, error) {
+
+	now, err := ledgerClock.Now(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var columns []shim.Column
+	rowChannel, err := stub.GetRows(tableDividend, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot query dividend.")
+	}
+
+	var dividends []DividendMsg
+
+	for {
+		select {
+		case row, ok := <-rowChannel:
+			if !ok {
+				rowChannel = nil
+			} else {
+				dividend := t.toDividendMsg(row)
+				if dividend.Status == DIVIDEND_DECLARED {
+					recordDate, err := time.Parse(time.RFC3339Nano, dividend.RecordDate)
+					if err != nil {
+						myLogger.Errorf("system error %v", err)
+						return nil, errors.New("Cannot parse record date.")
+					}
+					if !now.Before(recordDate) {
+						dividends = append(dividends, dividend)
+					}
+				}
+			}
+		}
+		if rowChannel == nil {
+			break
+		}
+	}
+
+	sort.Sort(dividendQueue(dividends))
+	return dividends, nil
+}
+
+// entitle rebuilds the holders of the dividend's symbol as of its record
+// date from the balance history, however late the payout runs, and works
+// out what each is owed. Every amount is rounded down to a minor unit; the units this
+// leaves out of the total are then handed out one at a time by largest
+// remainder, ties going to the lower account ID, so the payout never depends
+// on the order rows come back in.
+func (t *dividendHandler) entitle(stub shim.ChaincodeStubInterface, dividend *DividendMsg) ([]DividendPaymentMsg, error) {
+
+	rate, err := parseDecimal(dividend.Rate, DIVIDEND_PRECISION)
+	if err != nil {
+		return nil, err
+	}
+	unit := pow10(DIVIDEND_PRECISION - MONEY_PRECISION)
+
+	recordDate, err := time.Parse(time.RFC3339Nano, dividend.RecordDate)
+	if err != nil {
+		return nil, errors.New("Cannot parse record date " + dividend.RecordDate)
+	}
+	register, err := capHandler.capTable(stub, dividend.Symbol, &balanceCut{At: recordDate})
+	if err != nil {
+		return nil, err
+	}
+	holders := register.Holders
+
+	queue := remainderQueue{}
+	var totalShares, paid uint64
+	for _, holder := range holders {
+		owed, err := mulAmount(rate, holder.Balance)
+		if err != nil {
+			return nil, err
+		}
+		queue.payments = append(queue.payments, DividendPaymentMsg{
+			DividendID: dividend.DividendID,
+			AccountID:  holder.AccountID,
+			Shares:     holder.Balance,
+			Amount:     owed / unit,
+		})
+		queue.remainders = append(queue.remainders, owed%unit)
+		totalShares += holder.Balance
+		paid += owed / unit
+	}
+
+	owed, err := mulAmount(rate, totalShares)
+	if err != nil {
+		return nil, err
+	}
+	total := owed / unit
+
+	sort.Sort(queue)
+	for i := 0; paid < total; i++ {
+		queue.payments[i].Amount++
+		paid++
+	}
+
+	dividend.TotalShares = totalShares
+	dividend.TotalAmount = total
+	return queue.payments, nil
+}
+
+// pay snapshots the holders of a due dividend and pays them from the
+// issuer's money. If the issuer cannot fund the whole payout nobody is paid
+// and the dividend is marked failed.
+func (t *dividendHandler) pay(stub shim.ChaincodeStubInterface, dividend *DividendMsg) error {
+
+	payments, err := t.entitle(stub, dividend)
+	if err != nil {
+		return err
+	}
+
+	available, err := actMonHandler.queryAvailable(stub, dividend.IssuerID)
+	if err != nil {
+		return err
+	}
+	var issuerShare uint64
+	for _, payment := range payments {
+		if payment.AccountID == dividend.IssuerID {
+			issuerShare = payment.Amount
+		}
+	}
+	if available < dividend.TotalAmount-issuerShare {
+		myLogger.Infof("dividend [%v] not funded, needs [%v] available [%v]", dividend.DividendID, dividend.TotalAmount-issuerShare, available)
+		dividend.Status = DIVIDEND_FAILED
+		return t.putDividend(stub, dividend, false)
+	}
+
+	// a holder without a money account, such as one credited by issueStock
+	// alone, cannot be paid, and paying the others would split the payout
+	for _, payment := range payments {
+		if payment.AccountID == dividend.IssuerID || payment.Amount == 0 {
+			continue
+		}
+		if _, err := actMonHandler.queryBalance(stub, payment.AccountID); err != nil {
+			myLogger.Infof("dividend [%v] not paid, no money account for [%v]", dividend.DividendID, payment.AccountID)
+			dividend.Status = DIVIDEND_FAILED
+			return t.putDividend(stub, dividend, false)
+		}
+	}
+
+	for i := range payments {
+		payment := &payments[i]
+		// the issuer's own holding is entitled but the cash stays put
+		if payment.AccountID != dividend.IssuerID && payment.Amount > 0 {
+			err = actMonHandler.transfer(stub, dividend.IssuerID, payment.AccountID, payment.Amount)
+			if err != nil {
+				return err
+			}
+		}
+		err = t.insertPayment(stub, payment)
+		if err != nil {
+			return err
+		}
+		if payment.AccountID != dividend.IssuerID {
+			err = t.index(stub, payment.AccountID, dividend.DividendID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	myLogger.Infof("dividend [%v] paid [%v] on [%v] shares", dividend.DividendID, dividend.TotalAmount, dividend.TotalShares)
+	dividend.Status = DIVIDEND_PAID
+	dividend.Payments = payments
+	return t.putDividend(stub, dividend, false)
+}
+
+// payDue pays every dividend whose record date has come. A dividend that
+// cannot be paid is marked failed so it does not hold up the ones after it.
+func (t *dividendHandler) payDue(stub shim.ChaincodeStubInterface) error {
+
+	dividends, err := t.findDueDividend(stub)
+	if err != nil {
+		return err
+	}
+
+	for i := range dividends {
+		dividend := &dividends[i]
+		err = t.pay(stub, dividend)
+		if err != nil {
+			myLogger.Errorf("dividend [%v] failed %v", dividend.DividendID, err)
+			dividend.Status = DIVIDEND_FAILED
+			err = t.putDividend(stub, dividend, false)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// findDividend returns the dividends an account declared or was paid. A
+// holder only sees its own payment.
+func (t *dividendHandler) findDividend(stub shim.ChaincodeStubInterface, accountID string) ([]DividendMsg, error) {
+
+	var columns []shim.Column
+	colAccountID := shim.Column{Value: &shim.Column_String_{String_: accountID}}
+	columns = append(columns, colAccountID)
+
+	rowChannel, err := stub.GetRows(tableAccountDividend, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot query dividend.")
+	}
+
+	var dividends []DividendMsg
+
+	for {
+		select {
+		case row, ok := <-rowChannel:
+			if !ok {
+				rowChannel = nil
+			} else {
+				dividend, err := t.getDividend(stub, row.Columns[1].GetUint64())
+				if err != nil || dividend == nil {
+					return nil, errors.New("Cannot query dividend.")
+				}
+				dividends = append(dividends, *t.visibleTo(dividend, accountID))
+			}
+		}
+		if rowChannel == nil {
+			break
+		}
+	}
+
+	return dividends, nil
+}
+
+// paymentOf returns the payment to a holder, or nil if it was not paid.
+func (t *dividendHandler) paymentOf(dividend *DividendMsg, accountID string) *DividendPaymentMsg {
+	for i := range dividend.Payments {
+		if dividend.Payments[i].AccountID == accountID {
+			return &dividend.Payments[i]
+		}
+	}
+	return nil
+}
+
+// visibleTo hides the other holders' payments from a holder.
+func (t *dividendHandler) visibleTo(dividend *DividendMsg, accountID string) *DividendMsg {
+	if accountID == dividend.IssuerID {
+		return dividend
+	}
+	var payments []DividendPaymentMsg
+	if payment := t.paymentOf(dividend, accountID); payment != nil {
+		payments = append(payments, *payment)
+	}
+	dividend.Payments = payments
+	return dividend
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestEntitle(t *testing.T) {
+	defer restoreClock()
+
+	tests := []struct {
+		name      string
+		rate      string
+		before    map[string]uint64 // Ookbee issued before the record date, on top of owner01's 100000
+		after     map[string]uint64 // issued after the record date
+		want      map[string]uint64
+		wantTotal uint64
+	}{
+		{
+			"whole minor units",
+			"0.01",
+			map[string]uint64{"investor01": 10},
+			nil,
+			map[string]uint64{"owner01": 100000, "investor01": 10},
+			100010,
+		},
+		{
+			"largest remainder gets the unit left over",
+			"0.001",
+			map[string]uint64{"investor01": 5, "investor02": 5, "investor03": 7},
+			nil,
+			map[string]uint64{"owner01": 10000, "investor01": 0, "investor02": 0, "investor03": 1},
+			10001,
+		},
+		{
+			"tie goes to the lower account ID",
+			"0.001",
+			map[string]uint64{"investor02": 5, "investor01": 5},
+			nil,
+			map[string]uint64{"owner01": 10000, "investor01": 1, "investor02": 0},
+			10001,
+		},
+		{
+			"holdings after the record date are left out",
+			"0.001",
+			map[string]uint64{"investor01": 5},
+			map[string]uint64{"investor02": 50},
+			map[string]uint64{"owner01": 10000, "investor01": 0},
+			10000,
+		},
+	}
+
+	for _, tc := range tests {
+		stub := newTestStub(t)
+		for accountID, volume := range tc.before {
+			stub.as("tsd01", ROLE_TSD).mustInvoke("issueStock", accountID, "Ookbee", strconv.FormatUint(volume, 10))
+		}
+		recordDate := stub.clock.now.Add(time.Hour)
+		stub.clock.advance(2 * time.Hour)
+		for accountID, volume := range tc.after {
+			stub.as("tsd01", ROLE_TSD).mustInvoke("issueStock", accountID, "Ookbee", strconv.FormatUint(volume, 10))
+		}
+
+		dividend := DividendMsg{Symbol: "Ookbee", Rate: tc.rate, RecordDate: formatTime(recordDate)}
+		payments, err := divHandler.entitle(stub, &dividend)
+		if err != nil {
+			t.Errorf("%v: %v", tc.name, err)
+			continue
+		}
+
+		if dividend.TotalAmount != tc.wantTotal {
+			t.Errorf("%v: total %v, want %v", tc.name, dividend.TotalAmount, tc.wantTotal)
+		}
+		if len(payments) != len(tc.want) {
+			t.Errorf("%v: %v payments, want %v", tc.name, len(payments), len(tc.want))
+		}
+		for _, payment := range payments {
+			want, ok := tc.want[payment.AccountID]
+			if !ok || payment.Amount != want {
+				t.Errorf("%v: %v is paid %v, want %v", tc.name, payment.AccountID, payment.Amount, want)
+			}
+		}
+	}
+}
+
+func TestDeclareDividendIssuer(t *testing.T) {
+	defer restoreClock()
+
+	tests := []struct {
+		name     string
+		issuerID string
+		symbol   string
+		wantErr  bool
+	}{
+		{"own symbol", "owner01", "Ookbee", false},
+		{"another issuer's symbol", "owner02", "Ookbee", true},
+		{"unknown symbol", "owner01", "Nope", true},
+	}
+
+	for _, tc := range tests {
+		stub := newTestStub(t)
+		err := stub.as(tc.issuerID, ROLE_ISSUER).invoke("declareDividend", tc.symbol, "0.1", formatTime(testEpoch.Add(time.Hour)))
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%v: error %v, want error %v", tc.name, err, tc.wantErr)
+		}
+		if dividend, _ := divHandler.getDividend(stub, 1); (dividend != nil) == tc.wantErr {
+			t.Errorf("%v: dividend %v", tc.name, dividend)
+		}
+	}
+}
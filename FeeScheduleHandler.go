@@ -0,0 +1,448 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	tableFeeSchedule = "FeeSchedule"
+	columnFeeType    = "FeeType"
+	columnRole       = "Role"
+	columnRate       = "Rate"
+	columnMinimum    = "Minimum"
+	columnCap        = "Cap"
+	columnFeeAccount = "FeeAccount"
+
+	tableTransactionFee = "TransactionFee"
+	columnSeq           = "Seq"
+	columnPayerID       = "PayerID"
+	columnPayeeID       = "PayeeID"
+
+	stateAccountRole = "AccountRole_"
+
+	FEE_BROKERAGE = "Brokerage"
+	FEE_PLATFORM  = "Platform"
+	FEE_REFUND    = "Refund" // fee paid back by a reversal
+
+	FEE_ANY = "*" // matches any symbol or role
+
+	RATE_SCALE = 10000 // rates are in basis points
+)
+
+type feeScheduleHandler struct {
+}
+
+// FeeRuleMsg charges the Side of a trade Rate basis points of its value,
+// no less than Minimum and, when Cap is not zero, no more than Cap, paid to
+// FeeAccount. Symbol and Role may be FEE_ANY.
+type FeeRuleMsg struct {
+	FeeType    string
+	Side       string
+	Symbol     string
+	Role       string
+	Rate       uint64
+	Minimum    uint64
+	Cap        uint64
+	FeeAccount string
+}
+
+// FeeMsg is one fee movement of a trade, from PayerID to PayeeID.
+type FeeMsg struct {
+	TransactionID uint64
+	Symbol        string
+	FeeType       string
+	Side          string
+	PayerID       string
+	PayeeID       string
+	Amount        uint64
+}
+
+//
+func NewFeeScheduleHandler() *feeScheduleHandler {
+	return &feeScheduleHandler{}
+}
+
+func (t *feeScheduleHandler) createTable(stub shim.ChaincodeStubInterface) error {
+
+	err := stub.CreateTable(tableFeeSchedule, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnFeeType, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnSide, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnSymbol, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnRole, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnRate, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnMinimum, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnCap, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnFeeAccount, Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		myLogger.Errorf("system error create table fee schedule %v", err)
+		return errors.New("Cannot create table fee schedule.")
+	}
+
+	err = stub.CreateTable(tableTransactionFee, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnTransactionID, Type: shim.ColumnDefinition_UINT64, Key: true},
+		&shim.ColumnDefinition{Name: columnSeq, Type: shim.ColumnDefinition_UINT64, Key: true},
+		&shim.ColumnDefinition{Name: columnSymbol, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnFeeType, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnSide, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnPayerID, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnPayeeID, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnAmount, Type: shim.ColumnDefinition_UINT64, Key: false},
+	})
+	if err != nil {
+		myLogger.Errorf("system error create table transaction fee %v", err)
+		return errors.New("Cannot create table transaction fee.")
+	}
+
+	return nil
+}
+
+// recordRole remembers the role an account posted a trade under, so fees can
+// be looked up by role when the account is not the one invoking.
+func (t *feeScheduleHandler) recordRole(stub shim.ChaincodeStubInterface, accountID string, role string) error {
+	tmpbytes, err := stub.GetState(stateAccountRole + accountID)
+	if err == nil && string(tmpbytes) == role {
+		return nil
+	}
+	return stub.PutState(stateAccountRole+accountID, []byte(role))
+}
+
+// roleOf returns the role the fees of accountID are looked up by: the role
+// it invokes under if it is the caller, otherwise the role it recorded when
+// it posted its side of the trade.
+func (t *feeScheduleHandler) roleOf(stub shim.ChaincodeStubInterface, accountID string) (string, error) {
+	caller, err := stub.ReadCertAttribute("accountid")
+	if err == nil && string(caller) == accountID {
+		role, err := stub.ReadCertAttribute("role")
+		if err == nil && (string(role) == ROLE_TRADER || string(role) == ROLE_ISSUER) {
+			return string(role), nil
+		}
+	}
+	return t.getAccountRole(stub, accountID)
+}
+
+func (t *feeScheduleHandler) getAccountRole(stub shim.ChaincodeStubInterface, accountID string) (string, error) {
+	tmpbytes, err := stub.GetState(stateAccountRole + accountID)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return "", errors.New("Cannot get account role.")
+	}
+	return string(tmpbytes), nil
+}
+
+func (t *feeScheduleHandler) putRule(stub shim.ChaincodeStubInterface, rule *FeeRuleMsg) error {
+
+	if rule.FeeType != FEE_BROKERAGE && rule.FeeType != FEE_PLATFORM {
+		return errors.New("Invalid fee type")
+	}
+	if rule.Side != SIDE_BUY && rule.Side != SIDE_SELL {
+		return errors.New("Invalid side")
+	}
+	if rule.Cap != 0 && rule.Cap < rule.Minimum {
+		return errors.New("Fee cap is below the minimum")
+	}
+	if _, err := actMonHandler.queryBalance(stub, rule.FeeAccount); err != nil {
+		return errors.New("No money account for fee account " + rule.FeeAccount)
+	}
+	// a fee account that trades would end up paying fees to itself
+	role, err := t.getAccountRole(stub, rule.FeeAccount)
+	if err != nil {
+		return err
+	}
+	holds, err := actBalHandler.hasHoldings(stub, rule.FeeAccount)
+	if err != nil {
+		return err
+	}
+	if role != "" || holds {
+		return errors.New("Fee account " + rule.FeeAccount + " trades and cannot collect fees")
+	}
+
+	row := shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: rule.FeeType}},
+			&shim.Column{Value: &shim.Column_String_{String_: rule.Side}},
+			&shim.Column{Value: &shim.Column_String_{String_: rule.Symbol}},
+			&shim.Column{Value: &shim.Column_String_{String_: rule.Role}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: rule.Rate}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: rule.Minimum}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: rule.Cap}},
+			&shim.Column{Value: &shim.Column_String_{String_: rule.FeeAccount}}},
+	}
+
+	ok, err := stub.ReplaceRow(tableFeeSchedule, row)
+	if err == nil && !ok {
+		ok, err = stub.InsertRow(tableFeeSchedule, row)
+	}
+	if !ok || err != nil {
+		myLogger.Errorf("system error %v", err)
+		return errors.New("Cannot update fee schedule.")
+	}
+
+	return nil
+}
+
+func (t *feeScheduleHandler) removeRule(stub shim.ChaincodeStubInterface, feeType string, side string, symbol string, role string) error {
+
+	var columns []shim.Column
+	columns = append(columns, shim.Column{Value: &shim.Column_String_{String_: feeType}})
+	columns = append(columns, shim.Column{Value: &shim.Column_String_{String_: side}})
+	columns = append(columns, shim.Column{Value: &shim.Column_String_{String_: symbol}})
+	columns = append(columns, shim.Column{Value: &shim.Column_String_{String_: role}})
+
+	err := stub.DeleteRow(tableFeeSchedule, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return errors.New("Cannot remove fee rule.")
+	}
+
+	return nil
+}
+
+func (t *feeScheduleHandler) getRule(stub shim.ChaincodeStubInterface, feeType string, side string, symbol string, role string) (*FeeRuleMsg, error) {
+
+	var columns []shim.Column
+	columns = append(columns, shim.Column{Value: &shim.Column_String_{String_: feeType}})
+	columns = append(columns, shim.Column{Value: &shim.Column_String_{String_: side}})
+	columns = append(columns, shim.Column{Value: &shim.Column_String_{String_: symbol}})
+	columns = append(columns, shim.Column{Value: &shim.Column_String_{String_: role}})
+
+	row, err := stub.GetRow(tableFeeSchedule, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot query fee schedule.")
+	}
+	if len(row.Columns) == 0 {
+		return nil, nil
+	}
+
+	rule := t.toFeeRuleMsg(row)
+	return &rule, nil
+}
+
+func (t *feeScheduleHandler) toFeeRuleMsg(row shim.Row) FeeRuleMsg {
+	return FeeRuleMsg{
+		row.Columns[0].GetString_(), //feeType
+		row.Columns[1].GetString_(), //side
+		row.Columns[2].GetString_(), //symbol
+		row.Columns[3].GetString_(), //role
+		row.Columns[4].GetUint64(),  //rate
+		row.Columns[5].GetUint64(),  //minimum
+		row.Columns[6].GetUint64(),  //cap
+		row.Columns[7].GetString_(), //feeAccount
+	}
+}
+
+// findRule returns the most specific rule for a payer: symbol and role,
+// then symbol only, then role only, then the default.
+func (t *feeScheduleHandler) findRule(stub shim.ChaincodeStubInterface, feeType string, side string, symbol string, role string) (*FeeRuleMsg, error) {
+	candidates := [][2]string{{symbol, role}, {symbol, FEE_ANY}, {FEE_ANY, role}, {FEE_ANY, FEE_ANY}}
+	for _, c := range candidates {
+		if c[1] == "" {
+			continue
+		}
+		rule, err := t.getRule(stub, feeType, side, c[0], c[1])
+		if rule != nil || err != nil {
+			return rule, err
+		}
+	}
+	return nil, nil
+}
+
+// feeOf applies a rule to a trade value, rounding half up to a minor unit.
+func (t *feeScheduleHandler) feeOf(rule *FeeRuleMsg, amount uint64) (uint64, error) {
+	fee, err := mulAmount(amount, rule.Rate)
+	if err != nil {
+		return 0, err
+	}
+	fee, err = addAmount(fee, RATE_SCALE/2)
+	if err != nil {
+		return 0, err
+	}
+	fee = fee / RATE_SCALE
+
+	if fee < rule.Minimum {
+		fee = rule.Minimum
+	}
+	if rule.Cap != 0 && fee > rule.Cap {
+		fee = rule.Cap
+	}
+	return fee, nil
+}
+
+// compute returns the fees both sides owe on a single-symbol trade worth
+// amount. Reversals are not charged.
+func (t *feeScheduleHandler) compute(stub shim.ChaincodeStubInterface, txMsg *TransactionMsg, amount uint64) ([]FeeMsg, error) {
+	if txMsg.TxType == TXTYPE_REVERSAL {
+		return nil, nil
+	}
+
+	var fees []FeeMsg
+	for _, side := range []string{SIDE_BUY, SIDE_SELL} {
+		payerID := txMsg.BuyerID
+		if side == SIDE_SELL {
+			payerID = txMsg.SellerID
+		}
+		role, err := t.roleOf(stub, payerID)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, feeType := range []string{FEE_BROKERAGE, FEE_PLATFORM} {
+			rule, err := t.findRule(stub, feeType, side, txMsg.Symbol, role)
+			if err != nil {
+				return nil, err
+			}
+			if rule == nil {
+				continue
+			}
+			fee, err := t.feeOf(rule, amount)
+			if err != nil {
+				return nil, err
+			}
+			if fee > 0 {
+				fees = append(fees, FeeMsg{txMsg.TransactionID, txMsg.Symbol, feeType, side, payerID, rule.FeeAccount, fee})
+			}
+		}
+	}
+	return fees, nil
+}
+
+// total sums the fees paid by one account.
+func (t *feeScheduleHandler) total(fees []FeeMsg, payerID string) uint64 {
+	var total uint64
+	for _, fee := range fees {
+		if fee.PayerID == payerID {
+			total += fee.Amount
+		}
+	}
+	return total
+}
+
+// charge moves every fee from its payer to its payee. A fee an account owes
+// itself stays where it is, as transfer would otherwise credit it twice.
+func (t *feeScheduleHandler) charge(stub shim.ChaincodeStubInterface, fees []FeeMsg) error {
+	for _, fee := range fees {
+		if fee.PayerID == fee.PayeeID {
+			continue
+		}
+		err := actMonHandler.transfer(stub, fee.PayerID, fee.PayeeID, fee.Amount)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refund is the reversal of charged fees: each payee pays its fee back.
+func (t *feeScheduleHandler) refund(fees []FeeMsg) []FeeMsg {
+	var refunds []FeeMsg
+	for _, fee := range fees {
+		refunds = append(refunds, FeeMsg{fee.TransactionID, fee.Symbol, FEE_REFUND, fee.Side, fee.PayeeID, fee.PayerID, fee.Amount})
+	}
+	return refunds
+}
+
+// record writes the fee breakdown of a transaction.
+func (t *feeScheduleHandler) record(stub shim.ChaincodeStubInterface, txID uint64, fees []FeeMsg) error {
+	for i, fee := range fees {
+		ok, err := stub.InsertRow(tableTransactionFee, shim.Row{
+			Columns: []*shim.Column{
+				&shim.Column{Value: &shim.Column_Uint64{Uint64: txID}},
+				&shim.Column{Value: &shim.Column_Uint64{Uint64: uint64(i + 1)}},
+				&shim.Column{Value: &shim.Column_String_{String_: fee.Symbol}},
+				&shim.Column{Value: &shim.Column_String_{String_: fee.FeeType}},
+				&shim.Column{Value: &shim.Column_String_{String_: fee.Side}},
+				&shim.Column{Value: &shim.Column_String_{String_: fee.PayerID}},
+				&shim.Column{Value: &shim.Column_String_{String_: fee.PayeeID}},
+				&shim.Column{Value: &shim.Column_Uint64{Uint64: fee.Amount}}},
+		})
+		if !ok || err != nil {
+			myLogger.Errorf("system error %v", err)
+			return errors.New("Cannot insert transaction fee.")
+		}
+	}
+	return nil
+}
+
+// find returns the fee breakdown of a transaction in the order charged.
+func (t *feeScheduleHandler) find(stub shim.ChaincodeStubInterface, txID uint64) ([]FeeMsg, error) {
+
+	var columns []shim.Column
+	colTxID := shim.Column{Value: &shim.Column_Uint64{Uint64: txID}}
+	columns = append(columns, colTxID)
+
+	rowChannel, err := stub.GetRows(tableTransactionFee, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot query transaction fee.")
+	}
+
+	var rows []shim.Row
+
+	for {
+		select {
+		case row, ok := <-rowChannel:
+			if !ok {
+				rowChannel = nil
+			} else {
+				rows = append(rows, row)
+			}
+		}
+		if rowChannel == nil {
+			break
+		}
+	}
+
+	fees := make([]FeeMsg, len(rows))
+	for _, row := range rows {
+		seq := row.Columns[1].GetUint64()
+		if seq < 1 || seq > uint64(len(rows)) {
+			return nil, errors.New("Invalid transaction fee")
+		}
+		fees[seq-1] = FeeMsg{
+			row.Columns[0].GetUint64(),  //txID
+			row.Columns[2].GetString_(), //symbol
+			row.Columns[3].GetString_(), //feeType
+			row.Columns[4].GetString_(), //side
+			row.Columns[5].GetString_(), //payerID
+			row.Columns[6].GetString_(), //payeeID
+			row.Columns[7].GetUint64(),  //amount
+		}
+	}
+
+	return fees, nil
+}
+
+func (t *feeScheduleHandler) query(stub shim.ChaincodeStubInterface) ([]byte, error) {
+
+	var columns []shim.Column
+	rowChannel, err := stub.GetRows(tableFeeSchedule, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot query fee schedule.")
+	}
+
+	var rules []FeeRuleMsg
+
+	for {
+		select {
+		case row, ok := <-rowChannel:
+			if !ok {
+				rowChannel = nil
+			} else {
+				rules = append(rules, t.toFeeRuleMsg(row))
+			}
+		}
+		if rowChannel == nil {
+			break
+		}
+	}
+
+	rulesJson, err := json.Marshal(rules)
+	myLogger.Debugf("Response : %s", rulesJson)
+
+	return rulesJson, nil
+}
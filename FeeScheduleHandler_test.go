@@ -0,0 +1,120 @@
+package main
+
+import "testing"
+
+func TestFeeOf(t *testing.T) {
+	tests := []struct {
+		name   string
+		rule   FeeRuleMsg
+		amount uint64
+		want   uint64
+	}{
+		{"rate", FeeRuleMsg{Rate: 25}, 1000000, 2500},
+		{"rounds half up", FeeRuleMsg{Rate: 25}, 200, 1},
+		{"rounds down below half", FeeRuleMsg{Rate: 25}, 199, 0},
+		{"minimum", FeeRuleMsg{Rate: 25, Minimum: 100}, 10000, 100},
+		{"cap", FeeRuleMsg{Rate: 1000, Cap: 500}, 10000, 500},
+		{"under the cap", FeeRuleMsg{Rate: 1000, Cap: 5000}, 10000, 1000},
+		{"zero rate", FeeRuleMsg{}, 10000, 0},
+	}
+
+	for _, tc := range tests {
+		got, err := feeHandler.feeOf(&tc.rule, tc.amount)
+		if err != nil {
+			t.Errorf("%v: %v", tc.name, err)
+		} else if got != tc.want {
+			t.Errorf("%v: fee %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestTradeFees(t *testing.T) {
+	defer restoreClock()
+
+	// investor01 bids for 10 Ookbee of owner01 at 10.00, a trade worth 100.00
+	tests := []struct {
+		name       string
+		rules      [][]string
+		wantBuyer  uint64 // investor01 pays
+		wantSeller uint64 // owner01 receives
+		wantFee    uint64 // fee01 collects
+		wantPlat   uint64 // plat01 collects
+	}{
+		{"no fees", nil, 10000, 10000, 0, 0},
+		{
+			"buyer brokerage at its minimum",
+			[][]string{{FEE_BROKERAGE, SIDE_BUY, FEE_ANY, FEE_ANY, "25", "1", "0", "fee01"}},
+			10100, 10000, 100, 0,
+		},
+		{
+			"seller platform fee at its cap",
+			[][]string{{FEE_PLATFORM, SIDE_SELL, FEE_ANY, FEE_ANY, "1000", "0", "5", "plat01"}},
+			10000, 9500, 0, 500,
+		},
+		{
+			"symbol and role rule before the default",
+			[][]string{
+				{FEE_BROKERAGE, SIDE_BUY, FEE_ANY, FEE_ANY, "100", "0", "0", "fee01"},
+				{FEE_BROKERAGE, SIDE_BUY, "Ookbee", ROLE_TRADER, "50", "0", "0", "fee01"},
+			},
+			10050, 10000, 50, 0,
+		},
+		{
+			"role of a seller that only confirms",
+			[][]string{
+				{FEE_PLATFORM, SIDE_SELL, FEE_ANY, ROLE_TRADER, "100", "0", "0", "plat01"},
+				{FEE_PLATFORM, SIDE_SELL, FEE_ANY, ROLE_ISSUER, "200", "0", "0", "plat01"},
+			},
+			10000, 9800, 0, 200,
+		},
+		{
+			"both sides",
+			[][]string{
+				{FEE_BROKERAGE, SIDE_BUY, FEE_ANY, FEE_ANY, "25", "0", "0", "fee01"},
+				{FEE_PLATFORM, SIDE_SELL, FEE_ANY, FEE_ANY, "10", "0", "0", "plat01"},
+			},
+			10025, 9990, 25, 10,
+		},
+	}
+
+	for _, tc := range tests {
+		stub := newTestStub(t)
+		stub.as("tsd01", ROLE_TSD).mustInvoke("setSettlementCycle", "0")
+		stub.as("bot01", ROLE_BOT).mustInvoke("addMoney", "fee01", "0")
+		stub.as("bot01", ROLE_BOT).mustInvoke("addMoney", "plat01", "0")
+		for _, rule := range tc.rules {
+			stub.as("admin01", ROLE_ADMIN).mustInvoke("setFee", rule...)
+		}
+		buyerBefore := stub.money("investor01")
+
+		stub.as("investor01", ROLE_TRADER).mustInvoke("buy", "Ookbee", "owner01", "10", "10")
+		stub.as("owner01", ROLE_ISSUER).mustInvoke("confirmSell", "1")
+		stub.as("bot01", ROLE_BOT).mustInvoke("settleTrades")
+
+		if txMsg := stub.transaction(1); txMsg.Status != STATUS_CONFIRMED {
+			t.Errorf("%v: status %v", tc.name, txMsg.Status)
+			continue
+		}
+		got := []uint64{buyerBefore - stub.money("investor01"), stub.money("owner01"), stub.money("fee01"), stub.money("plat01")}
+		want := []uint64{tc.wantBuyer, tc.wantSeller, tc.wantFee, tc.wantPlat}
+		for i, who := range []string{"investor01 paid", "owner01 received", "fee01 collected", "plat01 collected"} {
+			if got[i] != want[i] {
+				t.Errorf("%v: %v %v, want %v", tc.name, who, formatAmount(got[i]), formatAmount(want[i]))
+			}
+		}
+	}
+}
+
+func TestFeeAccountThatTrades(t *testing.T) {
+	defer restoreClock()
+
+	// owner01 holds shares, investor02 has a bid posted
+	stub := newTestStub(t)
+	stub.as("investor02", ROLE_TRADER).mustInvoke("buy", "Ookbee", "owner01", "1", "10")
+	for _, feeAccount := range []string{"owner01", "investor02"} {
+		err := stub.as("admin01", ROLE_ADMIN).invoke("setFee", FEE_BROKERAGE, SIDE_BUY, FEE_ANY, FEE_ANY, "25", "0", "0", feeAccount)
+		if err == nil {
+			t.Errorf("%v accepted as a fee account", feeAccount)
+		}
+	}
+}
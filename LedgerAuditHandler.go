@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	tableIssuedSupply = "IssuedSupply"
+	columnSupply      = "Supply"
+
+	stateTotalDeposit = "TotalDeposit"
+)
+
+type ledgerAuditHandler struct {
+}
+
+//
+type SupplyAuditMsg struct {
+	Symbol   string
+	Issued   uint64
+	Balances uint64
+	Drift    int64
+}
+
+//
+type CashAuditMsg struct {
+	Deposited uint64
+	Balances  uint64
+	Drift     int64
+}
+
+//
+type AccountAuditMsg struct {
+	AccountID string
+	Symbol    string
+	Problem   string
+}
+
+//
+type LedgerAuditMsg struct {
+	Balanced bool
+	Supply   []SupplyAuditMsg
+	Cash     CashAuditMsg
+	Accounts []AccountAuditMsg
+}
+
+//
+func NewLedgerAuditHandler() *ledgerAuditHandler {
+	return &ledgerAuditHandler{}
+}
+
+func (t *ledgerAuditHandler) createTable(stub shim.ChaincodeStubInterface) error {
+
+	err := stub.CreateTable(tableIssuedSupply, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnSymbol, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnSupply, Type: shim.ColumnDefinition_UINT64, Key: false},
+	})
+	if err != nil {
+		myLogger.Errorf("system error create table issued supply %v", err)
+		return errors.New("Cannot create table issued supply.")
+	}
+
+	return stub.PutState(stateTotalDeposit, []byte("0"))
+}
+
+func (t *ledgerAuditHandler) getSupply(stub shim.ChaincodeStubInterface, symbol string) (uint64, error) {
+
+	var columns []shim.Column
+	colSymbol := shim.Column{Value: &shim.Column_String_{String_: symbol}}
+	columns = append(columns, colSymbol)
+
+	row, err := stub.GetRow(tableIssuedSupply, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return 0, errors.New("Cannot query issued supply.")
+	}
+	if len(row.Columns) == 0 {
+		return 0, nil
+	}
+
+	return row.Columns[1].GetUint64(), nil
+}
+
+func (t *ledgerAuditHandler) putSupply(stub shim.ChaincodeStubInterface, symbol string, supply uint64) error {
+
+	row := shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: symbol}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: supply}}},
+	}
+
+	ok, err := stub.ReplaceRow(tableIssuedSupply, row)
+	if err == nil && !ok {
+		ok, err = stub.InsertRow(tableIssuedSupply, row)
+	}
+	if !ok || err != nil {
+		myLogger.Errorf("system error %v", err)
+		return errors.New("Cannot update issued supply.")
+	}
+
+	return nil
+}
+
+// addSupply records newly created shares of a symbol.
+func (t *ledgerAuditHandler) addSupply(stub shim.ChaincodeStubInterface, symbol string, volume uint64) error {
+	supply, err := t.getSupply(stub, symbol)
+	if err != nil {
+		return err
+	}
+	supply, err = addAmount(supply, volume)
+	if err != nil {
+		return err
+	}
+	return t.putSupply(stub, symbol, supply)
+}
+
+// removeSupply records shares of a symbol that were taken out of circulation.
+func (t *ledgerAuditHandler) removeSupply(stub shim.ChaincodeStubInterface, symbol string, volume uint64) error {
+	supply, err := t.getSupply(stub, symbol)
+	if err != nil {
+		return err
+	}
+	if supply < volume {
+		return errors.New("Cannot remove more than issued supply.")
+	}
+	return t.putSupply(stub, symbol, supply-volume)
+}
+
+func (t *ledgerAuditHandler) getTotalDeposit(stub shim.ChaincodeStubInterface) (uint64, error) {
+	tmpbytes, err := stub.GetState(stateTotalDeposit)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return 0, errors.New("Cannot get total deposit.")
+	}
+	if tmpbytes == nil {
+		return 0, nil
+	}
+	return strconv.ParseUint(string(tmpbytes), 10, 64)
+}
+
+// addDeposit records cash brought onto the ledger by the bot.
+func (t *ledgerAuditHandler) addDeposit(stub shim.ChaincodeStubInterface, amount uint64) error {
+	total, err := t.getTotalDeposit(stub)
+	if err != nil {
+		return err
+	}
+	total, err = addAmount(total, amount)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(stateTotalDeposit, []byte(strconv.FormatUint(total, 10)))
+}
+
+// audit recomputes share supply and cash from AccountBalance and
+// AccountMoney, compares them with the running totals and checks that no
+// account has more reserved or held than it owns.
+func (t *ledgerAuditHandler) audit(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	auditMsg := LedgerAuditMsg{Balanced: true}
+
+	balances := make(map[string]uint64)
+	issued := make(map[string]uint64)
+
+	var columns []shim.Column
+	rowChannel, err := stub.GetRows(tableIssuedSupply, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot query issued supply.")
+	}
+	for {
+		select {
+		case row, ok := <-rowChannel:
+			if !ok {
+				rowChannel = nil
+			} else {
+				issued[row.Columns[0].GetString_()] = row.Columns[1].GetUint64()
+			}
+		}
+		if rowChannel == nil {
+			break
+		}
+	}
+
+	rowChannel, err = stub.GetRows(tableAccountBalance, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot query account balance.")
+	}
+	for {
+		select {
+		case row, ok := <-rowChannel:
+			if !ok {
+				rowChannel = nil
+			} else {
+				tAccount := row.Columns[0].GetString_()
+				tSymbol := row.Columns[1].GetString_()
+				tBalance := row.Columns[2].GetUint64()
+				tReserved := row.Columns[3].GetUint64()
+
+				balances[tSymbol] += tBalance
+				if tReserved > tBalance {
+					auditMsg.Accounts = append(auditMsg.Accounts, AccountAuditMsg{tAccount, tSymbol, "Reserved exceeds balance"})
+				}
+			}
+		}
+		if rowChannel == nil {
+			break
+		}
+	}
+
+	var symbols []string
+	for symbol := range issued {
+		symbols = append(symbols, symbol)
+	}
+	for symbol := range balances {
+		if _, ok := issued[symbol]; !ok {
+			symbols = append(symbols, symbol)
+		}
+	}
+	sort.Strings(symbols)
+	for _, symbol := range symbols {
+		supplyMsg := SupplyAuditMsg{symbol, issued[symbol], balances[symbol], int64(balances[symbol]) - int64(issued[symbol])}
+		if supplyMsg.Drift != 0 {
+			auditMsg.Balanced = false
+		}
+		auditMsg.Supply = append(auditMsg.Supply, supplyMsg)
+	}
+
+	auditMsg.Cash.Deposited, err = t.getTotalDeposit(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	rowChannel, err = stub.GetRows(tableAccountMoney, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot query account money.")
+	}
+	for {
+		select {
+		case row, ok := <-rowChannel:
+			if !ok {
+				rowChannel = nil
+			} else {
+				tAccount := row.Columns[0].GetString_()
+				tAmount := row.Columns[1].GetUint64()
+				tHeld := row.Columns[2].GetUint64()
+
+				auditMsg.Cash.Balances += tAmount
+				if tHeld > tAmount {
+					auditMsg.Accounts = append(auditMsg.Accounts, AccountAuditMsg{tAccount, "", "Held exceeds amount"})
+				}
+			}
+		}
+		if rowChannel == nil {
+			break
+		}
+	}
+	auditMsg.Cash.Drift = int64(auditMsg.Cash.Balances) - int64(auditMsg.Cash.Deposited)
+
+	if auditMsg.Cash.Drift != 0 || len(auditMsg.Accounts) > 0 {
+		auditMsg.Balanced = false
+	}
+
+	auditMsgJson, err := json.Marshal(auditMsg)
+	myLogger.Debugf("Response : %s", auditMsgJson)
+
+	return auditMsgJson, err
+}
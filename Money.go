@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Prices and cash amounts are fixed-point values held as a uint64 count of
+// the currency's smallest unit, e.g. 12.50 THB is stored as 1250.
+const (
+	MONEY_PRECISION = 2
+	MONEY_SCALE     = 100 // 10^MONEY_PRECISION
+
+	CURRENCY_THB = "THB"
+)
+
+// parseAmount reads a non-negative decimal such as "12", "12.5" or "12.50"
+// into minor units. More decimals than MONEY_PRECISION are refused rather
+// than rounded.
+func parseAmount(s string) (uint64, error) {
+	return parseDecimal(s, MONEY_PRECISION)
+}
+
+// parseDecimal reads a non-negative decimal with at most precision decimals
+// into a count of 10^-precision units.
+func parseDecimal(s string, precision int) (uint64, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) > 2 || parts[0] == "" {
+		return 0, errors.New("Invalid amount " + s)
+	}
+
+	whole, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, errors.New("Invalid amount " + s)
+	}
+	amount, err := mulAmount(whole, pow10(precision))
+	if err != nil {
+		return 0, err
+	}
+
+	if len(parts) == 2 {
+		frac := parts[1]
+		if frac == "" || len(frac) > precision {
+			return 0, errors.New("Invalid amount " + s)
+		}
+		frac = frac + strings.Repeat("0", precision-len(frac))
+		fracUnits, err := strconv.ParseUint(frac, 10, 64)
+		if err != nil {
+			return 0, errors.New("Invalid amount " + s)
+		}
+		amount, err = addAmount(amount, fracUnits)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return amount, nil
+}
+
+// formatAmount is the canonical string form of an amount in minor units.
+func formatAmount(amount uint64) string {
+	return formatDecimal(amount, MONEY_PRECISION)
+}
+
+// formatDecimal is the canonical string form of a count of 10^-precision
+// units.
+func formatDecimal(amount uint64, precision int) string {
+	scale := pow10(precision)
+	frac := strconv.FormatUint(amount%scale, 10)
+	frac = strings.Repeat("0", precision-len(frac)) + frac
+	return strconv.FormatUint(amount/scale, 10) + "." + frac
+}
+
+func pow10(n int) uint64 {
+	var p uint64 = 1
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
+
+// parsePrice reads a price with an optional currency code, e.g. "12.50" or
+// "12.50 THB". The currency is returned empty when it was not given.
+func parsePrice(s string) (uint64, string, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return 0, "", errors.New("Invalid price " + s)
+	}
+
+	price, err := parseAmount(fields[0])
+	if err != nil {
+		return 0, "", errors.New("Invalid price " + s)
+	}
+
+	currency := ""
+	if len(fields) == 2 {
+		currency = fields[1]
+	}
+	return price, currency, nil
+}
+
+func addAmount(a uint64, b uint64) (uint64, error) {
+	if a > math.MaxUint64-b {
+		return 0, errors.New("Amount overflow")
+	}
+	return a + b, nil
+}
+
+func mulAmount(a uint64, b uint64) (uint64, error) {
+	if a != 0 && b > math.MaxUint64/a {
+		return 0, errors.New("Amount overflow")
+	}
+	return a * b, nil
+}
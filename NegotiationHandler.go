@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	tableNegotiation = "Negotiation"
+	columnStep       = "Step"
+	columnAction     = "Action"
+
+	NEGOTIATION_COUNTER = "Counter"
+	NEGOTIATION_ACCEPT  = "Accept"
+	NEGOTIATION_REJECT  = "Reject"
+)
+
+type negotiationHandler struct {
+}
+
+// NegotiationMsg is one step of the negotiation on a waiting offer. Revision
+// is the offer revision the step refers to: the one countered by a buyer, or
+// the one created by a seller's counter or acceptance.
+type NegotiationMsg struct {
+	TransactionID uint64
+	Step          uint64
+	AccountID     string
+	Action        string
+	Price         string
+	Volume        uint64
+	Revision      uint64
+	LastUpdated   string
+}
+
+//
+func NewNegotiationHandler() *negotiationHandler {
+	return &negotiationHandler{}
+}
+
+func (t *negotiationHandler) createTable(stub shim.ChaincodeStubInterface) error {
+
+	err := stub.CreateTable(tableNegotiation, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnTransactionID, Type: shim.ColumnDefinition_UINT64, Key: true},
+		&shim.ColumnDefinition{Name: columnStep, Type: shim.ColumnDefinition_UINT64, Key: true},
+		&shim.ColumnDefinition{Name: columnAccountID, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnAction, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnPrice, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnVolume, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnRevision, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnLastUpdated, Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		myLogger.Errorf("system error create table negotiation %v", err)
+		return errors.New("Cannot create table negotiation.")
+	}
+
+	return nil
+}
+
+// findNegotiation returns the negotiation steps of a transaction in order.
+func (t *negotiationHandler) findNegotiation(stub shim.ChaincodeStubInterface, txID uint64) ([]NegotiationMsg, error) {
+
+	var columns []shim.Column
+	colTxID := shim.Column{Value: &shim.Column_Uint64{Uint64: txID}}
+	columns = append(columns, colTxID)
+
+	rowChannel, err := stub.GetRows(tableNegotiation, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot query negotiation.")
+	}
+
+	var steps []NegotiationMsg
+
+	for {
+		select {
+		case row, ok := <-rowChannel:
+			if !ok {
+				rowChannel = nil
+			} else {
+				steps = append(steps, NegotiationMsg{
+					row.Columns[0].GetUint64(),  //txID
+					row.Columns[1].GetUint64(),  //step
+					row.Columns[2].GetString_(), //accountID
+					row.Columns[3].GetString_(), //action
+					row.Columns[4].GetString_(), //price
+					row.Columns[5].GetUint64(),  //volume
+					row.Columns[6].GetUint64(),  //revision
+					row.Columns[7].GetString_(), //lastUpdated
+				})
+			}
+		}
+		if rowChannel == nil {
+			break
+		}
+	}
+
+	// steps are numbered from 1 without gaps, put them back in that order
+	ordered := make([]NegotiationMsg, len(steps))
+	for _, step := range steps {
+		if step.Step < 1 || step.Step > uint64(len(steps)) {
+			return nil, errors.New("Invalid negotiation step")
+		}
+		ordered[step.Step-1] = step
+	}
+
+	return ordered, nil
+}
+
+// pendingCounter returns the buyer's latest counter on an offer if the
+// seller has not answered it yet.
+func (t *negotiationHandler) pendingCounter(stub shim.ChaincodeStubInterface, txMsg *TransactionMsg) (*NegotiationMsg, error) {
+	steps, err := t.findNegotiation(stub, txMsg.TransactionID)
+	if err != nil {
+		return nil, err
+	}
+	if len(steps) == 0 {
+		return nil, nil
+	}
+
+	last := steps[len(steps)-1]
+	if last.Action != NEGOTIATION_COUNTER || last.AccountID != txMsg.BuyerID || last.Revision != txMsg.Revision {
+		return nil, nil
+	}
+	return &last, nil
+}
+
+// record appends a step to the negotiation of a transaction.
+func (t *negotiationHandler) record(stub shim.ChaincodeStubInterface,
+	txMsg *TransactionMsg,
+	accountID string,
+	action string,
+	price string,
+	volume uint64) error {
+
+	steps, err := t.findNegotiation(stub, txMsg.TransactionID)
+	if err != nil {
+		return err
+	}
+
+	lastUpdated, err := txHandler.getCurrentTime(stub)
+	if err != nil {
+		return err
+	}
+
+	ok, err := stub.InsertRow(tableNegotiation, shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: txMsg.TransactionID}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: uint64(len(steps) + 1)}},
+			&shim.Column{Value: &shim.Column_String_{String_: accountID}},
+			&shim.Column{Value: &shim.Column_String_{String_: action}},
+			&shim.Column{Value: &shim.Column_String_{String_: price}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: volume}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: txMsg.Revision}},
+			&shim.Column{Value: &shim.Column_String_{String_: lastUpdated}}},
+	})
+	if !ok || err != nil {
+		myLogger.Errorf("system error %v", err)
+		return errors.New("Cannot insert negotiation.")
+	}
+
+	return nil
+}
+
+func (t *negotiationHandler) query(stub shim.ChaincodeStubInterface, txID uint64) ([]byte, error) {
+	steps, err := t.findNegotiation(stub, txID)
+	if err != nil {
+		return nil, err
+	}
+
+	stepsJson, err := json.Marshal(steps)
+	myLogger.Debugf("Response : %s", stepsJson)
+
+	return stepsJson, nil
+}
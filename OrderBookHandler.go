@@ -0,0 +1,526 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	tableOrder       = "Order"
+	columnOrderID    = "OrderID"
+	columnSide       = "Side"
+	columnRemaining  = "Remaining"
+	tableSymbolOrder = "SymbolOrder"
+
+	stateCurrOrderID = "CurrOrderID"
+
+	SIDE_BUY  = "Buy"
+	SIDE_SELL = "Sell"
+
+	ORDER_OPEN      = "Open"
+	ORDER_FILLED    = "Filled"
+	ORDER_CANCELLED = "Cancelled"
+	ORDER_REJECTED  = "Rejected"
+)
+
+type orderBookHandler struct {
+}
+
+//
+type OrderMsg struct {
+	OrderID     uint64
+	Symbol      string
+	AccountID   string
+	Side        string
+	Price       string
+	Volume      uint64
+	Remaining   uint64
+	Status      string
+	LastUpdated string
+}
+
+//
+type DepthMsg struct {
+	Price  string
+	Volume uint64
+	Orders uint64
+}
+
+//
+type OrderBookMsg struct {
+	Symbol string
+	Bids   []DepthMsg
+	Asks   []DepthMsg
+}
+
+// orderQueue sorts resting orders by price-time priority. Bids are best at
+// the highest price, asks at the lowest; ties go to the lower OrderID.
+type orderQueue struct {
+	orders []OrderMsg
+	prices []uint64
+	side   string
+}
+
+func (q *orderQueue) Len() int { return len(q.orders) }
+
+func (q *orderQueue) Swap(i, j int) {
+	q.orders[i], q.orders[j] = q.orders[j], q.orders[i]
+	q.prices[i], q.prices[j] = q.prices[j], q.prices[i]
+}
+
+func (q *orderQueue) Less(i, j int) bool {
+	if q.prices[i] != q.prices[j] {
+		if q.side == SIDE_BUY {
+			return q.prices[i] > q.prices[j]
+		}
+		return q.prices[i] < q.prices[j]
+	}
+	return q.orders[i].OrderID < q.orders[j].OrderID
+}
+
+//
+func NewOrderBookHandler() *orderBookHandler {
+	return &orderBookHandler{}
+}
+
+func (t *orderBookHandler) createTable(stub shim.ChaincodeStubInterface) error {
+
+	err := stub.CreateTable(tableOrder, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnOrderID, Type: shim.ColumnDefinition_UINT64, Key: true},
+		&shim.ColumnDefinition{Name: columnSymbol, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnAccountID, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnSide, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnPrice, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnVolume, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnRemaining, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnStatus, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnLastUpdated, Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		myLogger.Errorf("system error create table order %v", err)
+		return errors.New("Cannot create table order.")
+	}
+
+	// Only open orders are kept in this index so the book scan stays small.
+	err = stub.CreateTable(tableSymbolOrder, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnSymbol, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnOrderID, Type: shim.ColumnDefinition_UINT64, Key: true},
+	})
+	if err != nil {
+		myLogger.Errorf("system error create table symbol order %v", err)
+		return errors.New("Cannot create table symbol order.")
+	}
+
+	return nil
+}
+
+func (t *orderBookHandler) toOrderMsg(row shim.Row) OrderMsg {
+	return OrderMsg{
+		row.Columns[0].GetUint64(),  //orderID
+		row.Columns[1].GetString_(), //symbol
+		row.Columns[2].GetString_(), //accountID
+		row.Columns[3].GetString_(), //side
+		row.Columns[4].GetString_(), //price
+		row.Columns[5].GetUint64(),  //volume
+		row.Columns[6].GetUint64(),  //remaining
+		row.Columns[7].GetString_(), //status
+		row.Columns[8].GetString_(), //lastUpdated
+	}
+}
+
+func (t *orderBookHandler) toRow(order *OrderMsg) shim.Row {
+	return shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: order.OrderID}},
+			&shim.Column{Value: &shim.Column_String_{String_: order.Symbol}},
+			&shim.Column{Value: &shim.Column_String_{String_: order.AccountID}},
+			&shim.Column{Value: &shim.Column_String_{String_: order.Side}},
+			&shim.Column{Value: &shim.Column_String_{String_: order.Price}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: order.Volume}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: order.Remaining}},
+			&shim.Column{Value: &shim.Column_String_{String_: order.Status}},
+			&shim.Column{Value: &shim.Column_String_{String_: order.LastUpdated}}},
+	}
+}
+
+func (t *orderBookHandler) nextOrderID(stub shim.ChaincodeStubInterface) (uint64, error) {
+	var orderID uint64 = 1
+
+	tmpbytes, err := stub.GetState(stateCurrOrderID)
+	if err == nil && tmpbytes != nil {
+		orderID, err = strconv.ParseUint(string(tmpbytes), 10, 64)
+		if err != nil {
+			return 0, errors.New("Cannot parse current order ID")
+		}
+		orderID++
+	}
+
+	err = stub.PutState(stateCurrOrderID, []byte(strconv.FormatUint(orderID, 10)))
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return 0, errors.New("Cannot update current order ID")
+	}
+	return orderID, nil
+}
+
+func (t *orderBookHandler) getOrder(stub shim.ChaincodeStubInterface, orderID uint64) (*OrderMsg, error) {
+
+	var columns []shim.Column
+	colOrderID := shim.Column{Value: &shim.Column_Uint64{Uint64: orderID}}
+	columns = append(columns, colOrderID)
+
+	row, err := stub.GetRow(tableOrder, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot get order.")
+	}
+
+	if len(row.Columns) == 0 {
+		return nil, nil
+	}
+
+	order := t.toOrderMsg(row)
+	return &order, nil
+}
+
+// save writes the order row and keeps the symbol index in step with its status.
+func (t *orderBookHandler) save(stub shim.ChaincodeStubInterface, order *OrderMsg, isNew bool) error {
+	lastUpdated, err := txHandler.getCurrentTime(stub)
+	if err != nil {
+		return err
+	}
+	order.LastUpdated = lastUpdated
+
+	var ok bool
+	if isNew {
+		ok, err = stub.InsertRow(tableOrder, t.toRow(order))
+	} else {
+		ok, err = stub.ReplaceRow(tableOrder, t.toRow(order))
+	}
+	if !ok || err != nil {
+		myLogger.Errorf("system error %v", err)
+		return errors.New("Cannot save order.")
+	}
+
+	index := []shim.Column{
+		shim.Column{Value: &shim.Column_String_{String_: order.Symbol}},
+		shim.Column{Value: &shim.Column_Uint64{Uint64: order.OrderID}},
+	}
+
+	if order.Status == ORDER_OPEN {
+		if isNew {
+			_, err = stub.InsertRow(tableSymbolOrder, shim.Row{
+				Columns: []*shim.Column{&index[0], &index[1]},
+			})
+		}
+	} else {
+		err = stub.DeleteRow(tableSymbolOrder, index)
+	}
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return errors.New("Cannot update order index.")
+	}
+
+	return nil
+}
+
+func (t *orderBookHandler) findOpenOrderBySymbol(stub shim.ChaincodeStubInterface, symbol string) ([]OrderMsg, error) {
+
+	var columns []shim.Column
+	colSymbol := shim.Column{Value: &shim.Column_String_{String_: symbol}}
+	columns = append(columns, colSymbol)
+
+	rowChannel, err := stub.GetRows(tableSymbolOrder, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot query order book.")
+	}
+
+	var orders []OrderMsg
+
+	for {
+		select {
+		case row, ok := <-rowChannel:
+			if !ok {
+				rowChannel = nil
+			} else {
+				order, err := t.getOrder(stub, row.Columns[1].GetUint64())
+				if err != nil {
+					return nil, err
+				}
+				if order != nil && order.Status == ORDER_OPEN {
+					orders = append(orders, *order)
+				}
+			}
+		}
+		if rowChannel == nil {
+			break
+		}
+	}
+
+	return orders, nil
+}
+
+// queue returns the resting orders on the given side of the book in
+// price-time priority.
+func (t *orderBookHandler) queue(stub shim.ChaincodeStubInterface, symbol string, side string) (*orderQueue, error) {
+	orders, err := t.findOpenOrderBySymbol(stub, symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &orderQueue{side: side}
+	for _, order := range orders {
+		if order.Side != side {
+			continue
+		}
+		price, _, err := parsePrice(order.Price)
+		if err != nil {
+			return nil, errors.New("Unable to parse Price " + order.Price)
+		}
+		q.orders = append(q.orders, order)
+		q.prices = append(q.prices, price)
+	}
+	sort.Sort(q)
+
+	return q, nil
+}
+
+// restingAtFault reports whether a settlement rejection was caused by the
+// resting order's owner rather than the incoming order.
+func (t *orderBookHandler) restingAtFault(rejection *SettlementRejection, resting *OrderMsg) bool {
+	switch rejection.Code {
+	case REJECT_INSUFFICIENT_CASH, REJECT_NO_CASH_ACCOUNT:
+		return resting.Side == SIDE_BUY
+	case REJECT_INSUFFICIENT_SHARE:
+		return resting.Side == SIDE_SELL
+	}
+	return false
+}
+
+// placeOrder adds an order to the book and matches it against the opposite
+// side. Every fill trades at the resting order's price and is recorded as a
+// transaction in clearing, settled by settleTrades on its settlement date
+// like any other confirmed trade.
+func (t *orderBookHandler) placeOrder(stub shim.ChaincodeStubInterface,
+	accountID string,
+	symbol string,
+	side string,
+	price string,
+	volume uint64) error {
+
+	price, err := secProHandler.checkPrice(stub, symbol, price)
+	if err != nil {
+		return err
+	}
+	limit, _, err := parsePrice(price)
+	if err != nil {
+		return err
+	}
+	if volume == 0 {
+		return errors.New("Invalid volume")
+	}
+	amount, err := mulAmount(limit, volume)
+	if err != nil {
+		return err
+	}
+
+	// the incoming side has to be able to settle in full, a buyer with its
+	// fees on the whole order at the limit price on top
+	if side == SIDE_BUY {
+		fees, err := feeHandler.compute(stub, &TransactionMsg{Symbol: symbol, BuyerID: accountID, Price: price, Volume: volume}, amount)
+		if err != nil {
+			return err
+		}
+		amount, err = addAmount(amount, feeHandler.total(fees, accountID))
+		if err != nil {
+			return err
+		}
+		cash, err := actMonHandler.queryAvailable(stub, accountID)
+		if err != nil || cash < amount {
+			return errors.New("Not enough money to place order")
+		}
+	} else {
+		share, err := actBalHandler.getAvailableBalance(stub, accountID, symbol)
+		if err != nil || share < volume {
+			return errors.New("Not enough balance to place order")
+		}
+	}
+
+	orderID, err := t.nextOrderID(stub)
+	if err != nil {
+		return err
+	}
+	order := &OrderMsg{orderID, symbol, accountID, side, price, volume, volume, ORDER_OPEN, ""}
+
+	opposite := SIDE_SELL
+	if side == SIDE_SELL {
+		opposite = SIDE_BUY
+	}
+	q, err := t.queue(stub, symbol, opposite)
+	if err != nil {
+		return err
+	}
+
+	for i := range q.orders {
+		if order.Remaining == 0 {
+			break
+		}
+		resting := &q.orders[i]
+		if side == SIDE_BUY && q.prices[i] > limit {
+			break
+		}
+		if side == SIDE_SELL && q.prices[i] < limit {
+			break
+		}
+		if resting.AccountID == accountID {
+			continue
+		}
+
+		fill := order.Remaining
+		if resting.Remaining < fill {
+			fill = resting.Remaining
+		}
+
+		txMsg := TransactionMsg{Symbol: symbol, Price: resting.Price, Volume: fill, TxType: TXTYPE_MATCH}
+		if side == SIDE_BUY {
+			txMsg.BuyerID, txMsg.SellerID = accountID, resting.AccountID
+		} else {
+			txMsg.BuyerID, txMsg.SellerID = resting.AccountID, accountID
+		}
+
+		// a resting order has its remaining shares reserved or its cash
+		// held at its own price, which is also the trade price; clearing
+		// keeps them set aside for the fill
+		sharesReserved, cashHeld := resting.Side == SIDE_SELL, resting.Side == SIDE_BUY
+		legs := []BasketLegMsg{BasketLegMsg{0, 1, symbol, txMsg.Price, fill}}
+		_, err = settleHandler.validateLegs(stub, &txMsg, legs, sharesReserved, cashHeld)
+		if rejection, ok := err.(*SettlementRejection); ok && rejection.Code != REJECT_SYSTEM {
+			if t.restingAtFault(rejection, resting) {
+				myLogger.Infof("order [%v] can no longer settle, removed from book", resting.OrderID)
+				if err := t.close(stub, resting, ORDER_REJECTED); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		txMsg.Status = STATUS_CLEARING
+		_, err = txHandler.insertMsg(stub, &txMsg)
+		if err != nil {
+			return err
+		}
+		err = settleHandler.clear(stub, &txMsg, sharesReserved, cashHeld)
+		if err != nil {
+			return err
+		}
+
+		order.Remaining -= fill
+		resting.Remaining -= fill
+		if resting.Remaining == 0 {
+			resting.Status = ORDER_FILLED
+		}
+		if err := t.save(stub, resting, false); err != nil {
+			return err
+		}
+	}
+
+	if order.Remaining == 0 {
+		order.Status = ORDER_FILLED
+	} else if side == SIDE_SELL {
+		err = actBalHandler.reserve(stub, accountID, symbol, order.Remaining)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = actMonHandler.hold(stub, accountID, limit*order.Remaining) // bounded by amount above
+		if err != nil {
+			return err
+		}
+	}
+	return t.save(stub, order, true)
+}
+
+// close takes an open order off the book and releases whatever shares or
+// cash it still has set aside.
+func (t *orderBookHandler) close(stub shim.ChaincodeStubInterface, order *OrderMsg, status string) error {
+	if order.Side == SIDE_SELL && order.Remaining > 0 {
+		err := actBalHandler.release(stub, order.AccountID, order.Symbol, order.Remaining)
+		if err != nil {
+			return err
+		}
+	}
+
+	if order.Side == SIDE_BUY && order.Remaining > 0 {
+		price, _, err := parsePrice(order.Price)
+		if err != nil {
+			return errors.New("Unable to parse Price " + order.Price)
+		}
+		err = actMonHandler.releaseHold(stub, order.AccountID, price*order.Remaining)
+		if err != nil {
+			return err
+		}
+	}
+
+	order.Status = status
+	return t.save(stub, order, false)
+}
+
+func (t *orderBookHandler) cancelOrder(stub shim.ChaincodeStubInterface, accountID string, orderID uint64) error {
+
+	order, err := t.getOrder(stub, orderID)
+	if order == nil || err != nil {
+		return errors.New("Cannot find order")
+	}
+
+	if order.AccountID != accountID {
+		return errors.New("Invalid accountID")
+	}
+
+	if order.Status != ORDER_OPEN {
+		return errors.New("Invalid Status")
+	}
+
+	return t.close(stub, order, ORDER_CANCELLED)
+}
+
+// depth aggregates the open orders of a symbol into price levels, best first.
+func (t *orderBookHandler) depth(stub shim.ChaincodeStubInterface, symbol string) ([]byte, error) {
+
+	book := OrderBookMsg{Symbol: symbol}
+
+	for _, side := range []string{SIDE_BUY, SIDE_SELL} {
+		q, err := t.queue(stub, symbol, side)
+		if err != nil {
+			return nil, err
+		}
+
+		var levels []DepthMsg
+		for i, order := range q.orders {
+			if i > 0 && q.prices[i] == q.prices[i-1] {
+				levels[len(levels)-1].Volume += order.Remaining
+				levels[len(levels)-1].Orders++
+				continue
+			}
+			levels = append(levels, DepthMsg{order.Price, order.Remaining, 1})
+		}
+
+		if side == SIDE_BUY {
+			book.Bids = levels
+		} else {
+			book.Asks = levels
+		}
+	}
+
+	bookJson, err := json.Marshal(book)
+	myLogger.Debugf("Response : %s", bookJson)
+
+	return bookJson, err
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	tableRFQ        = "RFQ"
+	tableRFQQuote   = "RFQQuote"
+	tableAccountRFQ = "AccountRFQ"
+	columnRFQID     = "RFQID"
+	columnRequester = "RequesterID"
+	columnHolderID  = "HolderID"
+
+	stateCurrRFQID = "CurrRFQID"
+
+	RFQ_OPEN      = "Open"
+	RFQ_ACCEPTED  = "Accepted"
+	RFQ_CANCELLED = "Cancelled"
+	RFQ_EXPIRED   = "Expired"
+
+	// how long an RFQ stays open before expireOffers closes it
+	RFQ_LIFETIME = 24 * time.Hour
+
+	QUOTE_REQUESTED = "Requested" // holder asked, no price yet
+	QUOTE_QUOTED    = "Quoted"    // price given, holder's shares reserved
+	QUOTE_ACCEPTED  = "Accepted"  // TransactionID is the resulting trade
+	QUOTE_EXPIRED   = "Expired"   // another quote won or the RFQ was closed
+	QUOTE_WITHDRAWN = "Withdrawn" // the holder took its quote back
+)
+
+type quoteRequestHandler struct {
+}
+
+// RFQMsg is a request for quotes on Volume shares of Symbol sent to a list
+// of holders. It is closed as expired if still open at ExpiryTime.
+type RFQMsg struct {
+	RFQID       uint64
+	Symbol      string
+	RequesterID string
+	Volume      uint64
+	Status      string
+	ExpiryTime  string
+	LastUpdated string
+	Quotes      []QuoteMsg
+}
+
+//
+type QuoteMsg struct {
+	RFQID         uint64
+	HolderID      string
+	Price         string
+	Status        string
+	TransactionID uint64
+	LastUpdated   string
+}
+
+//
+func NewQuoteRequestHandler() *quoteRequestHandler {
+	return &quoteRequestHandler{}
+}
+
+func (t *quoteRequestHandler) createTable(stub shim.ChaincodeStubInterface) error {
+
+	err := stub.CreateTable(tableRFQ, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnRFQID, Type: shim.ColumnDefinition_UINT64, Key: true},
+		&shim.ColumnDefinition{Name: columnSymbol, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnRequester, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnVolume, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnStatus, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnLastUpdated, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnExpiryTime, Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		myLogger.Errorf("system error create table rfq %v", err)
+		return errors.New("Cannot create table rfq.")
+	}
+
+	err = stub.CreateTable(tableRFQQuote, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnRFQID, Type: shim.ColumnDefinition_UINT64, Key: true},
+		&shim.ColumnDefinition{Name: columnHolderID, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnPrice, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnStatus, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnTransactionID, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnLastUpdated, Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		myLogger.Errorf("system error create table rfq quote %v", err)
+		return errors.New("Cannot create table rfq quote.")
+	}
+
+	// RFQs by requester and by holder asked
+	err = stub.CreateTable(tableAccountRFQ, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnAccountID, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnRFQID, Type: shim.ColumnDefinition_UINT64, Key: true},
+	})
+	if err != nil {
+		myLogger.Errorf("system error create table account rfq %v", err)
+		return errors.New("Cannot create table account rfq.")
+	}
+
+	return nil
+}
+
+func (t *quoteRequestHandler) nextRFQID(stub shim.ChaincodeStubInterface) (uint64, error) {
+	var rfqID uint64 = 1
+
+	tmpbytes, err := stub.GetState(stateCurrRFQID)
+	if err == nil && tmpbytes != nil {
+		rfqID, err = strconv.ParseUint(string(tmpbytes), 10, 64)
+		if err != nil {
+			return 0, errors.New("Cannot get RFQ ID.")
+		}
+		rfqID++
+	}
+
+	return rfqID, stub.PutState(stateCurrRFQID, []byte(strconv.FormatUint(rfqID, 10)))
+}
+
+// insert opens an RFQ and a requested quote for each holder.
+func (t *quoteRequestHandler) insert(stub shim.ChaincodeStubInterface, rfq *RFQMsg, holders []string) (uint64, error) {
+
+	rfqID, err := t.nextRFQID(stub)
+	if err != nil {
+		return 0, err
+	}
+	rfq.RFQID = rfqID
+	rfq.Status = RFQ_OPEN
+
+	err = t.putRFQ(stub, rfq, true)
+	if err != nil {
+		return 0, err
+	}
+	err = t.index(stub, rfq.RequesterID, rfqID)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, holder := range holders {
+		quote := QuoteMsg{RFQID: rfqID, HolderID: holder, Status: QUOTE_REQUESTED}
+		err = t.putQuote(stub, &quote, true)
+		if err != nil {
+			return 0, err
+		}
+		err = t.index(stub, holder, rfqID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	myLogger.Debugf("insert rfq [%v]", rfqID)
+	return rfqID, nil
+}
+
+func (t *quoteRequestHandler) index(stub shim.ChaincodeStubInterface, accountID string, rfqID uint64) error {
+	ok, err := stub.InsertRow(tableAccountRFQ, shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: accountID}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: rfqID}}},
+	})
+	if !ok || err != nil {
+		myLogger.Errorf("system error %v", err)
+		return errors.New("Cannot insert rfq index.")
+	}
+	return nil
+}
+
+func (t *quoteRequestHandler) putRFQ(stub shim.ChaincodeStubInterface, rfq *RFQMsg, insert bool) error {
+
+	lastUpdated, err := txHandler.getCurrentTime(stub)
+	if err != nil {
+		return err
+	}
+	rfq.LastUpdated = lastUpdated
+
+	row := shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: rfq.RFQID}},
+			&shim.Column{Value: &shim.Column_String_{String_: rfq.Symbol}},
+			&shim.Column{Value: &shim.Column_String_{String_: rfq.RequesterID}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: rfq.Volume}},
+			&shim.Column{Value: &shim.Column_String_{String_: rfq.Status}},
+			&shim.Column{Value: &shim.Column_String_{String_: rfq.LastUpdated}},
+			&shim.Column{Value: &shim.Column_String_{String_: rfq.ExpiryTime}}},
+	}
+
+	var ok bool
+	if insert {
+		ok, err = stub.InsertRow(tableRFQ, row)
+	} else {
+		ok, err = stub.ReplaceRow(tableRFQ, row)
+	}
+	if !ok || err != nil {
+		myLogger.Errorf("system error %v", err)
+		return errors.New("Cannot save rfq.")
+	}
+	return nil
+}
+
+func (t *quoteRequestHandler) putQuote(stub shim.ChaincodeStubInterface, quote *QuoteMsg, insert bool) error {
+
+	lastUpdated, err := txHandler.getCurrentTime(stub)
+	if err != nil {
+		return err
+	}
+	quote.LastUpdated = lastUpdated
+
+	row := shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: quote.RFQID}},
+			&shim.Column{Value: &shim.Column_String_{String_: quote.HolderID}},
+			&shim.Column{Value: &shim.Column_String_{String_: quote.Price}},
+			&shim.Column{Value: &shim.Column_String_{String_: quote.Status}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: quote.TransactionID}},
+			&shim.Column{Value: &shim.Column_String_{String_: quote.LastUpdated}}},
+	}
+
+	var ok bool
+	if insert {
+		ok, err = stub.InsertRow(tableRFQQuote, row)
+	} else {
+		ok, err = stub.ReplaceRow(tableRFQQuote, row)
+	}
+	if !ok || err != nil {
+		myLogger.Errorf("system error %v", err)
+		return errors.New("Cannot save rfq quote.")
+	}
+	return nil
+}
+
+// getRFQ returns an RFQ with all of its quotes, or nil if there is none.
+func (t *quoteRequestHandler) getRFQ(stub shim.ChaincodeStubInterface, rfqID uint64) (*RFQMsg, error) {
+
+	var columns []shim.Column
+	colRFQID := shim.Column{Value: &shim.Column_Uint64{Uint64: rfqID}}
+	columns = append(columns, colRFQID)
+
+	row, err := stub.GetRow(tableRFQ, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot get rfq.")
+	}
+	if len(row.Columns) == 0 {
+		return nil, nil
+	}
+
+	rfq := t.toRFQMsg(row)
+
+	rowChannel, err := stub.GetRows(tableRFQQuote, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot query rfq quote.")
+	}
+
+	for {
+		select {
+		case row, ok := <-rowChannel:
+			if !ok {
+				rowChannel = nil
+			} else {
+				rfq.Quotes = append(rfq.Quotes, QuoteMsg{
+					row.Columns[0].GetUint64(),  //rfqID
+					row.Columns[1].GetString_(), //holderID
+					row.Columns[2].GetString_(), //price
+					row.Columns[3].GetString_(), //status
+					row.Columns[4].GetUint64(),  //txID
+					row.Columns[5].GetString_(), //lastUpdated
+				})
+			}
+		}
+		if rowChannel == nil {
+			break
+		}
+	}
+
+	return &rfq, nil
+}
+
+func (t *quoteRequestHandler) toRFQMsg(row shim.Row) RFQMsg {
+	return RFQMsg{
+		row.Columns[0].GetUint64(),  //rfqID
+		row.Columns[1].GetString_(), //symbol
+		row.Columns[2].GetString_(), //requesterID
+		row.Columns[3].GetUint64(),  //volume
+		row.Columns[4].GetString_(), //status
+		row.Columns[6].GetString_(), //expiryTime
+		row.Columns[5].GetString_(), //lastUpdated
+		nil,
+	}
+}
+
+// isExpired reports whether an open RFQ has passed its expiry time at now.
+func (t *quoteRequestHandler) isExpired(rfq *RFQMsg, now time.Time) bool {
+	if rfq.Status != RFQ_OPEN || rfq.ExpiryTime == "" {
+		return false
+	}
+	expiry, err := time.Parse(time.RFC3339Nano, rfq.ExpiryTime)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return false
+	}
+	return !now.Before(expiry)
+}
+
+// findExpiredRFQ returns the open RFQs whose expiry time has passed.
+func (t *quoteRequestHandler) findExpiredRFQ(stub shim.ChaincodeStubInterface) ([]RFQMsg, error) {
+	return t.findRFQAt(stub, func(rfq *RFQMsg, now time.Time) bool {
+		return t.isExpired(rfq, now)
+	})
+}
+
+// findOpenRFQBySymbol returns the open RFQs on a symbol.
+func (t *quoteRequestHandler) findOpenRFQBySymbol(stub shim.ChaincodeStubInterface, symbol string) ([]RFQMsg, error) {
+	return t.findRFQAt(stub, func(rfq *RFQMsg, now time.Time) bool {
+		return rfq.Symbol == symbol && rfq.Status == RFQ_OPEN
+	})
+}
+
+// findRFQAt returns the RFQs, with their quotes, that match at the current
+// ledger time.
+func (t *quoteRequestHandler) findRFQAt(stub shim.ChaincodeStubInterface,
+	match func(rfq *RFQMsg, now time.Time) bool) ([]RFQMsg, error) {
+
+	now, err := ledgerClock.Now(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var columns []shim.Column
+	rowChannel, err := stub.GetRows(tableRFQ, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot query rfq.")
+	}
+
+	var rfqIDs []uint64
+
+	for {
+		select {
+		case row, ok := <-rowChannel:
+			if !ok {
+				rowChannel = nil
+			} else {
+				rfq := t.toRFQMsg(row)
+				if match(&rfq, now) {
+					rfqIDs = append(rfqIDs, rfq.RFQID)
+				}
+			}
+		}
+		if rowChannel == nil {
+			break
+		}
+	}
+
+	var rfqs []RFQMsg
+	for _, rfqID := range rfqIDs {
+		rfq, err := t.getRFQ(stub, rfqID)
+		if err != nil || rfq == nil {
+			return nil, errors.New("Cannot query rfq.")
+		}
+		rfqs = append(rfqs, *rfq)
+	}
+
+	return rfqs, nil
+}
+
+// withdraw takes a holder's quote off an RFQ and releases the shares
+// reserved for it. The RFQ stays open for the other holders.
+func (t *quoteRequestHandler) withdraw(stub shim.ChaincodeStubInterface, rfq *RFQMsg, quote *QuoteMsg) error {
+
+	if quote.Status == QUOTE_QUOTED {
+		err := actBalHandler.release(stub, quote.HolderID, rfq.Symbol, rfq.Volume)
+		if err != nil {
+			return err
+		}
+	}
+	quote.Status = QUOTE_WITHDRAWN
+	return t.putQuote(stub, quote, false)
+}
+
+// quoteOf returns the quote of a holder on an RFQ, or nil if the holder was
+// not asked.
+func (t *quoteRequestHandler) quoteOf(rfq *RFQMsg, holderID string) *QuoteMsg {
+	for i := range rfq.Quotes {
+		if rfq.Quotes[i].HolderID == holderID {
+			return &rfq.Quotes[i]
+		}
+	}
+	return nil
+}
+
+// close ends an RFQ with status and expires every quote still open,
+// releasing the shares reserved for them.
+func (t *quoteRequestHandler) close(stub shim.ChaincodeStubInterface, rfq *RFQMsg, status string) error {
+
+	for i := range rfq.Quotes {
+		quote := &rfq.Quotes[i]
+		if quote.Status != QUOTE_REQUESTED && quote.Status != QUOTE_QUOTED {
+			continue
+		}
+		if quote.Status == QUOTE_QUOTED {
+			err := actBalHandler.release(stub, quote.HolderID, rfq.Symbol, rfq.Volume)
+			if err != nil {
+				return err
+			}
+		}
+		quote.Status = QUOTE_EXPIRED
+		err := t.putQuote(stub, quote, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	rfq.Status = status
+	return t.putRFQ(stub, rfq, false)
+}
+
+// findRFQ returns the RFQs an account sent or was asked to quote on. A
+// holder only sees its own quote.
+func (t *quoteRequestHandler) findRFQ(stub shim.ChaincodeStubInterface, accountID string) ([]RFQMsg, error) {
+
+	var columns []shim.Column
+	colAccountID := shim.Column{Value: &shim.Column_String_{String_: accountID}}
+	columns = append(columns, colAccountID)
+
+	rowChannel, err := stub.GetRows(tableAccountRFQ, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot query rfq.")
+	}
+
+	var rfqs []RFQMsg
+
+	for {
+		select {
+		case row, ok := <-rowChannel:
+			if !ok {
+				rowChannel = nil
+			} else {
+				rfq, err := t.getRFQ(stub, row.Columns[1].GetUint64())
+				if err != nil || rfq == nil {
+					return nil, errors.New("Cannot query rfq.")
+				}
+				rfqs = append(rfqs, *t.visibleTo(rfq, accountID))
+			}
+		}
+		if rowChannel == nil {
+			break
+		}
+	}
+
+	return rfqs, nil
+}
+
+// visibleTo hides the other holders' quotes from a holder.
+func (t *quoteRequestHandler) visibleTo(rfq *RFQMsg, accountID string) *RFQMsg {
+	if accountID == rfq.RequesterID {
+		return rfq
+	}
+	var quotes []QuoteMsg
+	if quote := t.quoteOf(rfq, accountID); quote != nil {
+		quotes = append(quotes, *quote)
+	}
+	rfq.Quotes = quotes
+	return rfq
+}
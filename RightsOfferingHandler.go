@@ -0,0 +1,515 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	tableRightsOffering    = "RightsOffering"
+	tableRightsEntitlement = "RightsEntitlement"
+	tableAccountRights     = "AccountRights"
+	columnOfferingID       = "OfferingID"
+	columnNewShares        = "NewShares"
+	columnHeldShares       = "HeldShares"
+	columnEntitled         = "Entitled"
+	columnSubscribed       = "Subscribed"
+	columnIssued           = "Issued"
+
+	stateCurrOfferingID = "CurrOfferingID"
+
+	RIGHTS_OPEN      = "Open"
+	RIGHTS_CLOSED    = "Closed"
+	RIGHTS_CANCELLED = "Cancelled"
+
+	// what happens to rights a holder does not take up itself
+	RIGHTS_LAPSE        = "Lapse"        // they expire at the close
+	RIGHTS_TRANSFERABLE = "Transferable" // they can be passed to another account
+)
+
+type rightsOfferingHandler struct {
+}
+
+// RightsOfferingMsg offers new shares of Symbol at Price to its holders,
+// NewShares for every HeldShares they held when the offering was declared.
+// Issued is the number of shares issued when it closed.
+type RightsOfferingMsg struct {
+	OfferingID   uint64
+	Symbol       string
+	IssuerID     string
+	NewShares    uint64
+	HeldShares   uint64
+	Price        string
+	CloseTime    string
+	Policy       string
+	Status       string
+	Issued       uint64
+	LastUpdated  string
+	Entitlements []RightsEntitlementMsg
+}
+
+// RightsEntitlementMsg is the number of new shares an account may subscribe
+// for and how many it has. Price times Subscribed is held from its money
+// until the offering closes.
+type RightsEntitlementMsg struct {
+	OfferingID  uint64
+	AccountID   string
+	Entitled    uint64
+	Subscribed  uint64
+	LastUpdated string
+}
+
+//
+func NewRightsOfferingHandler() *rightsOfferingHandler {
+	return &rightsOfferingHandler{}
+}
+
+func (t *rightsOfferingHandler) createTable(stub shim.ChaincodeStubInterface) error {
+
+	err := stub.CreateTable(tableRightsOffering, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnOfferingID, Type: shim.ColumnDefinition_UINT64, Key: true},
+		&shim.ColumnDefinition{Name: columnSymbol, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnIssuerID, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnNewShares, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnHeldShares, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnPrice, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnCloseTime, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnPolicy, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnStatus, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnIssued, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnLastUpdated, Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		myLogger.Errorf("system error create table rights offering %v", err)
+		return errors.New("Cannot create table rights offering.")
+	}
+
+	err = stub.CreateTable(tableRightsEntitlement, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnOfferingID, Type: shim.ColumnDefinition_UINT64, Key: true},
+		&shim.ColumnDefinition{Name: columnAccountID, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnEntitled, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnSubscribed, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnLastUpdated, Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		myLogger.Errorf("system error create table rights entitlement %v", err)
+		return errors.New("Cannot create table rights entitlement.")
+	}
+
+	// offerings by issuer and by entitled account
+	err = stub.CreateTable(tableAccountRights, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnAccountID, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnOfferingID, Type: shim.ColumnDefinition_UINT64, Key: true},
+	})
+	if err != nil {
+		myLogger.Errorf("system error create table account rights %v", err)
+		return errors.New("Cannot create table account rights.")
+	}
+
+	return nil
+}
+
+func (t *rightsOfferingHandler) nextOfferingID(stub shim.ChaincodeStubInterface) (uint64, error) {
+	var offeringID uint64 = 1
+
+	tmpbytes, err := stub.GetState(stateCurrOfferingID)
+	if err == nil && tmpbytes != nil {
+		offeringID, err = strconv.ParseUint(string(tmpbytes), 10, 64)
+		if err != nil {
+			return 0, errors.New("Cannot get offering ID.")
+		}
+		offeringID++
+	}
+
+	return offeringID, stub.PutState(stateCurrOfferingID, []byte(strconv.FormatUint(offeringID, 10)))
+}
+
+// insert declares an offering and snapshots the holders of its symbol. Each
+// holder other than the issuer is entitled to NewShares for every HeldShares
+// it holds, rounded down.
+func (t *rightsOfferingHandler) insert(stub shim.ChaincodeStubInterface, offering *RightsOfferingMsg) (uint64, error) {
+
+	offeringID, err := t.nextOfferingID(stub)
+	if err != nil {
+		return 0, err
+	}
+	offering.OfferingID = offeringID
+	offering.Status = RIGHTS_OPEN
+
+	err = t.putOffering(stub, offering, true)
+	if err != nil {
+		return 0, err
+	}
+	err = t.index(stub, offering.IssuerID, offeringID)
+	if err != nil {
+		return 0, err
+	}
+
+	holders, err := actBalHandler.findHolderBySymbol(stub, offering.Symbol)
+	if err != nil {
+		return 0, err
+	}
+	for _, holder := range holders {
+		if holder.AccountID == offering.IssuerID {
+			continue
+		}
+		entitled, err := mulAmount(holder.Balance, offering.NewShares)
+		if err != nil {
+			return 0, err
+		}
+		entitled = entitled / offering.HeldShares
+		if entitled == 0 {
+			continue
+		}
+
+		entitlement := RightsEntitlementMsg{OfferingID: offeringID, AccountID: holder.AccountID, Entitled: entitled}
+		err = t.putEntitlement(stub, &entitlement, true)
+		if err != nil {
+			return 0, err
+		}
+		offering.Entitlements = append(offering.Entitlements, entitlement)
+	}
+
+	myLogger.Debugf("insert rights offering [%v]", offeringID)
+	return offeringID, nil
+}
+
+func (t *rightsOfferingHandler) index(stub shim.ChaincodeStubInterface, accountID string, offeringID uint64) error {
+	ok, err := stub.InsertRow(tableAccountRights, shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: accountID}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: offeringID}}},
+	})
+	if !ok || err != nil {
+		myLogger.Errorf("system error %v", err)
+		return errors.New("Cannot insert rights offering index.")
+	}
+	return nil
+}
+
+func (t *rightsOfferingHandler) putOffering(stub shim.ChaincodeStubInterface, offering *RightsOfferingMsg, insert bool) error {
+
+	lastUpdated, err := txHandler.getCurrentTime(stub)
+	if err != nil {
+		return err
+	}
+	offering.LastUpdated = lastUpdated
+
+	row := shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: offering.OfferingID}},
+			&shim.Column{Value: &shim.Column_String_{String_: offering.Symbol}},
+			&shim.Column{Value: &shim.Column_String_{String_: offering.IssuerID}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: offering.NewShares}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: offering.HeldShares}},
+			&shim.Column{Value: &shim.Column_String_{String_: offering.Price}},
+			&shim.Column{Value: &shim.Column_String_{String_: offering.CloseTime}},
+			&shim.Column{Value: &shim.Column_String_{String_: offering.Policy}},
+			&shim.Column{Value: &shim.Column_String_{String_: offering.Status}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: offering.Issued}},
+			&shim.Column{Value: &shim.Column_String_{String_: offering.LastUpdated}}},
+	}
+
+	var ok bool
+	if insert {
+		ok, err = stub.InsertRow(tableRightsOffering, row)
+	} else {
+		ok, err = stub.ReplaceRow(tableRightsOffering, row)
+	}
+	if !ok || err != nil {
+		myLogger.Errorf("system error %v", err)
+		return errors.New("Cannot save rights offering.")
+	}
+	return nil
+}
+
+// putEntitlement saves an entitlement and, for a new one, indexes the
+// offering under the entitled account.
+func (t *rightsOfferingHandler) putEntitlement(stub shim.ChaincodeStubInterface, entitlement *RightsEntitlementMsg, insert bool) error {
+
+	lastUpdated, err := txHandler.getCurrentTime(stub)
+	if err != nil {
+		return err
+	}
+	entitlement.LastUpdated = lastUpdated
+
+	row := shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: entitlement.OfferingID}},
+			&shim.Column{Value: &shim.Column_String_{String_: entitlement.AccountID}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: entitlement.Entitled}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: entitlement.Subscribed}},
+			&shim.Column{Value: &shim.Column_String_{String_: entitlement.LastUpdated}}},
+	}
+
+	var ok bool
+	if insert {
+		ok, err = stub.InsertRow(tableRightsEntitlement, row)
+	} else {
+		ok, err = stub.ReplaceRow(tableRightsEntitlement, row)
+	}
+	if !ok || err != nil {
+		myLogger.Errorf("system error %v", err)
+		return errors.New("Cannot save rights entitlement.")
+	}
+
+	if insert {
+		return t.index(stub, entitlement.AccountID, entitlement.OfferingID)
+	}
+	return nil
+}
+
+// getOffering returns an offering with all of its entitlements, or nil if
+// there is none.
+func (t *rightsOfferingHandler) getOffering(stub shim.ChaincodeStubInterface, offeringID uint64) (*RightsOfferingMsg, error) {
+
+	var columns []shim.Column
+	colOfferingID := shim.Column{Value: &shim.Column_Uint64{Uint64: offeringID}}
+	columns = append(columns, colOfferingID)
+
+	row, err := stub.GetRow(tableRightsOffering, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot get rights offering.")
+	}
+	if len(row.Columns) == 0 {
+		return nil, nil
+	}
+
+	offering := RightsOfferingMsg{
+		row.Columns[0].GetUint64(),   //offeringID
+		row.Columns[1].GetString_(),  //symbol
+		row.Columns[2].GetString_(),  //issuerID
+		row.Columns[3].GetUint64(),   //newShares
+		row.Columns[4].GetUint64(),   //heldShares
+		row.Columns[5].GetString_(),  //price
+		row.Columns[6].GetString_(),  //closeTime
+		row.Columns[7].GetString_(),  //policy
+		row.Columns[8].GetString_(),  //status
+		row.Columns[9].GetUint64(),   //issued
+		row.Columns[10].GetString_(), //lastUpdated
+		nil,
+	}
+
+	rowChannel, err := stub.GetRows(tableRightsEntitlement, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot query rights entitlement.")
+	}
+
+	for {
+		select {
+		case row, ok := <-rowChannel:
+			if !ok {
+				rowChannel = nil
+			} else {
+				offering.Entitlements = append(offering.Entitlements, RightsEntitlementMsg{
+					row.Columns[0].GetUint64(),  //offeringID
+					row.Columns[1].GetString_(), //accountID
+					row.Columns[2].GetUint64(),  //entitled
+					row.Columns[3].GetUint64(),  //subscribed
+					row.Columns[4].GetString_(), //lastUpdated
+				})
+			}
+		}
+		if rowChannel == nil {
+			break
+		}
+	}
+
+	return &offering, nil
+}
+
+// entitlementOf returns the entitlement of an account, or nil if it has
+// none.
+func (t *rightsOfferingHandler) entitlementOf(offering *RightsOfferingMsg, accountID string) *RightsEntitlementMsg {
+	for i := range offering.Entitlements {
+		if offering.Entitlements[i].AccountID == accountID {
+			return &offering.Entitlements[i]
+		}
+	}
+	return nil
+}
+
+// subscriptionAmount is the money held for volume subscribed shares.
+func (t *rightsOfferingHandler) subscriptionAmount(offering *RightsOfferingMsg, volume uint64) (uint64, error) {
+	price, _, err := parsePrice(offering.Price)
+	if err != nil {
+		return 0, errors.New("Unable to parse Price " + offering.Price)
+	}
+	return mulAmount(price, volume)
+}
+
+// subscribe takes up volume more of an account's rights and holds the money
+// to pay for them.
+func (t *rightsOfferingHandler) subscribe(stub shim.ChaincodeStubInterface, offering *RightsOfferingMsg, entitlement *RightsEntitlementMsg, volume uint64) error {
+
+	if volume == 0 || volume > entitlement.Entitled-entitlement.Subscribed {
+		return errors.New("Invalid volume")
+	}
+
+	amount, err := t.subscriptionAmount(offering, volume)
+	if err != nil {
+		return err
+	}
+	err = actMonHandler.hold(stub, entitlement.AccountID, amount)
+	if err != nil {
+		return err
+	}
+
+	entitlement.Subscribed += volume
+	return t.putEntitlement(stub, entitlement, false)
+}
+
+// transfer passes volume of an account's unexercised rights to another
+// account.
+func (t *rightsOfferingHandler) transfer(stub shim.ChaincodeStubInterface, offering *RightsOfferingMsg, from *RightsEntitlementMsg, toAccount string, volume uint64) error {
+
+	if volume == 0 || volume > from.Entitled-from.Subscribed {
+		return errors.New("Invalid volume")
+	}
+
+	to := t.entitlementOf(offering, toAccount)
+	insert := to == nil
+	if insert {
+		to = &RightsEntitlementMsg{OfferingID: offering.OfferingID, AccountID: toAccount}
+	}
+
+	from.Entitled -= volume
+	to.Entitled += volume
+
+	err := t.putEntitlement(stub, from, false)
+	if err != nil {
+		return err
+	}
+	return t.putEntitlement(stub, to, insert)
+}
+
+// close pays the issuer for every subscription and issues the subscribed
+// shares. Rights nobody took up lapse.
+func (t *rightsOfferingHandler) close(stub shim.ChaincodeStubInterface, offering *RightsOfferingMsg) error {
+
+	supplyBefore, err := auditHandler.getSupply(stub, offering.Symbol)
+	if err != nil {
+		return err
+	}
+
+	var raised uint64
+	for i := range offering.Entitlements {
+		entitlement := &offering.Entitlements[i]
+		if entitlement.Subscribed == 0 {
+			continue
+		}
+
+		amount, err := t.subscriptionAmount(offering, entitlement.Subscribed)
+		if err != nil {
+			return err
+		}
+		err = actMonHandler.releaseHold(stub, entitlement.AccountID, amount)
+		if err != nil {
+			return err
+		}
+		err = actMonHandler.transfer(stub, entitlement.AccountID, offering.IssuerID, amount)
+		if err != nil {
+			return err
+		}
+		err = actBalHandler.issueStock(stub, entitlement.AccountID, offering.Symbol, entitlement.Subscribed)
+		if err != nil {
+			return err
+		}
+
+		offering.Issued += entitlement.Subscribed
+		raised += amount
+	}
+
+	_, err = corpHandler.record(stub, &CorporateActionMsg{
+		Symbol:       offering.Symbol,
+		ActionType:   CORP_ACTION_RIGHTS,
+		Ratio:        strconv.FormatUint(offering.NewShares, 10) + ":" + strconv.FormatUint(offering.HeldShares, 10),
+		Policy:       offering.Policy,
+		Price:        offering.Price,
+		AccountID:    offering.IssuerID,
+		SupplyBefore: supplyBefore,
+		SupplyAfter:  supplyBefore + offering.Issued,
+		Amount:       raised,
+	})
+	if err != nil {
+		return err
+	}
+
+	myLogger.Infof("rights offering [%v] closed, issued [%v]", offering.OfferingID, offering.Issued)
+	offering.Status = RIGHTS_CLOSED
+	return t.putOffering(stub, offering, false)
+}
+
+// cancel withdraws an open offering and releases the money held for
+// subscriptions.
+func (t *rightsOfferingHandler) cancel(stub shim.ChaincodeStubInterface, offering *RightsOfferingMsg) error {
+
+	for i := range offering.Entitlements {
+		entitlement := &offering.Entitlements[i]
+		amount, err := t.subscriptionAmount(offering, entitlement.Subscribed)
+		if err != nil {
+			return err
+		}
+		err = actMonHandler.releaseHold(stub, entitlement.AccountID, amount)
+		if err != nil {
+			return err
+		}
+	}
+
+	offering.Status = RIGHTS_CANCELLED
+	return t.putOffering(stub, offering, false)
+}
+
+// findRightsOffering returns the offerings an account declared or holds
+// rights in. An entitled account only sees its own entitlement.
+func (t *rightsOfferingHandler) findRightsOffering(stub shim.ChaincodeStubInterface, accountID string) ([]RightsOfferingMsg, error) {
+
+	var columns []shim.Column
+	colAccountID := shim.Column{Value: &shim.Column_String_{String_: accountID}}
+	columns = append(columns, colAccountID)
+
+	rowChannel, err := stub.GetRows(tableAccountRights, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot query rights offering.")
+	}
+
+	var offerings []RightsOfferingMsg
+
+	for {
+		select {
+		case row, ok := <-rowChannel:
+			if !ok {
+				rowChannel = nil
+			} else {
+				offering, err := t.getOffering(stub, row.Columns[1].GetUint64())
+				if err != nil || offering == nil {
+					return nil, errors.New("Cannot query rights offering.")
+				}
+				offerings = append(offerings, *t.visibleTo(offering, accountID))
+			}
+		}
+		if rowChannel == nil {
+			break
+		}
+	}
+
+	return offerings, nil
+}
+
+// visibleTo hides the other holders' entitlements from a holder.
+func (t *rightsOfferingHandler) visibleTo(offering *RightsOfferingMsg, accountID string) *RightsOfferingMsg {
+	if accountID == offering.IssuerID {
+		return offering
+	}
+	var entitlements []RightsEntitlementMsg
+	if entitlement := t.entitlementOf(offering, accountID); entitlement != nil {
+		entitlements = append(entitlements, *entitlement)
+	}
+	offering.Entitlements = entitlements
+	return offering
+}
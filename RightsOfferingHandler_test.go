@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeclareRightsOfferingIssuer(t *testing.T) {
+	defer restoreClock()
+
+	tests := []struct {
+		name     string
+		issuerID string
+		symbol   string
+		wantErr  bool
+	}{
+		{"own symbol", "owner01", "Ookbee", false},
+		{"another issuer's symbol", "owner02", "Ookbee", true},
+		{"unknown symbol", "owner01", "Nope", true},
+	}
+
+	for _, tc := range tests {
+		stub := newTestStub(t)
+		err := stub.as(tc.issuerID, ROLE_ISSUER).invoke("declareRightsOffering",
+			tc.symbol, "1", "10", "1", formatTime(testEpoch.Add(time.Hour)), RIGHTS_LAPSE)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%v: error %v, want error %v", tc.name, err, tc.wantErr)
+		}
+		if offering, _ := rightsHandler.getOffering(stub, 1); (offering != nil) == tc.wantErr {
+			t.Errorf("%v: offering %v", tc.name, offering)
+		}
+	}
+}
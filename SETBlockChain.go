@@ -7,6 +7,7 @@ import (
 	"errors"
 	"strconv"
 	//"strings"
+	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	"github.com/op/go-logging"
@@ -18,12 +19,25 @@ var txHandler = NewTransactionHandler()
 var actBalHandler = NewAccountBalanceHandler()
 var actMonHandler = NewAccountMoneyHandler()
 var secProHandler = NewSecurityProfileHandler()
+var settleHandler = NewSettlementHandler()
+var orderHandler = NewOrderBookHandler()
+var auditHandler = NewLedgerAuditHandler()
+var negHandler = NewNegotiationHandler()
+var feeHandler = NewFeeScheduleHandler()
+var rfqHandler = NewQuoteRequestHandler()
+var auctHandler = NewAuctionHandler()
+var divHandler = NewDividendHandler()
+var corpHandler = NewCorporateActionHandler()
+var rightsHandler = NewRightsOfferingHandler()
+var capHandler = NewCapTableHandler()
 
 const (
-	ROLE_ISSUER = "issuer"
-	ROLE_TRADER = "trader"
-	ROLE_BOT    = "bot"
-	ROLE_TSD    = "tsd"
+	ROLE_ISSUER  = "issuer"
+	ROLE_TRADER  = "trader"
+	ROLE_BOT     = "bot"
+	ROLE_TSD     = "tsd"
+	ROLE_AUDITOR = "auditor"
+	ROLE_ADMIN   = "admin"
 )
 
 type SETBlockChainChaincode struct {
@@ -58,11 +72,24 @@ func (t *SETBlockChainChaincode) getRole(stub shim.ChaincodeStubInterface) (stri
 	return string(role), nil
 }
 
+// recordTradingRole remembers the role the caller posts or takes its side of
+// a trade under, so its fees can be looked up when the counterparty or the
+// bot settles the trade.
+func (t *SETBlockChainChaincode) recordTradingRole(stub shim.ChaincodeStubInterface, accountid string) error {
+	role, err := t.getRole(stub)
+	if err != nil {
+		return err
+	}
+	return feeHandler.recordRole(stub, accountid, role)
+}
+
+// sell offers shares to the named buyer, or with an empty buyerID to any
+// buyer as an open offer.
 func (t *SETBlockChainChaincode) sell(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ sell +++++++++++++++++++++++++++++++++")
 
-	if len(args) != 4 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+	if len(args) != 4 && len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4 or 5")
 	}
 
 	accountid, err := t.getAccountid(stub)
@@ -71,7 +98,12 @@ func (t *SETBlockChainChaincode) sell(stub shim.ChaincodeStubInterface, args []s
 	}
 	myLogger.Debugf("accountid [%v]", accountid)
 
-	var symbol, buyerID, price string
+	err = t.recordTradingRole(stub, accountid)
+	if err != nil {
+		return nil, err
+	}
+
+	var symbol, buyerID, price, expiryTime string
 
 	symbol = args[0]
 	buyerID = args[1]
@@ -80,16 +112,106 @@ func (t *SETBlockChainChaincode) sell(stub shim.ChaincodeStubInterface, args []s
 	if err != nil {
 		return nil, errors.New("Cannot parse volume")
 	}
+	if volume == 0 {
+		return nil, errors.New("Invalid volume")
+	}
+
+	price, err = secProHandler.checkPrice(stub, symbol, price)
+	if err != nil {
+		return nil, err
+	}
+
+	// an optional RFC3339 expiry time after which the offer can no longer be accepted
+	if len(args) == 5 {
+		expiry, err := time.Parse(time.RFC3339Nano, args[4])
+		if err != nil {
+			return nil, errors.New("Cannot parse expiry time")
+		}
+		now, err := ledgerClock.Now(stub)
+		if err != nil {
+			return nil, err
+		}
+		if !expiry.After(now) {
+			return nil, errors.New("Expiry time must be in the future")
+		}
+		expiryTime = formatTime(expiry)
+	}
+
+	err = actBalHandler.reserve(stub, accountid, symbol, volume)
+	if err != nil {
+		return nil, err
+	}
 
 	// return nil, txHandler.insert(stub, "abc", "0001", "0002", []byte(strconv.Itoa(10)), 100, "WAITING")
-	return nil, txHandler.insert(stub, symbol, buyerID, accountid, price, volume, STATUS_WAITING)
+	txMsg := TransactionMsg{
+		Symbol:     symbol,
+		BuyerID:    buyerID,
+		SellerID:   accountid,
+		Price:      price,
+		Volume:     volume,
+		Status:     STATUS_WAITING,
+		TxType:     TXTYPE_OFFER,
+		ExpiryTime: expiryTime,
+	}
+	_, err = txHandler.insertMsg(stub, &txMsg)
+	return nil, err
+}
+
+func (t *SETBlockChainChaincode) buy(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ buy +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	err = t.recordTradingRole(stub, accountid)
+	if err != nil {
+		return nil, err
+	}
+
+	var symbol, sellerID, price string
+
+	symbol = args[0]
+	sellerID = args[1]
+	price = args[2]
+	volume, err := strconv.ParseUint(args[3], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse volume")
+	}
+	if volume == 0 {
+		return nil, errors.New("Invalid volume")
+	}
+
+	price, err = secProHandler.checkPrice(stub, symbol, price)
+	if err != nil {
+		return nil, err
+	}
+
+	txMsg := TransactionMsg{Symbol: symbol, BuyerID: accountid, SellerID: sellerID, Price: price, Volume: volume}
+	amount, err := settleHandler.notional(&txMsg)
+	if err != nil {
+		return nil, err
+	}
+	err = actMonHandler.hold(stub, accountid, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = txHandler.insert(stub, symbol, accountid, sellerID, price, volume, STATUS_WAITING, TXTYPE_BID)
+	return nil, err
 }
 
 func (t *SETBlockChainChaincode) confirmBuy(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ confirmBuy +++++++++++++++++++++++++++++++++")
 
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	if len(args) != 2 && len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2 or 3")
 	}
 
 	accountid, err := t.getAccountid(stub)
@@ -98,49 +220,99 @@ func (t *SETBlockChainChaincode) confirmBuy(stub shim.ChaincodeStubInterface, ar
 	}
 	myLogger.Debugf("accountid [%v]", accountid)
 
+	err = t.recordTradingRole(stub, accountid)
+	if err != nil {
+		return nil, err
+	}
+
 	txID, err := strconv.ParseUint(args[0], 10, 64)
 	if err != nil {
 		return nil, errors.New("Cannot parse txID")
 	}
 
+	revision, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse revision")
+	}
+
 	txMsg, err := txHandler.getTransaction(stub, txID)
 	if txMsg == nil || err != nil {
 		return nil, errors.New("Cannot find transaction")
 	}
 
+	myLogger.Debugf("Status[%v]", txMsg.Status)
+
+	if STATUS_WAITING != txMsg.Status {
+		return nil, errors.New("Invalid Status")
+	}
+
+	if TXTYPE_OFFER != txMsg.TxType {
+		return nil, errors.New("Invalid transaction type")
+	}
+
+	now, err := ledgerClock.Now(stub)
+	if err != nil {
+		return nil, err
+	}
+	if txHandler.isExpired(txMsg, now) {
+		return nil, errors.New("Offer expired")
+	}
+
 	myLogger.Debugf("BuyerID[%v]", txMsg.BuyerID)
 
-	if accountid != txMsg.BuyerID {
+	// an open offer can be taken by anyone but the seller
+	if txMsg.BuyerID == "" {
+		if accountid == txMsg.SellerID {
+			return nil, errors.New("Invalid buyerID")
+		}
+	} else if accountid != txMsg.BuyerID {
 		return nil, errors.New("Invalid buyerID")
 	}
 
-	price, err := strconv.ParseUint(txMsg.Price, 10, 64)
-	if err != nil {
-		myLogger.Errorf("system error %v", err)
-		return nil, errors.New("Unable to parse Price" + txMsg.Price)
+	myLogger.Debugf("Revision[%v]", txMsg.Revision)
+
+	if revision != txMsg.Revision {
+		return nil, errors.New("Offer has been amended, current revision is " + strconv.FormatUint(txMsg.Revision, 10))
+	}
+
+	// an optional volume accepts only part of the offer
+	if len(args) == 3 {
+		volume, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			return nil, errors.New("Cannot parse volume")
+		}
+		if volume == 0 || volume > txMsg.Volume {
+			return nil, errors.New("Invalid volume")
+		}
+		if volume < txMsg.Volume {
+			txMsg, err = txHandler.split(stub, txMsg, volume)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// the first acceptance that clears wins, a failing one leaves the offer open
+	if txMsg.BuyerID == "" {
+		err = txHandler.assignBuyer(stub, txMsg, accountid)
+		if err != nil {
+			return nil, err
+		}
 	}
-	//var noOfHolderAllowed uint64 = 5;
-	noOfHolderAllowed, err := secProHandler.getMaxNumberHolder(stub, txMsg.Symbol)
+
+	// shares and cash stay reserved until settleTrades runs on the settlement date
+	err = settleHandler.clear(stub, txMsg, true, false)
 	if err != nil {
+		myLogger.Infof("+++++++++++++++++++++++++++++++++++ clearing FAILS +++++++++++++++++++++++++++++++++")
 		return nil, err
 	}
-	myLogger.Infof("+++++++++++++++++++++++++++++++++++ termsheet validation +++++++++++++++++++++++++++++++++")
-	myLogger.Debugf("noOfHolderAllowed [%v]", noOfHolderAllowed)
-	ok, err := actBalHandler.validateOverTermSheetRules(stub, txMsg.SellerID, txMsg.BuyerID, txMsg.Symbol, txMsg.Volume, noOfHolderAllowed)
-	if ok {
-		myLogger.Infof("+++++++++++++++++++++++++++++++++++ validate OK +++++++++++++++++++++++++++++++++")
-		actMonHandler.transfer(stub, txMsg.BuyerID, txMsg.SellerID, price*txMsg.Volume)
-		actBalHandler.transferAccountBalance(stub, txMsg.SellerID, txMsg.BuyerID, txMsg.Symbol, txMsg.Volume)
-		return nil, txHandler.updateStatus(stub, txID, STATUS_CONFIRMED)
-	} else {
-		myLogger.Infof("+++++++++++++++++++++++++++++++++++ validate FAILS +++++++++++++++++++++++++++++++++")
-		return nil, errors.New("Not pass termsheet validation")
-	}
+	myLogger.Infof("+++++++++++++++++++++++++++++++++++ clearing OK +++++++++++++++++++++++++++++++++")
 
+	return nil, nil
 }
 
-func (t *SETBlockChainChaincode) cancel(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ cancel +++++++++++++++++++++++++++++++++")
+func (t *SETBlockChainChaincode) confirmSell(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ confirmSell +++++++++++++++++++++++++++++++++")
 
 	if len(args) != 1 {
 		return nil, errors.New("Incorrect number of arguments. Expecting 1")
@@ -152,6 +324,11 @@ func (t *SETBlockChainChaincode) cancel(stub shim.ChaincodeStubInterface, args [
 	}
 	myLogger.Debugf("accountid [%v]", accountid)
 
+	err = t.recordTradingRole(stub, accountid)
+	if err != nil {
+		return nil, err
+	}
+
 	txID, err := strconv.ParseUint(args[0], 10, 64)
 	if err != nil {
 		return nil, errors.New("Cannot parse txID")
@@ -168,42 +345,34 @@ func (t *SETBlockChainChaincode) cancel(stub shim.ChaincodeStubInterface, args [
 		return nil, errors.New("Invalid Status")
 	}
 
-	myLogger.Debugf("BuyerID[%v]", txMsg.BuyerID)
-	myLogger.Debugf("SellerID[%v]", txMsg.SellerID)
-
-	if accountid == txMsg.BuyerID {
-		return nil, txHandler.updateStatus(stub, txID, STATUS_CANCEL_BUYER)
-	}
-
-	if accountid == txMsg.SellerID {
-		return nil, txHandler.updateStatus(stub, txID, STATUS_CANCEL_SELLER)
+	if TXTYPE_BID != txMsg.TxType {
+		return nil, errors.New("Invalid transaction type")
 	}
 
-	return nil, errors.New("Invalid buyerID or SellerID")
-}
-
-func (t *SETBlockChainChaincode) issueStock(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ issueStock +++++++++++++++++++++++++++++++++")
+	myLogger.Debugf("SellerID[%v]", txMsg.SellerID)
 
-	if len(args) != 3 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	if accountid != txMsg.SellerID {
+		return nil, errors.New("Invalid sellerID")
 	}
 
-	accountid := args[0]
-	symbol := args[1]
-	volume, err := strconv.ParseUint(args[2], 10, 64)
+	// shares and cash stay reserved until settleTrades runs on the settlement date
+	err = settleHandler.clear(stub, txMsg, false, true)
 	if err != nil {
-		return nil, errors.New("Cannot parse volume")
+		myLogger.Infof("+++++++++++++++++++++++++++++++++++ clearing FAILS +++++++++++++++++++++++++++++++++")
+		return nil, err
 	}
+	myLogger.Infof("+++++++++++++++++++++++++++++++++++ clearing OK +++++++++++++++++++++++++++++++++")
 
-	return nil, actBalHandler.issueStock(stub, accountid, symbol, volume)
+	return nil, nil
 }
 
-func (t *SETBlockChainChaincode) findUnconfirmedTransaction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ findUnconfirmedTransaction +++++++++++++++++++++++++++++++++")
+// sellBasket offers several symbols to one buyer as a single deal. The
+// arguments after buyerID are symbol, price and volume triples, one per leg.
+func (t *SETBlockChainChaincode) sellBasket(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ sellBasket +++++++++++++++++++++++++++++++++")
 
-	if len(args) != 0 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	if len(args) < 4 || (len(args)-1)%3 != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting buyerID followed by symbol, price, volume for each leg")
 	}
 
 	accountid, err := t.getAccountid(stub)
@@ -212,30 +381,83 @@ func (t *SETBlockChainChaincode) findUnconfirmedTransaction(stub shim.ChaincodeS
 	}
 	myLogger.Debugf("accountid [%v]", accountid)
 
-	txMsgs, err := txHandler.findTransactionByAccountID(stub, accountid)
+	err = t.recordTradingRole(stub, accountid)
 	if err != nil {
 		return nil, err
 	}
 
-	var txMsgsUnconfirmed []TransactionMsg
+	buyerID := args[0]
+	if buyerID == "" {
+		return nil, errors.New("Basket needs a buyerID")
+	}
 
-	for _, txMsg := range txMsgs {
-		if txMsg.Status == STATUS_WAITING {
-			txMsgsUnconfirmed = append(txMsgsUnconfirmed, txMsg)
+	var legs []BasketLegMsg
+	var total, totalVolume uint64
+	for i := 1; i < len(args); i += 3 {
+		symbol := args[i]
+		for _, leg := range legs {
+			if leg.Symbol == symbol {
+				return nil, errors.New("Duplicate symbol " + symbol + " in basket")
+			}
+		}
+
+		price, err := secProHandler.checkPrice(stub, symbol, args[i+1])
+		if err != nil {
+			return nil, err
+		}
+
+		volume, err := strconv.ParseUint(args[i+2], 10, 64)
+		if err != nil {
+			return nil, errors.New("Cannot parse volume")
+		}
+		if volume == 0 {
+			return nil, errors.New("Invalid volume")
+		}
+
+		leg := BasketLegMsg{Symbol: symbol, Price: price, Volume: volume}
+		amount, err := settleHandler.notional(txHandler.legMsg(&TransactionMsg{}, leg))
+		if err != nil {
+			return nil, err
+		}
+		total, err = addAmount(total, amount)
+		if err != nil {
+			return nil, err
+		}
+		totalVolume, err = addAmount(totalVolume, volume)
+		if err != nil {
+			return nil, err
+		}
+
+		err = actBalHandler.reserve(stub, accountid, symbol, volume)
+		if err != nil {
+			return nil, err
 		}
+		legs = append(legs, leg)
 	}
 
-	txMsgsJson, err := json.Marshal(txMsgsUnconfirmed)
-	myLogger.Debugf("Response : %s", txMsgsJson)
+	txMsg := TransactionMsg{
+		BuyerID:  buyerID,
+		SellerID: accountid,
+		Price:    formatAmount(total),
+		Volume:   totalVolume,
+		Status:   STATUS_WAITING,
+		TxType:   TXTYPE_BASKET,
+	}
+	txID, err := txHandler.insertMsg(stub, &txMsg)
+	if err != nil {
+		return nil, err
+	}
 
-	return txMsgsJson, nil
+	return nil, txHandler.insertLegs(stub, txID, legs)
 }
 
-func (t *SETBlockChainChaincode) findCompletedTransaction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ findCompletedTransaction +++++++++++++++++++++++++++++++++")
+// confirmBasket is the buyer's acceptance of a basket. Every leg clears and
+// later settles together, or none does.
+func (t *SETBlockChainChaincode) confirmBasket(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ confirmBasket +++++++++++++++++++++++++++++++++")
 
-	if len(args) != 0 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
 	}
 
 	accountid, err := t.getAccountid(stub)
@@ -244,30 +466,53 @@ func (t *SETBlockChainChaincode) findCompletedTransaction(stub shim.ChaincodeStu
 	}
 	myLogger.Debugf("accountid [%v]", accountid)
 
-	txMsgs, err := txHandler.findTransactionByAccountID(stub, accountid)
+	err = t.recordTradingRole(stub, accountid)
 	if err != nil {
 		return nil, err
 	}
 
-	var txMsgsCompleted []TransactionMsg
+	txID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse txID")
+	}
 
-	for _, txMsg := range txMsgs {
-		if txMsg.Status == STATUS_CONFIRMED || txMsg.Status == STATUS_CANCEL_BUYER || txMsg.Status == STATUS_CANCEL_SELLER {
-			txMsgsCompleted = append(txMsgsCompleted, txMsg)
-		}
+	txMsg, err := txHandler.getTransaction(stub, txID)
+	if txMsg == nil || err != nil {
+		return nil, errors.New("Cannot find transaction")
 	}
 
-	txMsgsJson, err := json.Marshal(txMsgsCompleted)
-	myLogger.Debugf("Response : %s", txMsgsJson)
+	myLogger.Debugf("Status[%v]", txMsg.Status)
 
-	return txMsgsJson, nil
+	if STATUS_WAITING != txMsg.Status {
+		return nil, errors.New("Invalid Status")
+	}
+
+	if TXTYPE_BASKET != txMsg.TxType {
+		return nil, errors.New("Invalid transaction type")
+	}
+
+	myLogger.Debugf("BuyerID[%v]", txMsg.BuyerID)
+
+	if accountid != txMsg.BuyerID {
+		return nil, errors.New("Invalid buyerID")
+	}
+
+	// shares and cash stay reserved until settleTrades runs on the settlement date
+	err = settleHandler.clear(stub, txMsg, true, false)
+	if err != nil {
+		myLogger.Infof("+++++++++++++++++++++++++++++++++++ clearing FAILS +++++++++++++++++++++++++++++++++")
+		return nil, err
+	}
+	myLogger.Infof("+++++++++++++++++++++++++++++++++++ clearing OK +++++++++++++++++++++++++++++++++")
+
+	return nil, nil
 }
 
-func (t *SETBlockChainChaincode) findConfirmedTransactionBySymbol(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ findConfirmedTransactionBySymbol +++++++++++++++++++++++++++++++++")
+func (t *SETBlockChainChaincode) amendOffer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ amendOffer +++++++++++++++++++++++++++++++++")
 
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
 	}
 
 	accountid, err := t.getAccountid(stub)
@@ -276,30 +521,2034 @@ func (t *SETBlockChainChaincode) findConfirmedTransactionBySymbol(stub shim.Chai
 	}
 	myLogger.Debugf("accountid [%v]", accountid)
 
-	var symbol string
-	symbol = args[0]
+	txID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse txID")
+	}
 
-	txMsgs, err := txHandler.findTransactionByAccountIDSymbol(stub, accountid, symbol)
+	volume, err := strconv.ParseUint(args[2], 10, 64)
 	if err != nil {
-		return nil, err
+		return nil, errors.New("Cannot parse volume")
 	}
 
-	var txMsgsConfirmed []TransactionMsg
+	txMsg, err := txHandler.getTransaction(stub, txID)
+	if txMsg == nil || err != nil {
+		return nil, errors.New("Cannot find transaction")
+	}
 
-	for _, txMsg := range txMsgs {
-		if txMsg.Status == STATUS_CONFIRMED {
-			txMsgsConfirmed = append(txMsgsConfirmed, txMsg)
-		}
+	myLogger.Debugf("Status[%v]", txMsg.Status)
+
+	if STATUS_WAITING != txMsg.Status {
+		return nil, errors.New("Invalid Status")
+	}
+
+	if TXTYPE_OFFER != txMsg.TxType {
+		return nil, errors.New("Invalid transaction type")
+	}
+
+	myLogger.Debugf("SellerID[%v]", txMsg.SellerID)
+
+	if accountid != txMsg.SellerID {
+		return nil, errors.New("Invalid sellerID")
+	}
+
+	return nil, t.reviseOffer(stub, txMsg, args[1], volume)
+}
+
+// reviseOffer changes the price and volume of a waiting offer, moving the
+// seller's reservation to the new volume and bumping the revision.
+func (t *SETBlockChainChaincode) reviseOffer(stub shim.ChaincodeStubInterface, txMsg *TransactionMsg, price string, volume uint64) error {
+
+	price, err := secProHandler.checkPrice(stub, txMsg.Symbol, price)
+	if err != nil {
+		return err
+	}
+
+	if volume == 0 {
+		return errors.New("Invalid volume")
+	}
+
+	// move the reservation from the old volume to the new one
+	err = actBalHandler.release(stub, txMsg.SellerID, txMsg.Symbol, txMsg.Volume)
+	if err != nil {
+		return err
+	}
+	err = actBalHandler.reserve(stub, txMsg.SellerID, txMsg.Symbol, volume)
+	if err != nil {
+		return err
+	}
+
+	return txHandler.amend(stub, txMsg, price, volume)
+}
+
+// getOpenOffer returns a waiting, unexpired offer that can still be
+// negotiated.
+func (t *SETBlockChainChaincode) getOpenOffer(stub shim.ChaincodeStubInterface, txID uint64) (*TransactionMsg, error) {
+
+	txMsg, err := txHandler.getTransaction(stub, txID)
+	if txMsg == nil || err != nil {
+		return nil, errors.New("Cannot find transaction")
+	}
+
+	myLogger.Debugf("Status[%v]", txMsg.Status)
+
+	if STATUS_WAITING != txMsg.Status {
+		return nil, errors.New("Invalid Status")
+	}
+
+	if TXTYPE_OFFER != txMsg.TxType {
+		return nil, errors.New("Invalid transaction type")
+	}
+
+	now, err := ledgerClock.Now(stub)
+	if err != nil {
+		return nil, err
+	}
+	if txHandler.isExpired(txMsg, now) {
+		return nil, errors.New("Offer expired")
+	}
+
+	return txMsg, nil
+}
+
+// counterOffer lets the named buyer propose other terms for the revision of
+// an offer it has seen. The seller may counter again, which revises the
+// offer itself so the buyer can take it with confirmBuy.
+func (t *SETBlockChainChaincode) counterOffer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ counterOffer +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	err = t.recordTradingRole(stub, accountid)
+	if err != nil {
+		return nil, err
+	}
+
+	txID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse txID")
+	}
+
+	revision, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse revision")
+	}
+
+	volume, err := strconv.ParseUint(args[3], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse volume")
+	}
+
+	txMsg, err := t.getOpenOffer(stub, txID)
+	if err != nil {
+		return nil, err
+	}
+
+	if accountid != txMsg.BuyerID && accountid != txMsg.SellerID {
+		return nil, errors.New("Invalid buyerID or SellerID")
+	}
+
+	if revision != txMsg.Revision {
+		return nil, errors.New("Offer has been amended, current revision is " + strconv.FormatUint(txMsg.Revision, 10))
+	}
+
+	if accountid == txMsg.SellerID {
+		err = t.reviseOffer(stub, txMsg, args[2], volume)
+		if err != nil {
+			return nil, err
+		}
+		return nil, negHandler.record(stub, txMsg, accountid, NEGOTIATION_COUNTER, txMsg.Price, txMsg.Volume)
+	}
+
+	price, err := secProHandler.checkPrice(stub, txMsg.Symbol, args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	if volume == 0 {
+		return nil, errors.New("Invalid volume")
+	}
+
+	return nil, negHandler.record(stub, txMsg, accountid, NEGOTIATION_COUNTER, price, volume)
+}
+
+// answerCounter is the seller's accept or reject of the buyer's pending
+// counter. Accepting revises the offer to the countered terms.
+func (t *SETBlockChainChaincode) answerCounter(stub shim.ChaincodeStubInterface, args []string, action string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ answerCounter [%v] +++++++++++++++++++++++++++++++++", action)
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	err = t.recordTradingRole(stub, accountid)
+	if err != nil {
+		return nil, err
+	}
+
+	txID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse txID")
+	}
+
+	txMsg, err := t.getOpenOffer(stub, txID)
+	if err != nil {
+		return nil, err
+	}
+
+	myLogger.Debugf("SellerID[%v]", txMsg.SellerID)
+
+	if accountid != txMsg.SellerID {
+		return nil, errors.New("Invalid sellerID")
+	}
+
+	counter, err := negHandler.pendingCounter(stub, txMsg)
+	if err != nil {
+		return nil, err
+	}
+	if counter == nil {
+		return nil, errors.New("No pending counter offer")
+	}
+
+	if NEGOTIATION_ACCEPT == action {
+		err = t.reviseOffer(stub, txMsg, counter.Price, counter.Volume)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, negHandler.record(stub, txMsg, accountid, action, counter.Price, counter.Volume)
+}
+
+func (t *SETBlockChainChaincode) cancel(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ cancel +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	txID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse txID")
+	}
+
+	txMsg, err := txHandler.getTransaction(stub, txID)
+	if txMsg == nil || err != nil {
+		return nil, errors.New("Cannot find transaction")
+	}
+
+	myLogger.Debugf("Status[%v]", txMsg.Status)
+
+	if STATUS_WAITING != txMsg.Status {
+		return nil, errors.New("Invalid Status")
+	}
+
+	myLogger.Debugf("BuyerID[%v]", txMsg.BuyerID)
+	myLogger.Debugf("SellerID[%v]", txMsg.SellerID)
+
+	if accountid != txMsg.BuyerID && accountid != txMsg.SellerID {
+		return nil, errors.New("Invalid buyerID or SellerID")
+	}
+
+	if TXTYPE_OFFER == txMsg.TxType {
+		err = actBalHandler.release(stub, txMsg.SellerID, txMsg.Symbol, txMsg.Volume)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if TXTYPE_BASKET == txMsg.TxType {
+		legs, err := txHandler.findLegs(stub, txID)
+		if err != nil {
+			return nil, err
+		}
+		for _, leg := range legs {
+			err = actBalHandler.release(stub, txMsg.SellerID, leg.Symbol, leg.Volume)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if TXTYPE_BID == txMsg.TxType {
+		amount, err := settleHandler.notional(txMsg)
+		if err != nil {
+			return nil, err
+		}
+		err = actMonHandler.releaseHold(stub, txMsg.BuyerID, amount)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if accountid == txMsg.BuyerID {
+		return nil, txHandler.updateStatus(stub, txID, STATUS_CANCEL_BUYER)
+	}
+
+	if accountid == txMsg.SellerID {
+		return nil, txHandler.updateStatus(stub, txID, STATUS_CANCEL_SELLER)
+	}
+
+	return nil, errors.New("Invalid buyerID or SellerID")
+}
+
+// requestQuote asks the listed holders for a price on volume shares of a
+// symbol: symbol, volume, holderID...
+func (t *SETBlockChainChaincode) requestQuote(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ requestQuote +++++++++++++++++++++++++++++++++")
+
+	if len(args) < 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting at least 3")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	err = t.recordTradingRole(stub, accountid)
+	if err != nil {
+		return nil, err
+	}
+
+	symbol := args[0]
+	if _, err := secProHandler.getSecurityProfile(stub, symbol); err != nil {
+		return nil, errors.New("No security profile for " + symbol)
+	}
+
+	volume, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse volume")
+	}
+	if volume == 0 {
+		return nil, errors.New("Invalid volume")
+	}
+
+	holders := args[2:]
+	for i, holder := range holders {
+		if holder == "" || holder == accountid || t.stringInSlice(holder, holders[:i]) {
+			return nil, errors.New("Invalid holderID " + holder)
+		}
+	}
+
+	// holders' shares are not held for longer than the RFQ's lifetime
+	now, err := ledgerClock.Now(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	rfq := RFQMsg{Symbol: symbol, RequesterID: accountid, Volume: volume, ExpiryTime: formatTime(now.Add(RFQ_LIFETIME))}
+	_, err = rfqHandler.insert(stub, &rfq, holders)
+	return nil, err
+}
+
+// submitQuote is a holder's price on an RFQ. The holder's shares are
+// reserved until the RFQ is closed; quoting again replaces the price.
+func (t *SETBlockChainChaincode) submitQuote(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ submitQuote +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	err = t.recordTradingRole(stub, accountid)
+	if err != nil {
+		return nil, err
+	}
+
+	rfqID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse rfqID")
+	}
+
+	rfq, err := rfqHandler.getRFQ(stub, rfqID)
+	if rfq == nil || err != nil {
+		return nil, errors.New("Cannot find rfq")
+	}
+
+	if RFQ_OPEN != rfq.Status {
+		return nil, errors.New("Invalid Status")
+	}
+	err = t.checkRFQExpiry(stub, rfq)
+	if err != nil {
+		return nil, err
+	}
+
+	quote := rfqHandler.quoteOf(rfq, accountid)
+	if quote == nil || (QUOTE_REQUESTED != quote.Status && QUOTE_QUOTED != quote.Status) {
+		return nil, errors.New("Invalid holderID")
+	}
+
+	price, err := secProHandler.checkPrice(stub, rfq.Symbol, args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if QUOTE_REQUESTED == quote.Status {
+		err = actBalHandler.reserve(stub, accountid, rfq.Symbol, rfq.Volume)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	quote.Price = price
+	quote.Status = QUOTE_QUOTED
+	return nil, rfqHandler.putQuote(stub, quote, false)
+}
+
+// acceptQuote turns the chosen quote into a trade between the holder and
+// the requester, confirms it with confirmBuy and expires the other quotes.
+func (t *SETBlockChainChaincode) acceptQuote(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ acceptQuote +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	err = t.recordTradingRole(stub, accountid)
+	if err != nil {
+		return nil, err
+	}
+
+	rfqID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse rfqID")
+	}
+
+	rfq, err := rfqHandler.getRFQ(stub, rfqID)
+	if rfq == nil || err != nil {
+		return nil, errors.New("Cannot find rfq")
+	}
+
+	if RFQ_OPEN != rfq.Status {
+		return nil, errors.New("Invalid Status")
+	}
+
+	if accountid != rfq.RequesterID {
+		return nil, errors.New("Invalid requesterID")
+	}
+	err = t.checkRFQExpiry(stub, rfq)
+	if err != nil {
+		return nil, err
+	}
+
+	quote := rfqHandler.quoteOf(rfq, args[1])
+	if quote == nil || QUOTE_QUOTED != quote.Status {
+		return nil, errors.New("No quote from " + args[1])
+	}
+
+	// the quote's reservation carries over to the offer
+	txMsg := TransactionMsg{
+		Symbol:   rfq.Symbol,
+		BuyerID:  rfq.RequesterID,
+		SellerID: quote.HolderID,
+		Price:    quote.Price,
+		Volume:   rfq.Volume,
+		Status:   STATUS_WAITING,
+		TxType:   TXTYPE_OFFER,
+	}
+	txID, err := txHandler.insertMsg(stub, &txMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	quote.Status = QUOTE_ACCEPTED
+	quote.TransactionID = txID
+	err = rfqHandler.putQuote(stub, quote, false)
+	if err != nil {
+		return nil, err
+	}
+
+	err = rfqHandler.close(stub, rfq, RFQ_ACCEPTED)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.confirmBuy(stub, []string{strconv.FormatUint(txID, 10), strconv.FormatUint(txMsg.Revision, 10)})
+}
+
+func (t *SETBlockChainChaincode) cancelRFQ(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ cancelRFQ +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	rfqID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse rfqID")
+	}
+
+	rfq, err := rfqHandler.getRFQ(stub, rfqID)
+	if rfq == nil || err != nil {
+		return nil, errors.New("Cannot find rfq")
+	}
+
+	if RFQ_OPEN != rfq.Status {
+		return nil, errors.New("Invalid Status")
+	}
+
+	if accountid != rfq.RequesterID {
+		return nil, errors.New("Invalid requesterID")
+	}
+
+	return nil, rfqHandler.close(stub, rfq, RFQ_CANCELLED)
+}
+
+// withdrawQuote takes the caller's quote off an open RFQ and releases the
+// shares reserved for it.
+func (t *SETBlockChainChaincode) withdrawQuote(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ withdrawQuote +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	rfqID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse rfqID")
+	}
+
+	rfq, err := rfqHandler.getRFQ(stub, rfqID)
+	if rfq == nil || err != nil {
+		return nil, errors.New("Cannot find rfq")
+	}
+
+	if RFQ_OPEN != rfq.Status {
+		return nil, errors.New("Invalid Status")
+	}
+
+	quote := rfqHandler.quoteOf(rfq, accountid)
+	if quote == nil || (QUOTE_REQUESTED != quote.Status && QUOTE_QUOTED != quote.Status) {
+		return nil, errors.New("Invalid holderID")
+	}
+
+	return nil, rfqHandler.withdraw(stub, rfq, quote)
+}
+
+// checkRFQExpiry refuses to act on an RFQ that has expired but has not been
+// closed by expireOffers yet.
+func (t *SETBlockChainChaincode) checkRFQExpiry(stub shim.ChaincodeStubInterface, rfq *RFQMsg) error {
+	now, err := ledgerClock.Now(stub)
+	if err != nil {
+		return err
+	}
+	if rfqHandler.isExpired(rfq, now) {
+		return errors.New("RFQ has expired")
+	}
+	return nil
+}
+
+// openAuction lets an issuer sell a new tranche of a symbol by Dutch
+// auction: symbol, volume, minPrice, closeTime (RFC3339).
+func (t *SETBlockChainChaincode) openAuction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ openAuction +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	symbol := args[0]
+	issuerID, err := secProHandler.getIssuer(stub, symbol)
+	if err != nil {
+		return nil, err
+	}
+	if accountid != issuerID {
+		return nil, errors.New("Only the issuer of " + symbol + " can auction its shares")
+	}
+
+	volume, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse volume")
+	}
+	if volume == 0 {
+		return nil, errors.New("Invalid volume")
+	}
+
+	minPrice, err := secProHandler.checkPrice(stub, symbol, args[2])
+	if err != nil {
+		return nil, err
+	}
+	err = secProHandler.checkIssuance(stub, symbol, volume)
+	if err != nil {
+		return nil, err
+	}
+
+	closeTime, err := time.Parse(time.RFC3339Nano, args[3])
+	if err != nil {
+		return nil, errors.New("Cannot parse close time")
+	}
+	now, err := ledgerClock.Now(stub)
+	if err != nil {
+		return nil, err
+	}
+	if !closeTime.After(now) {
+		return nil, errors.New("Close time must be in the future")
+	}
+
+	// the proceeds are paid into the issuer's money account
+	if _, err := actMonHandler.queryBalance(stub, accountid); err != nil {
+		return nil, errors.New("No money account for " + accountid)
+	}
+
+	auction := AuctionMsg{
+		Symbol:    symbol,
+		IssuerID:  accountid,
+		Volume:    volume,
+		MinPrice:  minPrice,
+		CloseTime: formatTime(closeTime),
+	}
+	_, err = auctHandler.insert(stub, &auction)
+	return nil, err
+}
+
+// placeAuctionBid is an investor's sealed bid on an open auction: auctionID,
+// price, volume. Bidding again replaces the earlier bid.
+func (t *SETBlockChainChaincode) placeAuctionBid(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ placeAuctionBid +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	auctionID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse auctionID")
+	}
+
+	auction, err := auctHandler.getAuction(stub, auctionID)
+	if auction == nil || err != nil {
+		return nil, errors.New("Cannot find auction")
+	}
+
+	if AUCTION_OPEN != auction.Status {
+		return nil, errors.New("Invalid Status")
+	}
+
+	closeTime, err := time.Parse(time.RFC3339Nano, auction.CloseTime)
+	if err != nil {
+		return nil, errors.New("Cannot parse close time")
+	}
+	now, err := ledgerClock.Now(stub)
+	if err != nil {
+		return nil, err
+	}
+	if !now.Before(closeTime) {
+		return nil, errors.New("Auction is closed for bidding")
+	}
+
+	if accountid == auction.IssuerID {
+		return nil, errors.New("Invalid bidderID")
+	}
+
+	price, err := secProHandler.checkPrice(stub, auction.Symbol, args[1])
+	if err != nil {
+		return nil, err
+	}
+	amount, _, _ := parsePrice(price)
+	minPrice, _, _ := parsePrice(auction.MinPrice)
+	if amount < minPrice {
+		return nil, errors.New("Price must be at least " + auction.MinPrice)
+	}
+
+	volume, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse volume")
+	}
+	if volume == 0 || volume > auction.Volume {
+		return nil, errors.New("Invalid volume")
+	}
+
+	return nil, auctHandler.placeBid(stub, auction, accountid, price, volume)
+}
+
+// closeAuction allocates an auction once its bidding window has ended.
+func (t *SETBlockChainChaincode) closeAuction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ closeAuction +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	auctionID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse auctionID")
+	}
+
+	auction, err := auctHandler.getAuction(stub, auctionID)
+	if auction == nil || err != nil {
+		return nil, errors.New("Cannot find auction")
+	}
+
+	if AUCTION_OPEN != auction.Status {
+		return nil, errors.New("Invalid Status")
+	}
+
+	role, err := t.getRole(stub)
+	if err != nil {
+		return nil, err
+	}
+	if ROLE_ISSUER == role && accountid != auction.IssuerID {
+		return nil, errors.New("Invalid issuerID")
+	}
+
+	closeTime, err := time.Parse(time.RFC3339Nano, auction.CloseTime)
+	if err != nil {
+		return nil, errors.New("Cannot parse close time")
+	}
+	now, err := ledgerClock.Now(stub)
+	if err != nil {
+		return nil, err
+	}
+	if now.Before(closeTime) {
+		return nil, errors.New("Auction is still open for bidding")
+	}
+
+	return nil, auctHandler.close(stub, auction)
+}
+
+func (t *SETBlockChainChaincode) cancelAuction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ cancelAuction +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	auctionID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse auctionID")
+	}
+
+	auction, err := auctHandler.getAuction(stub, auctionID)
+	if auction == nil || err != nil {
+		return nil, errors.New("Cannot find auction")
+	}
+
+	if AUCTION_OPEN != auction.Status {
+		return nil, errors.New("Invalid Status")
+	}
+
+	if accountid != auction.IssuerID {
+		return nil, errors.New("Invalid issuerID")
+	}
+
+	return nil, auctHandler.cancel(stub, auction)
+}
+
+// declareDividend declares a cash dividend on a symbol paid to whoever holds
+// it on the record date: symbol, amount per share, recordDate (RFC3339).
+func (t *SETBlockChainChaincode) declareDividend(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ declareDividend +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	symbol := args[0]
+	issuerID, err := secProHandler.getIssuer(stub, symbol)
+	if err != nil {
+		return nil, err
+	}
+	if accountid != issuerID {
+		return nil, errors.New("Only the issuer of " + symbol + " can declare a dividend on it")
+	}
+
+	rate, err := parseDecimal(args[1], DIVIDEND_PRECISION)
+	if err != nil {
+		return nil, errors.New("Cannot parse dividend per share")
+	}
+	if rate == 0 {
+		return nil, errors.New("Dividend per share must be greater than zero")
+	}
+
+	recordDate, err := time.Parse(time.RFC3339Nano, args[2])
+	if err != nil {
+		return nil, errors.New("Cannot parse record date")
+	}
+	now, err := ledgerClock.Now(stub)
+	if err != nil {
+		return nil, err
+	}
+	if !recordDate.After(now) {
+		return nil, errors.New("Record date must be in the future")
+	}
+
+	// the dividend is paid out of the issuer's money account
+	if _, err := actMonHandler.queryBalance(stub, accountid); err != nil {
+		return nil, errors.New("No money account for " + accountid)
+	}
+
+	dividend := DividendMsg{
+		Symbol:     symbol,
+		IssuerID:   accountid,
+		Rate:       formatDecimal(rate, DIVIDEND_PRECISION),
+		RecordDate: formatTime(recordDate),
+	}
+	_, err = divHandler.insert(stub, &dividend)
+	return nil, err
+}
+
+func (t *SETBlockChainChaincode) cancelDividend(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ cancelDividend +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	dividendID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse dividendID")
+	}
+
+	dividend, err := divHandler.getDividend(stub, dividendID)
+	if dividend == nil || err != nil {
+		return nil, errors.New("Cannot find dividend")
+	}
+
+	if DIVIDEND_DECLARED != dividend.Status {
+		return nil, errors.New("Invalid Status")
+	}
+
+	if accountid != dividend.IssuerID {
+		return nil, errors.New("Invalid issuerID")
+	}
+
+	dividend.Status = DIVIDEND_CANCELLED
+	return nil, divHandler.putDividend(stub, dividend, false)
+}
+
+// payDividends pays every declared dividend whose record date has come to
+// the holders of record at that point.
+func (t *SETBlockChainChaincode) payDividends(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ payDividends +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+
+	return nil, divHandler.payDue(stub)
+}
+
+// splitStock applies a split or reverse split to every holder of a symbol:
+// symbol, newShares, oldShares, policy for fractions of a share and, for
+// cash in lieu, the price per new share and the account paying it.
+func (t *SETBlockChainChaincode) splitStock(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ splitStock +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 4 && len(args) != 6 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4 or 6")
+	}
+
+	symbol := args[0]
+	if _, err := secProHandler.getSecurityProfile(stub, symbol); err != nil {
+		return nil, errors.New("No security profile for " + symbol)
+	}
+
+	newShares, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse newShares")
+	}
+	oldShares, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse oldShares")
+	}
+	if newShares == 0 || oldShares == 0 || newShares == oldShares {
+		return nil, errors.New("Invalid split ratio")
+	}
+
+	action := CorporateActionMsg{
+		Symbol:     symbol,
+		ActionType: CORP_ACTION_SPLIT,
+		Ratio:      args[1] + ":" + args[2],
+		Policy:     args[3],
+	}
+	if newShares < oldShares {
+		action.ActionType = CORP_ACTION_REVERSE_SPLIT
+	}
+
+	if FRACTION_CASH_IN_LIEU == action.Policy {
+		if len(args) != 6 {
+			return nil, errors.New("Cash in lieu needs a price and a payer")
+		}
+		action.Price, err = secProHandler.checkPrice(stub, symbol, args[4])
+		if err != nil {
+			return nil, err
+		}
+		action.AccountID = args[5]
+		issuerID, err := secProHandler.getIssuer(stub, symbol)
+		if err != nil {
+			return nil, err
+		}
+		if action.AccountID != issuerID {
+			return nil, errors.New("Cash in lieu must be paid by the issuer of " + symbol)
+		}
+		if _, err := actMonHandler.queryBalance(stub, action.AccountID); err != nil {
+			return nil, errors.New("No money account for " + action.AccountID)
+		}
+	} else if FRACTION_ROUND == action.Policy {
+		if len(args) != 4 {
+			return nil, errors.New("Incorrect number of arguments. Expecting 4")
+		}
+	} else {
+		return nil, errors.New("Invalid fraction policy")
+	}
+
+	return nil, corpHandler.split(stub, &action, newShares, oldShares)
+}
+
+// declareRightsOffering offers new shares of a symbol to its holders in
+// proportion to what they hold now: symbol, newShares, heldShares, price,
+// closeTime (RFC3339) and what happens to rights not taken up, Lapse or
+// Transferable.
+func (t *SETBlockChainChaincode) declareRightsOffering(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ declareRightsOffering +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 6 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 6")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	symbol := args[0]
+	issuerID, err := secProHandler.getIssuer(stub, symbol)
+	if err != nil {
+		return nil, err
+	}
+	if accountid != issuerID {
+		return nil, errors.New("Only the issuer of " + symbol + " can offer rights to its holders")
+	}
+
+	newShares, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse newShares")
+	}
+	heldShares, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse heldShares")
+	}
+	if newShares == 0 || heldShares == 0 {
+		return nil, errors.New("Invalid rights ratio")
+	}
+
+	price, err := secProHandler.checkPrice(stub, symbol, args[3])
+	if err != nil {
+		return nil, err
+	}
+
+	closeTime, err := time.Parse(time.RFC3339Nano, args[4])
+	if err != nil {
+		return nil, errors.New("Cannot parse close time")
+	}
+	now, err := ledgerClock.Now(stub)
+	if err != nil {
+		return nil, err
+	}
+	if !closeTime.After(now) {
+		return nil, errors.New("Close time must be in the future")
+	}
+
+	policy := args[5]
+	if !t.stringInSlice(policy, []string{RIGHTS_LAPSE, RIGHTS_TRANSFERABLE}) {
+		return nil, errors.New("Invalid rights policy")
+	}
+
+	// the subscriptions are paid into the issuer's money account
+	if _, err := actMonHandler.queryBalance(stub, accountid); err != nil {
+		return nil, errors.New("No money account for " + accountid)
+	}
+
+	offering := RightsOfferingMsg{
+		Symbol:     symbol,
+		IssuerID:   accountid,
+		NewShares:  newShares,
+		HeldShares: heldShares,
+		Price:      price,
+		CloseTime:  formatTime(closeTime),
+		Policy:     policy,
+	}
+	_, err = rightsHandler.insert(stub, &offering)
+	return nil, err
+}
+
+// getOpenRightsOffering returns an offering that is still taking
+// subscriptions.
+func (t *SETBlockChainChaincode) getOpenRightsOffering(stub shim.ChaincodeStubInterface, offeringID uint64) (*RightsOfferingMsg, error) {
+
+	offering, err := rightsHandler.getOffering(stub, offeringID)
+	if offering == nil || err != nil {
+		return nil, errors.New("Cannot find rights offering")
+	}
+
+	if RIGHTS_OPEN != offering.Status {
+		return nil, errors.New("Invalid Status")
+	}
+
+	closeTime, err := time.Parse(time.RFC3339Nano, offering.CloseTime)
+	if err != nil {
+		return nil, errors.New("Cannot parse close time")
+	}
+	now, err := ledgerClock.Now(stub)
+	if err != nil {
+		return nil, err
+	}
+	if !now.Before(closeTime) {
+		return nil, errors.New("Rights offering is closed")
+	}
+
+	return offering, nil
+}
+
+// subscribeRights takes up some of the caller's rights: offeringID, volume.
+func (t *SETBlockChainChaincode) subscribeRights(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ subscribeRights +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	offeringID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse offeringID")
+	}
+
+	volume, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse volume")
+	}
+
+	offering, err := t.getOpenRightsOffering(stub, offeringID)
+	if err != nil {
+		return nil, err
+	}
+
+	entitlement := rightsHandler.entitlementOf(offering, accountid)
+	if entitlement == nil {
+		return nil, errors.New("No rights for " + accountid)
+	}
+
+	return nil, rightsHandler.subscribe(stub, offering, entitlement, volume)
+}
+
+// transferRights passes some of the caller's unexercised rights to another
+// account when the offering allows it: offeringID, toAccountID, volume.
+func (t *SETBlockChainChaincode) transferRights(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ transferRights +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	offeringID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse offeringID")
+	}
+
+	toAccount := args[1]
+
+	volume, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse volume")
+	}
+
+	offering, err := t.getOpenRightsOffering(stub, offeringID)
+	if err != nil {
+		return nil, err
+	}
+
+	if RIGHTS_TRANSFERABLE != offering.Policy {
+		return nil, errors.New("Rights are not transferable")
+	}
+
+	entitlement := rightsHandler.entitlementOf(offering, accountid)
+	if entitlement == nil {
+		return nil, errors.New("No rights for " + accountid)
+	}
+
+	if toAccount == "" || toAccount == accountid || toAccount == offering.IssuerID {
+		return nil, errors.New("Invalid toAccountID")
+	}
+
+	// a new holder must still fit under the holder limit once the rights
+	// given to other non-holders are counted
+	if rightsHandler.entitlementOf(offering, toAccount) == nil {
+		noOfHolderAllowed, err := secProHandler.getMaxNumberHolder(stub, offering.Symbol)
+		if err != nil {
+			return nil, err
+		}
+		holders, err := actBalHandler.findHolderBySymbol(stub, offering.Symbol)
+		if err != nil {
+			return nil, err
+		}
+		isHolder := make(map[string]bool)
+		for _, holder := range holders {
+			isHolder[holder.AccountID] = true
+		}
+		noOfHolders := uint64(len(holders))
+		for _, other := range offering.Entitlements {
+			if !isHolder[other.AccountID] {
+				noOfHolders++
+			}
+		}
+		if !isHolder[toAccount] && noOfHolders >= noOfHolderAllowed {
+			return nil, errors.New("Too many holders of " + offering.Symbol)
+		}
+	}
+
+	return nil, rightsHandler.transfer(stub, offering, entitlement, toAccount, volume)
+}
+
+// closeRightsOffering issues the subscribed shares once the offering's close
+// time has passed.
+func (t *SETBlockChainChaincode) closeRightsOffering(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ closeRightsOffering +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	offeringID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse offeringID")
+	}
+
+	offering, err := rightsHandler.getOffering(stub, offeringID)
+	if offering == nil || err != nil {
+		return nil, errors.New("Cannot find rights offering")
+	}
+
+	if RIGHTS_OPEN != offering.Status {
+		return nil, errors.New("Invalid Status")
+	}
+
+	role, err := t.getRole(stub)
+	if err != nil {
+		return nil, err
+	}
+	if ROLE_ISSUER == role && accountid != offering.IssuerID {
+		return nil, errors.New("Invalid issuerID")
+	}
+
+	closeTime, err := time.Parse(time.RFC3339Nano, offering.CloseTime)
+	if err != nil {
+		return nil, errors.New("Cannot parse close time")
+	}
+	now, err := ledgerClock.Now(stub)
+	if err != nil {
+		return nil, err
+	}
+	if now.Before(closeTime) {
+		return nil, errors.New("Rights offering is still open")
+	}
+
+	return nil, rightsHandler.close(stub, offering)
+}
+
+func (t *SETBlockChainChaincode) cancelRightsOffering(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ cancelRightsOffering +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	offeringID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse offeringID")
+	}
+
+	offering, err := rightsHandler.getOffering(stub, offeringID)
+	if offering == nil || err != nil {
+		return nil, errors.New("Cannot find rights offering")
+	}
+
+	if RIGHTS_OPEN != offering.Status {
+		return nil, errors.New("Invalid Status")
+	}
+
+	if accountid != offering.IssuerID {
+		return nil, errors.New("Invalid issuerID")
+	}
+
+	return nil, rightsHandler.cancel(stub, offering)
+}
+
+func (t *SETBlockChainChaincode) placeOrder(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ placeOrder +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	err = t.recordTradingRole(stub, accountid)
+	if err != nil {
+		return nil, err
+	}
+
+	var symbol, side, price string
+
+	symbol = args[0]
+	side = args[1]
+	price = args[2]
+	volume, err := strconv.ParseUint(args[3], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse volume")
+	}
+
+	if !t.stringInSlice(side, []string{SIDE_BUY, SIDE_SELL}) {
+		return nil, errors.New("Invalid side")
+	}
+
+	return nil, orderHandler.placeOrder(stub, accountid, symbol, side, price, volume)
+}
+
+func (t *SETBlockChainChaincode) cancelOrder(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ cancelOrder +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	orderID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse orderID")
+	}
+
+	return nil, orderHandler.cancelOrder(stub, accountid, orderID)
+}
+
+func (t *SETBlockChainChaincode) expireOffers(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ expireOffers +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+
+	txMsgs, err := txHandler.findExpiredTransaction(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, txMsg := range txMsgs {
+		myLogger.Debugf("expire transaction [%v]", txMsg.TransactionID)
+
+		if TXTYPE_OFFER == txMsg.TxType {
+			err = actBalHandler.release(stub, txMsg.SellerID, txMsg.Symbol, txMsg.Volume)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err = txHandler.updateStatus(stub, txMsg.TransactionID, STATUS_EXPIRED)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rfqs, err := rfqHandler.findExpiredRFQ(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range rfqs {
+		myLogger.Debugf("expire rfq [%v]", rfqs[i].RFQID)
+
+		err = rfqHandler.close(stub, &rfqs[i], RFQ_EXPIRED)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+// settleTrades settles every cleared trade whose settlement date has arrived.
+func (t *SETBlockChainChaincode) settleTrades(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ settleTrades +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+
+	return nil, settleHandler.settleDue(stub)
+}
+
+func (t *SETBlockChainChaincode) setSettlementCycle(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ setSettlementCycle +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	days, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse settlement cycle")
+	}
+
+	return nil, settleHandler.setSettlementCycle(stub, days)
+}
+
+// reverseTransaction lets the tsd undo a settled trade, e.g. one keyed in
+// error, with compensating share and cash movements.
+func (t *SETBlockChainChaincode) reverseTransaction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ reverseTransaction +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	txID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse txID")
+	}
+
+	reasonCode := args[1]
+	if !t.stringInSlice(reasonCode, []string{REVERSAL_KEYING_ERROR, REVERSAL_DUPLICATE, REVERSAL_WRONG_PARTY, REVERSAL_CLIENT_REQUEST}) {
+		return nil, errors.New("Invalid reason code")
+	}
+
+	txMsg, err := txHandler.getTransaction(stub, txID)
+	if txMsg == nil || err != nil {
+		return nil, errors.New("Cannot find transaction")
+	}
+
+	myLogger.Debugf("Status[%v]", txMsg.Status)
+
+	if STATUS_CONFIRMED != txMsg.Status {
+		return nil, errors.New("Invalid Status")
+	}
+
+	if TXTYPE_REVERSAL == txMsg.TxType {
+		return nil, errors.New("Invalid transaction type")
+	}
+
+	revID, err := settleHandler.reverse(stub, txMsg, reasonCode)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Infof("transaction [%v] reversed by [%v]", txID, revID)
+
+	return nil, nil
+}
+
+func (t *SETBlockChainChaincode) issueStock(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ issueStock +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	accountid := args[0]
+	symbol := args[1]
+	volume, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse volume")
+	}
+
+	return nil, actBalHandler.issueStock(stub, accountid, symbol, volume)
+}
+
+// redeemStock takes shares of a holder out of circulation, for a buyback or
+// cancellation: holderID, symbol, volume and optionally the price per share
+// to pay the holder and the account paying it, which has to be the issuer.
+// An issuer can only redeem its own symbol, and shares held by anyone but
+// the issuer are only taken against payment.
+func (t *SETBlockChainChaincode) redeemStock(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ redeemStock +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 3 && len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3 or 5")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	role, err := t.getRole(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	action := CorporateActionMsg{
+		Symbol:     args[1],
+		ActionType: CORP_ACTION_REDEMPTION,
+		HolderID:   args[0],
+	}
+	issuerID, err := secProHandler.getIssuer(stub, action.Symbol)
+	if err != nil {
+		return nil, err
+	}
+	if ROLE_ISSUER == role && accountid != issuerID {
+		return nil, errors.New("Only the issuer of " + action.Symbol + " can redeem its shares")
+	}
+
+	action.Volume, err = strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse volume")
+	}
+	if action.Volume == 0 {
+		return nil, errors.New("Invalid volume")
+	}
+
+	if len(args) == 5 {
+		action.Price, err = secProHandler.checkPrice(stub, action.Symbol, args[3])
+		if err != nil {
+			return nil, err
+		}
+		action.AccountID = args[4]
+		if action.AccountID != issuerID {
+			return nil, errors.New("Invalid payerID")
+		}
+		if _, err := actMonHandler.queryBalance(stub, action.HolderID); err != nil {
+			return nil, errors.New("No money account for " + action.HolderID)
+		}
+	} else if action.HolderID != issuerID {
+		return nil, errors.New("Shares held by " + action.HolderID + " can only be redeemed against payment")
+	}
+
+	return nil, corpHandler.redeem(stub, &action)
+}
+
+// authoriseShares sets the authorised shares of a symbol and the par value
+// of each share: symbol, authorisedShares, parValue.
+func (t *SETBlockChainChaincode) authoriseShares(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ authoriseShares +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	}
+
+	symbol := args[0]
+	authorisedShares, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse authorised shares")
+	}
+	parValue, err := parseAmount(args[2])
+	if err != nil {
+		return nil, errors.New("Unable to parse par value " + args[2])
+	}
+
+	return nil, secProHandler.authorise(stub, symbol, authorisedShares, parValue)
+}
+
+// pinCapTable keeps the holders of a symbol under a name, such as a record
+// date: symbol, name and optionally the timestamp or ledger transaction to
+// pin them as of. Without it the holders are pinned as they stand now.
+func (t *SETBlockChainChaincode) pinCapTable(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ pinCapTable +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 2 && len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2 or 3")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	symbol := args[0]
+	if _, err := secProHandler.getSecurityProfile(stub, symbol); err != nil {
+		return nil, errors.New("No security profile for " + symbol)
+	}
+	name := args[1]
+	if name == "" {
+		return nil, errors.New("Invalid snapshot name")
+	}
+	var asOf string
+	if len(args) == 3 {
+		asOf = args[2]
+	}
+
+	return nil, capHandler.pin(stub, symbol, name, asOf, accountid)
+}
+
+func (t *SETBlockChainChaincode) findUnconfirmedTransaction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ findUnconfirmedTransaction +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	txMsgs, err := txHandler.findTransactionByAccountID(stub, accountid)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := ledgerClock.Now(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var txMsgsUnconfirmed []TransactionMsg
+
+	for _, txMsg := range txMsgs {
+		// trades in clearing are confirmed but not settled yet, so still open
+		if (txMsg.Status == STATUS_WAITING && !txHandler.isExpired(&txMsg, now)) || txMsg.Status == STATUS_CLEARING {
+			txMsgsUnconfirmed = append(txMsgsUnconfirmed, txMsg)
+		}
+	}
+
+	txMsgsJson, err := json.Marshal(txMsgsUnconfirmed)
+	myLogger.Debugf("Response : %s", txMsgsJson)
+
+	return txMsgsJson, nil
+}
+
+func (t *SETBlockChainChaincode) findCompletedTransaction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ findCompletedTransaction +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	txMsgs, err := txHandler.findTransactionByAccountID(stub, accountid)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := ledgerClock.Now(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var txMsgsCompleted []TransactionMsg
+
+	for _, txMsg := range txMsgs {
+		// offers past their expiry count as expired even before the sweep runs
+		if txHandler.isExpired(&txMsg, now) {
+			txMsg.Status = STATUS_EXPIRED
+		}
+		if txMsg.Status == STATUS_CONFIRMED || txMsg.Status == STATUS_CANCEL_BUYER || txMsg.Status == STATUS_CANCEL_SELLER || txMsg.Status == STATUS_EXPIRED || txMsg.Status == STATUS_SETTLE_FAILED || txMsg.Status == STATUS_REVERSED {
+			txMsgsCompleted = append(txMsgsCompleted, txMsg)
+		}
+	}
+
+	txMsgsJson, err := json.Marshal(txMsgsCompleted)
+	myLogger.Debugf("Response : %s", txMsgsJson)
+
+	return txMsgsJson, nil
+}
+
+func (t *SETBlockChainChaincode) findOpenOffer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ findOpenOffer +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	txMsgs, err := txHandler.findOpenOffer(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	txMsgsJson, err := json.Marshal(txMsgs)
+	myLogger.Debugf("Response : %s", txMsgsJson)
+
+	return txMsgsJson, nil
+}
+
+func (t *SETBlockChainChaincode) findConfirmedTransactionBySymbol(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ findConfirmedTransactionBySymbol +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	var symbol string
+	symbol = args[0]
+
+	txMsgs, err := txHandler.findTransactionByAccountIDSymbol(stub, accountid, symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	var txMsgsConfirmed []TransactionMsg
+
+	for _, txMsg := range txMsgs {
+		if txMsg.Status == STATUS_CONFIRMED {
+			txMsgsConfirmed = append(txMsgsConfirmed, txMsg)
+		}
+	}
+
+	txMsgsJson, err := json.Marshal(txMsgsConfirmed)
+	myLogger.Debugf("Response : %s", txMsgsJson)
+
+	return txMsgsJson, nil
+}
+
+func (t *SETBlockChainChaincode) getTransaction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ getTransaction +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	txMsgs, err := txHandler.findTransactionByAccountID(stub, accountid)
+	if err != nil {
+		return nil, err
+	}
+
+	for index, txMsg := range txMsgs {
+		myLogger.Debugf("[%v]:[%v]", index, txMsg)
+	}
+
+	return txHandler.query(stub, accountid)
+}
+
+func (t *SETBlockChainChaincode) getTransactionRevisions(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ getTransactionRevisions +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	txID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse txID")
+	}
+
+	txMsg, err := txHandler.getTransaction(stub, txID)
+	if txMsg == nil || err != nil {
+		return nil, errors.New("Cannot find transaction")
+	}
+
+	if accountid != txMsg.BuyerID && accountid != txMsg.SellerID {
+		return nil, errors.New("Invalid buyerID or SellerID")
+	}
+
+	revMsgs, err := txHandler.findRevision(stub, txMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	revMsgsJson, err := json.Marshal(revMsgs)
+	myLogger.Debugf("Response : %s", revMsgsJson)
+
+	return revMsgsJson, nil
+}
+
+func (t *SETBlockChainChaincode) getBasket(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ getBasket +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	txID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse txID")
+	}
+
+	txMsg, err := txHandler.getTransaction(stub, txID)
+	if txMsg == nil || err != nil {
+		return nil, errors.New("Cannot find transaction")
+	}
+
+	if accountid != txMsg.BuyerID && accountid != txMsg.SellerID {
+		return nil, errors.New("Invalid buyerID or SellerID")
+	}
+
+	legs, err := txHandler.findLegs(stub, txID)
+	if err != nil {
+		return nil, err
+	}
+
+	legsJson, err := json.Marshal(legs)
+	myLogger.Debugf("Response : %s", legsJson)
+
+	return legsJson, nil
+}
+
+func (t *SETBlockChainChaincode) getNegotiation(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ getNegotiation +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	txID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse txID")
+	}
+
+	txMsg, err := txHandler.getTransaction(stub, txID)
+	if txMsg == nil || err != nil {
+		return nil, errors.New("Cannot find transaction")
+	}
+
+	if accountid != txMsg.BuyerID && accountid != txMsg.SellerID {
+		return nil, errors.New("Invalid buyerID or SellerID")
+	}
+
+	return negHandler.query(stub, txID)
+}
+
+func (t *SETBlockChainChaincode) getRFQ(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ getRFQ +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	rfqID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse rfqID")
+	}
+
+	rfq, err := rfqHandler.getRFQ(stub, rfqID)
+	if rfq == nil || err != nil {
+		return nil, errors.New("Cannot find rfq")
+	}
+
+	if accountid != rfq.RequesterID && rfqHandler.quoteOf(rfq, accountid) == nil {
+		return nil, errors.New("Invalid requesterID or holderID")
+	}
+
+	rfqJson, err := json.Marshal(rfqHandler.visibleTo(rfq, accountid))
+	myLogger.Debugf("Response : %s", rfqJson)
+
+	return rfqJson, nil
+}
+
+func (t *SETBlockChainChaincode) getAuction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ getAuction +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	auctionID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse auctionID")
+	}
+
+	auction, err := auctHandler.getAuction(stub, auctionID)
+	if auction == nil || err != nil {
+		return nil, errors.New("Cannot find auction")
+	}
+
+	auctionJson, err := json.Marshal(auctHandler.visibleTo(auction, accountid))
+	myLogger.Debugf("Response : %s", auctionJson)
+
+	return auctionJson, nil
+}
+
+func (t *SETBlockChainChaincode) getDividend(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ getDividend +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	dividendID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse dividendID")
+	}
+
+	dividend, err := divHandler.getDividend(stub, dividendID)
+	if dividend == nil || err != nil {
+		return nil, errors.New("Cannot find dividend")
+	}
+
+	if accountid != dividend.IssuerID && divHandler.paymentOf(dividend, accountid) == nil {
+		return nil, errors.New("Invalid issuerID or holderID")
+	}
+
+	dividendJson, err := json.Marshal(divHandler.visibleTo(dividend, accountid))
+	myLogger.Debugf("Response : %s", dividendJson)
+
+	return dividendJson, nil
+}
+
+// findDividend lists the dividends the caller declared or was paid.
+func (t *SETBlockChainChaincode) findDividend(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ findDividend +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	dividends, err := divHandler.findDividend(stub, accountid)
+	if err != nil {
+		return nil, err
+	}
+
+	dividendsJson, err := json.Marshal(dividends)
+	myLogger.Debugf("Response : %s", dividendsJson)
+
+	return dividendsJson, nil
+}
+
+// getCorporateActions returns the corporate action history of a symbol.
+func (t *SETBlockChainChaincode) getCorporateActions(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ getCorporateActions +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	return corpHandler.query(stub, args[0])
+}
+
+func (t *SETBlockChainChaincode) getShareCapital(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ getShareCapital +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	return secProHandler.queryShareCapital(stub, args[0])
+}
+
+func (t *SETBlockChainChaincode) getRightsOffering(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ getRightsOffering +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	offeringID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse offeringID")
+	}
+
+	offering, err := rightsHandler.getOffering(stub, offeringID)
+	if offering == nil || err != nil {
+		return nil, errors.New("Cannot find rights offering")
+	}
+
+	if accountid != offering.IssuerID && rightsHandler.entitlementOf(offering, accountid) == nil {
+		return nil, errors.New("Invalid issuerID or holderID")
+	}
+
+	offeringJson, err := json.Marshal(rightsHandler.visibleTo(offering, accountid))
+	myLogger.Debugf("Response : %s", offeringJson)
+
+	return offeringJson, nil
+}
+
+// findRightsOffering lists the offerings the caller declared or holds rights
+// in.
+func (t *SETBlockChainChaincode) findRightsOffering(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ findRightsOffering +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	offerings, err := rightsHandler.findRightsOffering(stub, accountid)
+	if err != nil {
+		return nil, err
 	}
 
-	txMsgsJson, err := json.Marshal(txMsgsConfirmed)
-	myLogger.Debugf("Response : %s", txMsgsJson)
+	offeringsJson, err := json.Marshal(offerings)
+	myLogger.Debugf("Response : %s", offeringsJson)
 
-	return txMsgsJson, nil
+	return offeringsJson, nil
 }
 
-func (t *SETBlockChainChaincode) getTransaction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ getTransaction +++++++++++++++++++++++++++++++++")
+func (t *SETBlockChainChaincode) findRFQ(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ findRFQ +++++++++++++++++++++++++++++++++")
 
 	if len(args) != 0 {
 		return nil, errors.New("Incorrect number of arguments. Expecting 0")
@@ -311,16 +2560,15 @@ func (t *SETBlockChainChaincode) getTransaction(stub shim.ChaincodeStubInterface
 	}
 	myLogger.Debugf("accountid [%v]", accountid)
 
-	txMsgs, err := txHandler.findTransactionByAccountID(stub, accountid)
+	rfqs, err := rfqHandler.findRFQ(stub, accountid)
 	if err != nil {
 		return nil, err
 	}
 
-	for index, txMsg := range txMsgs {
-		myLogger.Debugf("[%v]:[%v]", index, txMsg)
-	}
+	rfqsJson, err := json.Marshal(rfqs)
+	myLogger.Debugf("Response : %s", rfqsJson)
 
-	return txHandler.query(stub, accountid)
+	return rfqsJson, nil
 }
 
 func (t *SETBlockChainChaincode) getBalance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
@@ -355,6 +2603,74 @@ func (t *SETBlockChainChaincode) getHolders(stub shim.ChaincodeStubInterface, ar
 	return actBalHandler.listHolderBySymbol(stub, args[0])
 }
 
+// getCapTable rebuilds the holders of a symbol as of a timestamp or a ledger
+// transaction: symbol, asOf.
+func (t *SETBlockChainChaincode) getCapTable(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ getCapTable +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	return capHandler.query(stub, args[0], args[1])
+}
+
+func (t *SETBlockChainChaincode) getCapTableSnapshot(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ getCapTableSnapshot +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	}
+
+	return capHandler.querySnapshot(stub, args[0], args[1])
+}
+
+func (t *SETBlockChainChaincode) findCapTableSnapshot(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ findCapTableSnapshot +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	snapshots, err := capHandler.findSnapshot(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotsJson, err := json.Marshal(snapshots)
+	myLogger.Debugf("Response : %s", snapshotsJson)
+
+	return snapshotsJson, nil
+}
+
+// getBalanceAsOf returns the caller's balances as of a timestamp or a ledger
+// transaction.
+func (t *SETBlockChainChaincode) getBalanceAsOf(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ getBalanceAsOf +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	accountid, err := t.getAccountid(stub)
+	if err != nil {
+		return nil, err
+	}
+	myLogger.Debugf("accountid [%v]", accountid)
+
+	return capHandler.queryHoldings(stub, accountid, args[0])
+}
+
+func (t *SETBlockChainChaincode) getOrderBook(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ getOrderBook +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	}
+
+	return orderHandler.depth(stub, args[0])
+}
+
 func (t *SETBlockChainChaincode) getMoney(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	myLogger.Debugf("+++++++++++++++++++++++++++++++++++getMoney+++++++++++++++++++++++++++++++++")
 
@@ -367,11 +2683,17 @@ func (t *SETBlockChainChaincode) getMoney(stub shim.ChaincodeStubInterface, args
 	if err != nil {
 		return nil, err
 	}
+	held, err := actMonHandler.queryHeld(stub, accountid)
+	if err != nil {
+		return nil, err
+	}
 
 	var txMsgs []AccountMoneyMsg
 	txMsg := AccountMoneyMsg{
-		accountid, //AccountID
-		balance,   //Amount
+		accountid,      //AccountID
+		balance,        //Amount
+		balance - held, //Available
+		held,           //Held
 	}
 	txMsgs = append(txMsgs, txMsg)
 
@@ -390,14 +2712,70 @@ func (t *SETBlockChainChaincode) addMoney(stub shim.ChaincodeStubInterface, args
 	}
 
 	accountid := args[0]
-	amount, err := strconv.ParseUint(args[1], 10, 64)
+	amount, err := parseAmount(args[1])
 	if err != nil {
-		return nil, errors.New("Cannot parse volume")
+		return nil, errors.New("Cannot parse amount")
 	}
 
 	return nil, actMonHandler.addMoney(stub, accountid, amount)
 }
 
+// setFee adds or replaces a fee rule: feeType, side, symbol, role, rate in
+// basis points, minimum, cap and the fee account. Symbol and role may be "*"
+// and a cap of 0 means no cap.
+func (t *SETBlockChainChaincode) setFee(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ setFee +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 8 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 8")
+	}
+
+	rate, err := strconv.ParseUint(args[4], 10, 64)
+	if err != nil {
+		return nil, errors.New("Cannot parse rate")
+	}
+	minimum, err := parseAmount(args[5])
+	if err != nil {
+		return nil, errors.New("Cannot parse minimum")
+	}
+	cap, err := parseAmount(args[6])
+	if err != nil {
+		return nil, errors.New("Cannot parse cap")
+	}
+
+	rule := FeeRuleMsg{
+		FeeType:    args[0],
+		Side:       args[1],
+		Symbol:     args[2],
+		Role:       args[3],
+		Rate:       rate,
+		Minimum:    minimum,
+		Cap:        cap,
+		FeeAccount: args[7],
+	}
+	return nil, feeHandler.putRule(stub, &rule)
+}
+
+func (t *SETBlockChainChaincode) removeFee(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ removeFee +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+	}
+
+	return nil, feeHandler.removeRule(stub, args[0], args[1], args[2], args[3])
+}
+
+func (t *SETBlockChainChaincode) getFeeSchedule(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++ getFeeSchedule +++++++++++++++++++++++++++++++++")
+
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+
+	return feeHandler.query(stub)
+}
+
 func (t *SETBlockChainChaincode) getMaxNumberHolder(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	myLogger.Debugf("+++++++++++++++++++++++++++++++++++getMaxNumberHolder+++++++++++++++++++++++++++++++++")
 	if len(args) != 1 {
@@ -406,17 +2784,13 @@ func (t *SETBlockChainChaincode) getMaxNumberHolder(stub shim.ChaincodeStubInter
 
 	sysmbol := args[0]
 
-	maxNumberHolder, err := secProHandler.getMaxNumberHolder(stub, sysmbol)
+	txMsg, err := secProHandler.getSecurityProfile(stub, sysmbol)
 	if err != nil {
 		return nil, err
 	}
 
 	var txMsgs []SecurityProfileMsg
-	txMsg := SecurityProfileMsg{
-		sysmbol,         //Symbol
-		maxNumberHolder, //MaxNumberHolder
-	}
-	txMsgs = append(txMsgs, txMsg)
+	txMsgs = append(txMsgs, *txMsg)
 
 	txMsgsJSON, err := json.Marshal(txMsgs)
 	myLogger.Debugf("Response : %s", txMsgsJSON)
@@ -424,6 +2798,16 @@ func (t *SETBlockChainChaincode) getMaxNumberHolder(stub shim.ChaincodeStubInter
 	return txMsgsJSON, nil
 }
 
+func (t *SETBlockChainChaincode) auditLedger(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	myLogger.Debugf("+++++++++++++++++++++++++++++++++++auditLedger+++++++++++++++++++++++++++++++++")
+
+	if len(args) != 0 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0")
+	}
+
+	return auditHandler.audit(stub)
+}
+
 func (t *SETBlockChainChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	myLogger.Debugf("******************************** Init ****************************************")
 
@@ -432,9 +2816,21 @@ func (t *SETBlockChainChaincode) Init(stub shim.ChaincodeStubInterface, function
 		return nil, errors.New("Incorrect number of arguments. Expecting 0")
 	}
 	/*test*/
+	auditHandler.createTable(stub)
+	// the opening balances are issued against the security profiles and
+	// recorded in the balance history
+	capHandler.createTable(stub)
+	secProHandler.createTable(stub)
 	actBalHandler.createTable(stub)
 	actMonHandler.createTable(stub)
-	secProHandler.createTable(stub)
+	orderHandler.createTable(stub)
+	negHandler.createTable(stub)
+	feeHandler.createTable(stub)
+	rfqHandler.createTable(stub)
+	auctHandler.createTable(stub)
+	divHandler.createTable(stub)
+	corpHandler.createTable(stub)
+	rightsHandler.createTable(stub)
 	return nil, txHandler.createTable(stub)
 }
 
@@ -454,31 +2850,211 @@ func (t *SETBlockChainChaincode) Invoke(stub shim.ChaincodeStubInterface, functi
 			return nil, errors.New("Invalid role")
 		}
 		return t.sell(stub, args)
-		/*} else if function == "buy" {
-		    return t.buy(stub, args)
-		  } else if function == "confirmSell" {
-		    return t.confirmSell(stub, args)
-		*/
+	} else if function == "buy" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.buy(stub, args)
+	} else if function == "confirmSell" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.confirmSell(stub, args)
 	} else if function == "confirmBuy" {
 		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
 			return nil, errors.New("Invalid role")
 		}
 		return t.confirmBuy(stub, args)
+	} else if function == "sellBasket" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.sellBasket(stub, args)
+	} else if function == "confirmBasket" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.confirmBasket(stub, args)
 	} else if function == "cancel" {
 		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
 			return nil, errors.New("Invalid role")
 		}
 		return t.cancel(stub, args)
+	} else if function == "amendOffer" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.amendOffer(stub, args)
+	} else if function == "counterOffer" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.counterOffer(stub, args)
+	} else if function == "acceptCounter" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.answerCounter(stub, args, NEGOTIATION_ACCEPT)
+	} else if function == "rejectCounter" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.answerCounter(stub, args, NEGOTIATION_REJECT)
+	} else if function == "requestQuote" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.requestQuote(stub, args)
+	} else if function == "submitQuote" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.submitQuote(stub, args)
+	} else if function == "acceptQuote" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.acceptQuote(stub, args)
+	} else if function == "cancelRFQ" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.cancelRFQ(stub, args)
+	} else if function == "withdrawQuote" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.withdrawQuote(stub, args)
+	} else if function == "openAuction" {
+		if !t.stringInSlice(role, []string{ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.openAuction(stub, args)
+	} else if function == "placeAuctionBid" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.placeAuctionBid(stub, args)
+	} else if function == "closeAuction" {
+		if !t.stringInSlice(role, []string{ROLE_ISSUER, ROLE_BOT}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.closeAuction(stub, args)
+	} else if function == "cancelAuction" {
+		if !t.stringInSlice(role, []string{ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.cancelAuction(stub, args)
+	} else if function == "declareDividend" {
+		if !t.stringInSlice(role, []string{ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.declareDividend(stub, args)
+	} else if function == "cancelDividend" {
+		if !t.stringInSlice(role, []string{ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.cancelDividend(stub, args)
+	} else if function == "declareRightsOffering" {
+		if !t.stringInSlice(role, []string{ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.declareRightsOffering(stub, args)
+	} else if function == "subscribeRights" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.subscribeRights(stub, args)
+	} else if function == "transferRights" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.transferRights(stub, args)
+	} else if function == "closeRightsOffering" {
+		if !t.stringInSlice(role, []string{ROLE_ISSUER, ROLE_BOT}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.closeRightsOffering(stub, args)
+	} else if function == "cancelRightsOffering" {
+		if !t.stringInSlice(role, []string{ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.cancelRightsOffering(stub, args)
+	} else if function == "placeOrder" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.placeOrder(stub, args)
+	} else if function == "cancelOrder" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.cancelOrder(stub, args)
 	} else if function == "issueStock" {
 		if !t.stringInSlice(role, []string{ROLE_TSD}) {
 			return nil, errors.New("Invalid role")
 		}
 		return t.issueStock(stub, args)
+	} else if function == "redeemStock" {
+		if !t.stringInSlice(role, []string{ROLE_ISSUER, ROLE_TSD}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.redeemStock(stub, args)
+	} else if function == "authoriseShares" {
+		if !t.stringInSlice(role, []string{ROLE_TSD}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.authoriseShares(stub, args)
+	} else if function == "pinCapTable" {
+		if !t.stringInSlice(role, []string{ROLE_ISSUER, ROLE_TSD}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.pinCapTable(stub, args)
 	} else if function == "addMoney" {
 		if !t.stringInSlice(role, []string{ROLE_BOT}) {
 			return nil, errors.New("Invalid role")
 		}
 		return t.addMoney(stub, args)
+	} else if function == "expireOffers" {
+		if !t.stringInSlice(role, []string{ROLE_BOT}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.expireOffers(stub, args)
+	} else if function == "payDividends" {
+		if !t.stringInSlice(role, []string{ROLE_BOT}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.payDividends(stub, args)
+	} else if function == "settleTrades" {
+		if !t.stringInSlice(role, []string{ROLE_BOT, ROLE_TSD}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.settleTrades(stub, args)
+	} else if function == "setSettlementCycle" {
+		if !t.stringInSlice(role, []string{ROLE_TSD}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.setSettlementCycle(stub, args)
+	} else if function == "reverseTransaction" {
+		if !t.stringInSlice(role, []string{ROLE_TSD}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.reverseTransaction(stub, args)
+	} else if function == "splitStock" {
+		if !t.stringInSlice(role, []string{ROLE_TSD}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.splitStock(stub, args)
+	} else if function == "setFee" {
+		if !t.stringInSlice(role, []string{ROLE_ADMIN}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.setFee(stub, args)
+	} else if function == "removeFee" {
+		if !t.stringInSlice(role, []string{ROLE_ADMIN}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.removeFee(stub, args)
 	}
 
 	return nil, errors.New("Received unknown function invocation")
@@ -516,6 +3092,21 @@ func (t *SETBlockChainChaincode) Query(stub shim.ChaincodeStubInterface, functio
 			return nil, errors.New("Invalid role")
 		}
 		return t.getTransaction(stub, args)
+	} else if function == "getTransactionRevisions" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.getTransactionRevisions(stub, args)
+	} else if function == "getBasket" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.getBasket(stub, args)
+	} else if function == "getNegotiation" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.getNegotiation(stub, args)
 	} else if function == "getBalance" {
 		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
 			return nil, errors.New("Invalid role")
@@ -536,6 +3127,11 @@ func (t *SETBlockChainChaincode) Query(stub shim.ChaincodeStubInterface, functio
 			return nil, errors.New("Invalid role")
 		}
 		return t.findConfirmedTransactionBySymbol(stub, args)
+	} else if function == "findOpenOffer" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.findOpenOffer(stub, args)
 	} else if function == "getMoney" {
 		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
 			return nil, errors.New("Invalid role")
@@ -551,6 +3147,86 @@ func (t *SETBlockChainChaincode) Query(stub shim.ChaincodeStubInterface, functio
 			return nil, errors.New("Invalid role")
 		}
 		return t.getHolders(stub, args)
+	} else if function == "getCapTable" {
+		if !t.stringInSlice(role, []string{ROLE_ISSUER, ROLE_TSD, ROLE_AUDITOR}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.getCapTable(stub, args)
+	} else if function == "getCapTableSnapshot" {
+		if !t.stringInSlice(role, []string{ROLE_ISSUER, ROLE_TSD, ROLE_AUDITOR}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.getCapTableSnapshot(stub, args)
+	} else if function == "findCapTableSnapshot" {
+		if !t.stringInSlice(role, []string{ROLE_ISSUER, ROLE_TSD, ROLE_AUDITOR}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.findCapTableSnapshot(stub, args)
+	} else if function == "getBalanceAsOf" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.getBalanceAsOf(stub, args)
+	} else if function == "getOrderBook" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.getOrderBook(stub, args)
+	} else if function == "auditLedger" {
+		if !t.stringInSlice(role, []string{ROLE_AUDITOR, ROLE_TSD}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.auditLedger(stub, args)
+	} else if function == "getRFQ" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.getRFQ(stub, args)
+	} else if function == "findRFQ" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.findRFQ(stub, args)
+	} else if function == "getAuction" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.getAuction(stub, args)
+	} else if function == "getDividend" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.getDividend(stub, args)
+	} else if function == "findDividend" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.findDividend(stub, args)
+	} else if function == "getCorporateActions" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER, ROLE_TSD, ROLE_AUDITOR}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.getCorporateActions(stub, args)
+	} else if function == "getShareCapital" {
+		if !t.stringInSlice(role, []string{ROLE_ISSUER, ROLE_TSD}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.getShareCapital(stub, args)
+	} else if function == "getRightsOffering" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.getRightsOffering(stub, args)
+	} else if function == "findRightsOffering" {
+		if !t.stringInSlice(role, []string{ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.findRightsOffering(stub, args)
+	} else if function == "getFeeSchedule" {
+		if !t.stringInSlice(role, []string{ROLE_ADMIN, ROLE_TRADER, ROLE_ISSUER}) {
+			return nil, errors.New("Invalid role")
+		}
+		return t.getFeeSchedule(stub, args)
 	}
 	return nil, errors.New("Received unknown function query invocation with function " + function)
 }
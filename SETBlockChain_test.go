@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// testEpoch is the ledger time every test starts at.
+var testEpoch = time.Date(2016, time.October, 3, 9, 0, 0, 0, time.UTC)
+
+// fixedClock is a Clock that only moves when the test advances it.
+type fixedClock struct {
+	now time.Time
+}
+
+func (c *fixedClock) Now(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	return c.now, nil
+}
+
+func (c *fixedClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// testStub is a MockStub that carries the certificate attributes of the
+// caller, which the MockStub itself does not have.
+type testStub struct {
+	*shim.MockStub
+	t     *testing.T
+	cc    *SETBlockChainChaincode
+	clock *fixedClock
+	attrs map[string]string
+	txSeq int
+}
+
+// newTestStub initialises the chaincode on a fresh MockStub with the ledger
+// clock fixed at testEpoch. The caller has to defer restoreClock.
+func newTestStub(t *testing.T) *testStub {
+	cc := new(SETBlockChainChaincode)
+	stub := &testStub{
+		MockStub: shim.NewMockStub("SETBlockChain", cc),
+		t:        t,
+		cc:       cc,
+		clock:    &fixedClock{testEpoch},
+		attrs:    map[string]string{},
+	}
+	ledgerClock = stub.clock
+
+	stub.MockTransactionStart("init")
+	_, err := cc.Init(stub, "init", nil)
+	stub.MockTransactionEnd("init")
+	if err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	return stub
+}
+
+func restoreClock() {
+	ledgerClock = NewTxTimestampClock()
+}
+
+func (s *testStub) ReadCertAttribute(attributeName string) ([]byte, error) {
+	value, ok := s.attrs[attributeName]
+	if !ok {
+		return nil, errors.New("No attribute " + attributeName)
+	}
+	return []byte(value), nil
+}
+
+// as makes the following calls under the given account and role.
+func (s *testStub) as(accountID string, role string) *testStub {
+	s.attrs["accountid"] = accountID
+	s.attrs["role"] = role
+	return s
+}
+
+func (s *testStub) invoke(function string, args ...string) error {
+	s.txSeq++
+	txID := strconv.Itoa(s.txSeq)
+	s.MockTransactionStart(txID)
+	defer s.MockTransactionEnd(txID)
+
+	_, err := s.cc.Invoke(s, function, args)
+	return err
+}
+
+func (s *testStub) mustInvoke(function string, args ...string) {
+	err := s.invoke(function, args...)
+	if err != nil {
+		s.t.Fatalf("%v %v: %v", function, args, err)
+	}
+}
+
+func (s *testStub) balance(accountID string, symbol string) (uint64, uint64) {
+	balance, reserved, err := actBalHandler.getBalanceReserved(s, accountID, symbol)
+	if err != nil {
+		s.t.Fatalf("balance of %v in %v: %v", accountID, symbol, err)
+	}
+	return balance, reserved
+}
+
+func (s *testStub) money(accountID string) uint64 {
+	amount, err := actMonHandler.queryBalance(s, accountID)
+	if err != nil {
+		s.t.Fatalf("money of %v: %v", accountID, err)
+	}
+	return amount
+}
+
+func (s *testStub) transaction(txID uint64) *TransactionMsg {
+	txMsg, err := txHandler.getTransaction(s, txID)
+	if err != nil || txMsg == nil {
+		s.t.Fatalf("transaction %v: %v", txID, err)
+	}
+	return txMsg
+}
@@ -1,15 +1,27 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"strconv"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 )
 
 const (
 	tableSecurityProfile = "SecurityProfile"
+	tableIssuanceLog     = "IssuanceLog"
 
-	columnMaxNumberHolder = "MaxNumberHolder"
+	columnMaxNumberHolder  = "MaxNumberHolder"
+	columnCurrency         = "Currency"
+	columnTickSize         = "TickSize"
+	columnAuthorisedShares = "AuthorisedShares"
+	columnIssuedShares     = "IssuedShares"
+	columnParValue         = "ParValue"
+
+	ISSUANCE_ISSUE  = "Issue"
+	ISSUANCE_REDEEM = "Redeem"
+	ISSUANCE_SPLIT  = "Split"
 )
 
 type securityProfileHandler struct {
@@ -17,8 +29,39 @@ type securityProfileHandler struct {
 
 //
 type SecurityProfileMsg struct {
-	Symbol          string
-	MaxNumberHolder uint64
+	Symbol           string
+	MaxNumberHolder  uint64
+	Currency         string
+	TickSize         string
+	AuthorisedShares uint64
+	IssuedShares     uint64
+	ParValue         string
+	IssuerID         string
+}
+
+// IssuanceMsg is one change to the issued shares of a symbol. Volume is the
+// number of shares issued, redeemed or added and removed by a split, and
+// IssuedShares the issued shares after the change.
+type IssuanceMsg struct {
+	Symbol       string
+	Seq          uint64
+	Action       string
+	AccountID    string
+	Volume       uint64
+	IssuedShares uint64
+	LastUpdated  string
+}
+
+// ShareCapitalMsg reports the issued against the authorised shares of a
+// symbol together with its issuance log.
+type ShareCapitalMsg struct {
+	Symbol           string
+	AuthorisedShares uint64
+	IssuedShares     uint64
+	UnissuedShares   uint64
+	ParValue         string
+	IssuedCapital    string
+	Issuances        []IssuanceMsg
 }
 
 //
@@ -32,14 +75,35 @@ func (t *securityProfileHandler) createTable(stub shim.ChaincodeStubInterface) e
 	stub.CreateTable(tableSecurityProfile, []*shim.ColumnDefinition{
 		&shim.ColumnDefinition{Name: columnSymbol, Type: shim.ColumnDefinition_STRING, Key: true},
 		&shim.ColumnDefinition{Name: columnMaxNumberHolder, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnCurrency, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnTickSize, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnAuthorisedShares, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnIssuedShares, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnParValue, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnIssuerID, Type: shim.ColumnDefinition_STRING, Key: false},
 	})
+
+	err := stub.CreateTable(tableIssuanceLog, []*shim.ColumnDefinition{
+		&shim.ColumnDefinition{Name: columnSymbol, Type: shim.ColumnDefinition_STRING, Key: true},
+		&shim.ColumnDefinition{Name: columnSeq, Type: shim.ColumnDefinition_UINT64, Key: true},
+		&shim.ColumnDefinition{Name: columnAction, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnAccountID, Type: shim.ColumnDefinition_STRING, Key: false},
+		&shim.ColumnDefinition{Name: columnVolume, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnIssuedShares, Type: shim.ColumnDefinition_UINT64, Key: false},
+		&shim.ColumnDefinition{Name: columnLastUpdated, Type: shim.ColumnDefinition_STRING, Key: false},
+	})
+	if err != nil {
+		myLogger.Errorf("system error create table issuance log %v", err)
+		return errors.New("Cannot create table issuance log.")
+	}
+
 	return t.initSecurityProfile(stub)
 }
 
 func (t *securityProfileHandler) initSecurityProfile(stub shim.ChaincodeStubInterface) error {
-	t.createSecurityProfile(stub, "Ookbee", 3)
-	t.createSecurityProfile(stub, "Wongnai", 4)
-	t.createSecurityProfile(stub, "ClaimDi", 5)
+	t.createSecurityProfile(stub, "Ookbee", 3, CURRENCY_THB, 1, 1000000, 100, "owner01")
+	t.createSecurityProfile(stub, "Wongnai", 4, CURRENCY_THB, 5, 1000000, 100, "owner02")
+	t.createSecurityProfile(stub, "ClaimDi", 5, CURRENCY_THB, 10, 1000000, 100, "owner03")
 	// t.createSecurityProfile(stub, "AAAA", 10)
 	// t.createSecurityProfile(stub, "BBBB", 10)
 	// t.createSecurityProfile(stub, "CCCC", 10)
@@ -50,7 +114,12 @@ func (t *securityProfileHandler) initSecurityProfile(stub shim.ChaincodeStubInte
 
 func (t *securityProfileHandler) createSecurityProfile(stub shim.ChaincodeStubInterface,
 	symbol string,
-	maxNumberHolder uint64) error {
+	maxNumberHolder uint64,
+	currency string,
+	tickSize uint64,
+	authorisedShares uint64,
+	parValue uint64,
+	issuerID string) error {
 
 	myLogger.Debugf("insert symbol= %v", symbol)
 
@@ -58,7 +127,13 @@ func (t *securityProfileHandler) createSecurityProfile(stub shim.ChaincodeStubIn
 	ok, err := stub.InsertRow(tableSecurityProfile, shim.Row{
 		Columns: []*shim.Column{
 			&shim.Column{Value: &shim.Column_String_{String_: symbol}},
-			&shim.Column{Value: &shim.Column_Uint64{Uint64: maxNumberHolder}}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: maxNumberHolder}},
+			&shim.Column{Value: &shim.Column_String_{String_: currency}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: tickSize}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: authorisedShares}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: 0}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: parValue}},
+			&shim.Column{Value: &shim.Column_String_{String_: issuerID}}},
 	})
 
 	// you can only assign balances to new account IDs
@@ -72,14 +147,26 @@ func (t *securityProfileHandler) createSecurityProfile(stub shim.ChaincodeStubIn
 
 func (t *securityProfileHandler) updateSecurityProfile(stub shim.ChaincodeStubInterface,
 	symbol string,
-	maxNumberHolder uint64) error {
+	maxNumberHolder uint64,
+	currency string,
+	tickSize uint64,
+	authorisedShares uint64,
+	issuedShares uint64,
+	parValue uint64,
+	issuerID string) error {
 
 	myLogger.Debugf("update symbol= %v", symbol)
 
 	ok, err := stub.ReplaceRow(tableSecurityProfile, shim.Row{
 		Columns: []*shim.Column{
 			&shim.Column{Value: &shim.Column_String_{String_: symbol}},
-			&shim.Column{Value: &shim.Column_Uint64{Uint64: maxNumberHolder}}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: maxNumberHolder}},
+			&shim.Column{Value: &shim.Column_String_{String_: currency}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: tickSize}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: authorisedShares}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: issuedShares}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: parValue}},
+			&shim.Column{Value: &shim.Column_String_{String_: issuerID}}},
 	})
 
 	if !ok && err == nil {
@@ -121,6 +208,363 @@ func (t *securityProfileHandler) getMaxNumberHolder(stub shim.ChaincodeStubInter
 	return row.Columns[1].GetUint64(), nil
 }
 
+func (t *securityProfileHandler) getSecurityProfile(stub shim.ChaincodeStubInterface, symbol string) (*SecurityProfileMsg, error) {
+
+	row, err := t.queryTable(stub, symbol)
+	if err != nil {
+		return nil, err
+	}
+	if len(row.Columns) == 0 {
+		return nil, errors.New("row or column value not found")
+	}
+
+	return &SecurityProfileMsg{
+		row.Columns[0].GetString_(),              //Symbol
+		row.Columns[1].GetUint64(),               //MaxNumberHolder
+		row.Columns[2].GetString_(),              //Currency
+		formatAmount(row.Columns[3].GetUint64()), //TickSize
+		row.Columns[4].GetUint64(),               //AuthorisedShares
+		row.Columns[5].GetUint64(),               //IssuedShares
+		formatAmount(row.Columns[6].GetUint64()), //ParValue
+		row.Columns[7].GetString_(),              //IssuerID
+	}, nil
+}
+
+// shareCapital reads the authorised shares, issued shares and par value of
+// a symbol.
+func (t *securityProfileHandler) shareCapital(stub shim.ChaincodeStubInterface, symbol string) (shim.Row, uint64, uint64, uint64, error) {
+
+	row, err := t.queryTable(stub, symbol)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return row, 0, 0, 0, errors.New("Cannot query security profile.")
+	}
+	if len(row.Columns) == 0 {
+		return row, 0, 0, 0, errors.New("No security profile for " + symbol)
+	}
+
+	return row, row.Columns[4].GetUint64(), row.Columns[5].GetUint64(), row.Columns[6].GetUint64(), nil
+}
+
+// putShareCapital replaces the share capital of a profile read by
+// shareCapital, keeping the rest of the profile.
+func (t *securityProfileHandler) putShareCapital(stub shim.ChaincodeStubInterface, row shim.Row, authorisedShares uint64, issuedShares uint64, parValue uint64) error {
+	return t.updateSecurityProfile(stub,
+		row.Columns[0].GetString_(),
+		row.Columns[1].GetUint64(),
+		row.Columns[2].GetString_(),
+		row.Columns[3].GetUint64(),
+		authorisedShares,
+		issuedShares,
+		parValue,
+		row.Columns[7].GetString_())
+}
+
+// getIssuer returns the account that issued symbol.
+func (t *securityProfileHandler) getIssuer(stub shim.ChaincodeStubInterface, symbol string) (string, error) {
+
+	row, err := t.queryTable(stub, symbol)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return "", errors.New("Cannot query security profile.")
+	}
+	if len(row.Columns) == 0 {
+		return "", errors.New("No security profile for " + symbol)
+	}
+
+	return row.Columns[7].GetString_(), nil
+}
+
+// checkIssuance makes sure volume more shares of symbol can be issued
+// without going past its authorised shares.
+func (t *securityProfileHandler) checkIssuance(stub shim.ChaincodeStubInterface, symbol string, volume uint64) error {
+
+	_, authorised, issued, _, err := t.shareCapital(stub, symbol)
+	if err != nil {
+		return err
+	}
+	if issued > authorised || volume > authorised-issued {
+		return errors.New("Issuing " + strconv.FormatUint(volume, 10) + " shares of " + symbol +
+			" would exceed its " + strconv.FormatUint(authorised, 10) + " authorised shares")
+	}
+	return nil
+}
+
+// issue adds volume shares issued to accountID to the issued shares of
+// symbol and logs the issuance.
+func (t *securityProfileHandler) issue(stub shim.ChaincodeStubInterface, symbol string, accountID string, volume uint64) error {
+
+	err := t.checkIssuance(stub, symbol, volume)
+	if err != nil {
+		return err
+	}
+	row, authorised, issued, parValue, err := t.shareCapital(stub, symbol)
+	if err != nil {
+		return err
+	}
+
+	issued += volume
+	err = t.putShareCapital(stub, row, authorised, issued, parValue)
+	if err != nil {
+		return err
+	}
+	return t.recordIssuance(stub, symbol, ISSUANCE_ISSUE, accountID, volume, issued)
+}
+
+// redeem takes volume shares redeemed from accountID off the issued shares
+// of symbol and logs the redemption.
+func (t *securityProfileHandler) redeem(stub shim.ChaincodeStubInterface, symbol string, accountID string, volume uint64) error {
+
+	row, authorised, issued, parValue, err := t.shareCapital(stub, symbol)
+	if err != nil {
+		return err
+	}
+	if volume > issued {
+		return errors.New("Cannot redeem more than the issued shares of " + symbol)
+	}
+
+	issued -= volume
+	err = t.putShareCapital(stub, row, authorised, issued, parValue)
+	if err != nil {
+		return err
+	}
+	return t.recordIssuance(stub, symbol, ISSUANCE_REDEEM, accountID, volume, issued)
+}
+
+// split rescales the authorised shares and par value of symbol by newShares
+// over oldShares and sets its issued shares to the holdings after the split.
+func (t *securityProfileHandler) split(stub shim.ChaincodeStubInterface, symbol string, newShares uint64, oldShares uint64, issuedAfter uint64) error {
+
+	row, authorised, issued, parValue, err := t.shareCapital(stub, symbol)
+	if err != nil {
+		return err
+	}
+
+	authorised, err = mulAmount(authorised, newShares)
+	if err != nil {
+		return err
+	}
+	authorised = authorised / oldShares
+	if issuedAfter > authorised {
+		return errors.New("The split would take the issued shares of " + symbol + " past its authorised shares")
+	}
+	parValue, err = mulAmount(parValue, oldShares)
+	if err != nil {
+		return err
+	}
+	parValue = parValue / newShares
+
+	var volume uint64
+	if issuedAfter > issued {
+		volume = issuedAfter - issued
+	} else {
+		volume = issued - issuedAfter
+	}
+
+	err = t.putShareCapital(stub, row, authorised, issuedAfter, parValue)
+	if err != nil {
+		return err
+	}
+	return t.recordIssuance(stub, symbol, ISSUANCE_SPLIT, "", volume, issuedAfter)
+}
+
+// authorise sets the authorised shares and par value of symbol. The
+// authorised shares cannot be set below the shares already issued.
+func (t *securityProfileHandler) authorise(stub shim.ChaincodeStubInterface, symbol string, authorisedShares uint64, parValue uint64) error {
+
+	row, _, issued, _, err := t.shareCapital(stub, symbol)
+	if err != nil {
+		return err
+	}
+	if authorisedShares < issued {
+		return errors.New("Authorised shares cannot be less than the " + strconv.FormatUint(issued, 10) + " shares issued")
+	}
+
+	return t.putShareCapital(stub, row, authorisedShares, issued, parValue)
+}
+
+// findIssuance returns the issuance log of a symbol in order.
+func (t *securityProfileHandler) findIssuance(stub shim.ChaincodeStubInterface, symbol string) ([]IssuanceMsg, error) {
+
+	var columns []shim.Column
+	colSymbol := shim.Column{Value: &shim.Column_String_{String_: symbol}}
+	columns = append(columns, colSymbol)
+
+	rowChannel, err := stub.GetRows(tableIssuanceLog, columns)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return nil, errors.New("Cannot query issuance log.")
+	}
+
+	var issuances []IssuanceMsg
+
+	for {
+		select {
+		case row, ok := <-rowChannel:
+			if !ok {
+				rowChannel = nil
+			} else {
+				issuances = append(issuances, IssuanceMsg{
+					row.Columns[0].GetString_(), //symbol
+					row.Columns[1].GetUint64(),  //seq
+					row.Columns[2].GetString_(), //action
+					row.Columns[3].GetString_(), //accountID
+					row.Columns[4].GetUint64(),  //volume
+					row.Columns[5].GetUint64(),  //issuedShares
+					row.Columns[6].GetString_(), //lastUpdated
+				})
+			}
+		}
+		if rowChannel == nil {
+			break
+		}
+	}
+
+	// entries are numbered from 1 without gaps, put them back in that order
+	ordered := make([]IssuanceMsg, len(issuances))
+	for _, issuance := range issuances {
+		if issuance.Seq < 1 || issuance.Seq > uint64(len(issuances)) {
+			return nil, errors.New("Invalid issuance sequence")
+		}
+		ordered[issuance.Seq-1] = issuance
+	}
+
+	return ordered, nil
+}
+
+// recordIssuance appends an entry to the issuance log of a symbol.
+func (t *securityProfileHandler) recordIssuance(stub shim.ChaincodeStubInterface,
+	symbol string,
+	action string,
+	accountID string,
+	volume uint64,
+	issuedShares uint64) error {
+
+	issuances, err := t.findIssuance(stub, symbol)
+	if err != nil {
+		return err
+	}
+
+	lastUpdated, err := txHandler.getCurrentTime(stub)
+	if err != nil {
+		return err
+	}
+
+	ok, err := stub.InsertRow(tableIssuanceLog, shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: symbol}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: uint64(len(issuances) + 1)}},
+			&shim.Column{Value: &shim.Column_String_{String_: action}},
+			&shim.Column{Value: &shim.Column_String_{String_: accountID}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: volume}},
+			&shim.Column{Value: &shim.Column_Uint64{Uint64: issuedShares}},
+			&shim.Column{Value: &shim.Column_String_{String_: lastUpdated}}},
+	})
+	if !ok || err != nil {
+		myLogger.Errorf("system error %v", err)
+		return errors.New("Cannot insert issuance log.")
+	}
+
+	return nil
+}
+
+// queryShareCapital reports the issued against the authorised shares of a
+// symbol with its issuance log.
+func (t *securityProfileHandler) queryShareCapital(stub shim.ChaincodeStubInterface, symbol string) ([]byte, error) {
+
+	_, authorised, issued, parValue, err := t.shareCapital(stub, symbol)
+	if err != nil {
+		return nil, err
+	}
+	issuedCapital, err := mulAmount(issued, parValue)
+	if err != nil {
+		return nil, err
+	}
+	issuances, err := t.findIssuance(stub, symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	var unissued uint64
+	if authorised > issued {
+		unissued = authorised - issued
+	}
+
+	capital := ShareCapitalMsg{
+		Symbol:           symbol,
+		AuthorisedShares: authorised,
+		IssuedShares:     issued,
+		UnissuedShares:   unissued,
+		ParValue:         formatAmount(parValue),
+		IssuedCapital:    formatAmount(issuedCapital),
+		Issuances:        issuances,
+	}
+
+	capitalJson, err := json.Marshal(capital)
+	myLogger.Debugf("Response : %s", capitalJson)
+
+	return capitalJson, nil
+}
+
+// checkPrice validates a price against the symbol's currency and tick size
+// and returns it in canonical form.
+func (t *securityProfileHandler) checkPrice(stub shim.ChaincodeStubInterface, symbol string, price string) (string, error) {
+
+	row, err := t.queryTable(stub, symbol)
+	if err != nil {
+		return "", err
+	}
+	if len(row.Columns) == 0 {
+		return "", errors.New("No security profile for " + symbol)
+	}
+	currency := row.Columns[2].GetString_()
+	tickSize := row.Columns[3].GetUint64()
+
+	amount, priceCurrency, err := parsePrice(price)
+	if err != nil {
+		return "", err
+	}
+	if priceCurrency != "" && priceCurrency != currency {
+		return "", errors.New("Price must be in " + currency)
+	}
+	if amount == 0 {
+		return "", errors.New("Price must be greater than zero")
+	}
+	if tickSize > 0 && amount%tickSize != 0 {
+		return "", errors.New("Price must be a multiple of tick size " + formatAmount(tickSize))
+	}
+
+	return formatAmount(amount), nil
+}
+
+// roundToTick rounds a price to a multiple of the symbol's tick size, up or
+// down, and never below one tick.
+func (t *securityProfileHandler) roundToTick(stub shim.ChaincodeStubInterface, symbol string, amount uint64, up bool) (uint64, error) {
+
+	row, err := t.queryTable(stub, symbol)
+	if err != nil {
+		return 0, err
+	}
+	if len(row.Columns) == 0 {
+		return 0, errors.New("No security profile for " + symbol)
+	}
+	tickSize := row.Columns[3].GetUint64()
+	if tickSize == 0 {
+		tickSize = 1
+	}
+
+	if amount%tickSize != 0 {
+		amount = amount - amount%tickSize
+		if up {
+			amount += tickSize
+		}
+	}
+	if amount == 0 {
+		amount = tickSize
+	}
+	return amount, nil
+}
+
 func (t *securityProfileHandler) queryTable(stub shim.ChaincodeStubInterface, symbol string) (shim.Row, error) {
 
 	var columns []shim.Column
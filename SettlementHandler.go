@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const (
+	REJECT_INVALID_PRICE      = "InvalidPrice"
+	REJECT_NO_CASH_ACCOUNT    = "NoCashAccount"
+	REJECT_INSUFFICIENT_CASH  = "InsufficientCash"
+	REJECT_INSUFFICIENT_SHARE = "InsufficientShare"
+	REJECT_TERMSHEET          = "TermSheetViolation"
+	REJECT_SYSTEM             = "SystemError"
+
+	stateSettlementCycle     = "SettlementCycle"
+	DEFAULT_SETTLEMENT_CYCLE = 2 // T+2
+)
+
+type settlementHandler struct {
+}
+
+// SettlementRejection is returned when a trade cannot be settled. Its error
+// text is the JSON form of the struct so callers get a machine readable reason.
+type SettlementRejection struct {
+	TransactionID uint64
+	Code          string
+	Reason        string
+}
+
+func (r *SettlementRejection) Error() string {
+	msg, err := json.Marshal(r)
+	if err != nil {
+		return r.Code + ": " + r.Reason
+	}
+	return string(msg)
+}
+
+// dueQueue orders due trades so the oldest transaction settles first.
+type dueQueue []TransactionMsg
+
+func (q dueQueue) Len() int           { return len(q) }
+func (q dueQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q dueQueue) Less(i, j int) bool { return q[i].TransactionID < q[j].TransactionID }
+
+//
+func NewSettlementHandler() *settlementHandler {
+	return &settlementHandler{}
+}
+
+func (t *settlementHandler) reject(txMsg *TransactionMsg, code string, reason string) error {
+	myLogger.Infof("settlement rejected tx[%v] %v : %v", txMsg.TransactionID, code, reason)
+	return &SettlementRejection{txMsg.TransactionID, code, reason}
+}
+
+// notional is the cash value of the trade, price times volume, in minor
+// currency units.
+func (t *settlementHandler) notional(txMsg *TransactionMsg) (uint64, error) {
+	price, _, err := parsePrice(txMsg.Price)
+	if err != nil {
+		return 0, errors.New("Unable to parse Price " + txMsg.Price)
+	}
+	return mulAmount(price, txMsg.Volume)
+}
+
+// validate checks every precondition of the trade without writing to the
+// ledger and returns the cash amount the buyer has to pay for the shares and
+// the fees both sides owe. sharesReserved and cashHeld tell whether the
+// seller's shares and the buyer's cash for this trade are already set aside;
+// only the trade value is ever held, fees are paid from available cash.
+func (t *settlementHandler) validate(stub shim.ChaincodeStubInterface, txMsg *TransactionMsg, sharesReserved bool, cashHeld bool) (uint64, []FeeMsg, error) {
+
+	amount, err := t.notional(txMsg)
+	if err != nil {
+		return 0, nil, t.reject(txMsg, REJECT_INVALID_PRICE, err.Error())
+	}
+
+	fees, err := feeHandler.compute(stub, txMsg, amount)
+	if err != nil {
+		return 0, nil, t.reject(txMsg, REJECT_SYSTEM, err.Error())
+	}
+
+	buyerCash, err := actMonHandler.queryAvailable(stub, txMsg.BuyerID)
+	if err != nil {
+		return 0, nil, t.reject(txMsg, REJECT_NO_CASH_ACCOUNT, "No money account for buyer "+txMsg.BuyerID)
+	}
+	sellerCash, err := actMonHandler.queryAvailable(stub, txMsg.SellerID)
+	if err != nil {
+		return 0, nil, t.reject(txMsg, REJECT_NO_CASH_ACCOUNT, "No money account for seller "+txMsg.SellerID)
+	}
+	if cashHeld {
+		buyerCash = buyerCash + amount
+	}
+	if buyerCash < amount+feeHandler.total(fees, txMsg.BuyerID) {
+		return 0, nil, t.reject(txMsg, REJECT_INSUFFICIENT_CASH,
+			"Buyer has "+formatAmount(buyerCash)+", needs "+formatAmount(amount+feeHandler.total(fees, txMsg.BuyerID)))
+	}
+	if sellerCash+amount < feeHandler.total(fees, txMsg.SellerID) {
+		return 0, nil, t.reject(txMsg, REJECT_INSUFFICIENT_CASH,
+			"Seller cannot pay fees of "+formatAmount(feeHandler.total(fees, txMsg.SellerID)))
+	}
+
+	sellerShare, err := actBalHandler.getAvailableBalance(stub, txMsg.SellerID, txMsg.Symbol)
+	if err != nil {
+		return 0, nil, t.reject(txMsg, REJECT_SYSTEM, err.Error())
+	}
+	if sharesReserved {
+		sellerShare = sellerShare + txMsg.Volume
+	}
+	if sellerShare < txMsg.Volume {
+		return 0, nil, t.reject(txMsg, REJECT_INSUFFICIENT_SHARE,
+			"Seller has "+strconv.FormatUint(sellerShare, 10)+", needs "+strconv.FormatUint(txMsg.Volume, 10))
+	}
+
+	noOfHolderAllowed, err := secProHandler.getMaxNumberHolder(stub, txMsg.Symbol)
+	if err != nil {
+		return 0, nil, t.reject(txMsg, REJECT_TERMSHEET, "No security profile for "+txMsg.Symbol)
+	}
+	myLogger.Debugf("noOfHolderAllowed [%v]", noOfHolderAllowed)
+	ok, err := actBalHandler.validateOverTermSheetRules(stub, txMsg.SellerID, txMsg.BuyerID, txMsg.Symbol, txMsg.Volume, noOfHolderAllowed)
+	if err != nil {
+		return 0, nil, t.reject(txMsg, REJECT_SYSTEM, err.Error())
+	}
+	if !ok {
+		return 0, nil, t.reject(txMsg, REJECT_TERMSHEET, "Not pass termsheet validation")
+	}
+
+	return amount, fees, nil
+}
+
+// settle validates the trade and then moves the cash and share legs. Nothing
+// is written unless every check passes, and an error from either leg is
+// returned so the whole invocation is rolled back.
+func (t *settlementHandler) settle(stub shim.ChaincodeStubInterface, txMsg *TransactionMsg, sharesReserved bool, cashHeld bool) error {
+	myLogger.Debugf("settle tx[%v]", txMsg.TransactionID)
+
+	amount, fees, err := t.validate(stub, txMsg, sharesReserved, cashHeld)
+	if err != nil {
+		return err
+	}
+
+	if cashHeld {
+		err = actMonHandler.releaseHold(stub, txMsg.BuyerID, amount)
+		if err != nil {
+			return t.reject(txMsg, REJECT_SYSTEM, err.Error())
+		}
+	}
+
+	if sharesReserved {
+		err = actBalHandler.release(stub, txMsg.SellerID, txMsg.Symbol, txMsg.Volume)
+		if err != nil {
+			return t.reject(txMsg, REJECT_SYSTEM, err.Error())
+		}
+	}
+
+	err = actMonHandler.transfer(stub, txMsg.BuyerID, txMsg.SellerID, amount)
+	if err != nil {
+		return t.reject(txMsg, REJECT_SYSTEM, err.Error())
+	}
+
+	err = actBalHandler.transferAccountBalance(stub, txMsg.SellerID, txMsg.BuyerID, txMsg.Symbol, txMsg.Volume)
+	if err != nil {
+		return t.reject(txMsg, REJECT_SYSTEM, err.Error())
+	}
+
+	err = feeHandler.charge(stub, fees)
+	if err != nil {
+		return t.reject(txMsg, REJECT_SYSTEM, err.Error())
+	}
+	txMsg.Fees = fees
+
+	return nil
+}
+
+// validateLegs validates every leg of a trade between the same two parties
+// and checks both sides' cash against the total of all legs and their fees.
+// It returns the total value of the legs.
+func (t *settlementHandler) validateLegs(stub shim.ChaincodeStubInterface, txMsg *TransactionMsg, legs []BasketLegMsg, sharesReserved bool, cashHeld bool) (uint64, error) {
+
+	if len(legs) == 0 {
+		return 0, t.reject(txMsg, REJECT_SYSTEM, "Transaction has no legs")
+	}
+
+	var total, buyerFee, sellerFee uint64
+	for _, leg := range legs {
+		amount, fees, err := t.validate(stub, txHandler.legMsg(txMsg, leg), sharesReserved, cashHeld)
+		if err != nil {
+			return 0, err
+		}
+		total, err = addAmount(total, amount)
+		if err != nil {
+			return 0, t.reject(txMsg, REJECT_INVALID_PRICE, err.Error())
+		}
+		buyerFee += feeHandler.total(fees, txMsg.BuyerID)
+		sellerFee += feeHandler.total(fees, txMsg.SellerID)
+	}
+
+	buyerCash, err := actMonHandler.queryAvailable(stub, txMsg.BuyerID)
+	if err != nil {
+		return 0, t.reject(txMsg, REJECT_NO_CASH_ACCOUNT, "No money account for buyer "+txMsg.BuyerID)
+	}
+	if cashHeld {
+		buyerCash = buyerCash + total
+	}
+	if buyerCash < total+buyerFee {
+		return 0, t.reject(txMsg, REJECT_INSUFFICIENT_CASH,
+			"Buyer has "+formatAmount(buyerCash)+", needs "+formatAmount(total+buyerFee))
+	}
+	sellerCash, err := actMonHandler.queryAvailable(stub, txMsg.SellerID)
+	if err != nil {
+		return 0, t.reject(txMsg, REJECT_NO_CASH_ACCOUNT, "No money account for seller "+txMsg.SellerID)
+	}
+	if sellerCash+total < sellerFee {
+		return 0, t.reject(txMsg, REJECT_INSUFFICIENT_CASH,
+			"Seller cannot pay fees of "+formatAmount(sellerFee))
+	}
+
+	return total, nil
+}
+
+// settleLegs settles every leg of a trade. All legs are validated before
+// any of them is settled, so a failing leg fails the whole trade.
+func (t *settlementHandler) settleLegs(stub shim.ChaincodeStubInterface, txMsg *TransactionMsg, legs []BasketLegMsg, sharesReserved bool, cashHeld bool) error {
+	myLogger.Debugf("settle tx[%v] legs[%v]", txMsg.TransactionID, len(legs))
+
+	_, err := t.validateLegs(stub, txMsg, legs, sharesReserved, cashHeld)
+	if err != nil {
+		return err
+	}
+
+	txMsg.Fees = nil
+	for _, leg := range legs {
+		legMsg := txHandler.legMsg(txMsg, leg)
+		err = t.settle(stub, legMsg, sharesReserved, cashHeld)
+		if err != nil {
+			return err
+		}
+		txMsg.Fees = append(txMsg.Fees, legMsg.Fees...)
+	}
+
+	return nil
+}
+
+func (t *settlementHandler) getSettlementCycle(stub shim.ChaincodeStubInterface) (uint64, error) {
+	tmpbytes, err := stub.GetState(stateSettlementCycle)
+	if err != nil {
+		myLogger.Errorf("system error %v", err)
+		return 0, errors.New("Cannot get settlement cycle.")
+	}
+	if tmpbytes == nil {
+		return DEFAULT_SETTLEMENT_CYCLE, nil
+	}
+	return strconv.ParseUint(string(tmpbytes), 10, 64)
+}
+
+// setSettlementCycle sets N, in calendar days, for trades confirmed from now
+// on. Trades already in clearing keep their settlement date.
+func (t *settlementHandler) setSettlementCycle(stub shim.ChaincodeStubInterface, days uint64) error {
+	return stub.PutState(stateSettlementCycle, []byte(strconv.FormatUint(days, 10)))
+}
+
+// clear is the first stage of a confirmed trade. It validates the trade,
+// reserves the seller's shares and holds the buyer's cash, and leaves it in
+// STATUS_CLEARING until its settlement date, T+N calendar days.
+func (t *settlementHandler) clear(stub shim.ChaincodeStubInterface, txMsg *TransactionMsg, sharesReserved bool, cashHeld bool) error {
+	myLogger.Debugf("clear tx[%v]", txMsg.TransactionID)
+
+	legs, err := txHandler.findLegsOf(stub, txMsg)
+	if err != nil {
+		return err
+	}
+
+	total, err := t.validateLegs(stub, txMsg, legs, sharesReserved, cashHeld)
+	if err != nil {
+		return err
+	}
+
+	if !cashHeld {
+		err = actMonHandler.hold(stub, txMsg.BuyerID, total)
+		if err != nil {
+			return t.reject(txMsg, REJECT_SYSTEM, err.Error())
+		}
+	}
+
+	if !sharesReserved {
+		for _, leg := range legs {
+			err = actBalHandler.reserve(stub, txMsg.SellerID, leg.Symbol, leg.Volume)
+			if err != nil {
+				return t.reject(txMsg, REJECT_SYSTEM, err.Error())
+			}
+		}
+	}
+
+	days, err := t.getSettlementCycle(stub)
+	if err != nil {
+		return err
+	}
+	now, err := ledgerClock.Now(stub)
+	if err != nil {
+		return err
+	}
+
+	txMsg.Status = STATUS_CLEARING
+	txMsg.SettlementDate = formatTime(now.Add(time.Duration(days) * 24 * time.Hour))
+	return txHandler.update(stub, txMsg)
+}
+
+// fail marks a cleared trade STATUS_SETTLE_FAILED and gives back the
+// reserved shares and held cash.
+func (t *settlementHandler) fail(stub shim.ChaincodeStubInterface, txMsg *TransactionMsg, legs []BasketLegMsg) error {
+
+	var total uint64
+	for _, leg := range legs {
+		amount, err := t.notional(txHandler.legMsg(txMsg, leg))
+		if err != nil {
+			return err
+		}
+		total, err = addAmount(total, amount)
+		if err != nil {
+			return err
+		}
+
+		err = actBalHandler.release(stub, txMsg.SellerID, leg.Symbol, leg.Volume)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := actMonHandler.releaseHold(stub, txMsg.BuyerID, total)
+	if err != nil {
+		return err
+	}
+
+	return txHandler.updateStatus(stub, txMsg.TransactionID, STATUS_SETTLE_FAILED)
+}
+
+// settleDue is the second stage: it settles every cleared trade whose
+// settlement date has arrived. A trade that no longer passes validation is
+// failed and its reservations released; the other trades still settle.
+func (t *settlementHandler) settleDue(stub shim.ChaincodeStubInterface) error {
+
+	txMsgs, err := txHandler.findDueTransaction(stub)
+	if err != nil {
+		return err
+	}
+	sort.Sort(dueQueue(txMsgs))
+
+	for i := range txMsgs {
+		txMsg := &txMsgs[i]
+		myLogger.Debugf("settle due transaction [%v]", txMsg.TransactionID)
+
+		legs, err := txHandler.findLegsOf(stub, txMsg)
+		if err != nil {
+			return err
+		}
+
+		_, err = t.validateLegs(stub, txMsg, legs, true, true)
+		if _, rejected := err.(*SettlementRejection); rejected {
+			err = t.fail(stub, txMsg, legs)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		err = t.settleLegs(stub, txMsg, legs, true, true)
+		if err != nil {
+			return err
+		}
+
+		err = txHandler.updateStatus(stub, txMsg.TransactionID, STATUS_CONFIRMED)
+		if err != nil {
+			return err
+		}
+
+		err = feeHandler.record(stub, txMsg.TransactionID, txMsg.Fees)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reverse undoes a settled trade with a compensating TXTYPE_REVERSAL entry
+// that moves every leg back from the buyer to the seller at the original
+// price and refunds the fees charged on it. It is refused, like any other
+// trade, when the buyer no longer holds the shares or the seller the cash.
+func (t *settlementHandler) reverse(stub shim.ChaincodeStubInterface, txMsg *TransactionMsg, reasonCode string) (uint64, error) {
+	myLogger.Debugf("reverse tx[%v] reason[%v]", txMsg.TransactionID, reasonCode)
+
+	legs, err := txHandler.findLegsOf(stub, txMsg)
+	if err != nil {
+		return 0, err
+	}
+
+	revMsg := TransactionMsg{
+		Symbol:     txMsg.Symbol,
+		BuyerID:    txMsg.SellerID,
+		SellerID:   txMsg.BuyerID,
+		Price:      txMsg.Price,
+		Volume:     txMsg.Volume,
+		Status:     STATUS_CONFIRMED,
+		TxType:     TXTYPE_REVERSAL,
+		LinkedTxID: txMsg.TransactionID,
+		ReasonCode: reasonCode,
+	}
+	revID, err := txHandler.insertMsg(stub, &revMsg)
+	if err != nil {
+		return 0, err
+	}
+
+	if txMsg.TxType == TXTYPE_BASKET {
+		err = txHandler.insertLegs(stub, revID, legs)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = t.settleLegs(stub, &revMsg, legs, false, false)
+	if err != nil {
+		return 0, err
+	}
+
+	fees, err := feeHandler.find(stub, txMsg.TransactionID)
+	if err != nil {
+		return 0, err
+	}
+	revMsg.Fees = feeHandler.refund(fees)
+	err = feeHandler.charge(stub, revMsg.Fees)
+	if err != nil {
+		return 0, err
+	}
+	err = feeHandler.record(stub, revID, revMsg.Fees)
+	if err != nil {
+		return 0, err
+	}
+
+	txMsg.Status = STATUS_REVERSED
+	txMsg.LinkedTxID = revID
+	return revID, txHandler.update(stub, txMsg)
+}
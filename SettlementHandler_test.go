@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSettleDue(t *testing.T) {
+	defer restoreClock()
+
+	tests := []struct {
+		name        string
+		cycle       string
+		buyerFee    bool // a buy side fee the buyer cannot pay is set after clearing
+		advance     time.Duration
+		wantStatus  string
+		wantShares  uint64 // bought by investor01
+		wantBuyer   uint64 // investor01's money
+		wantSeller  uint64 // owner01's money
+		wantHeld    uint64 // investor01's cash still held
+		wantReserve uint64 // owner01's shares still reserved
+	}{
+		{"before the settlement date", "2", false, 47 * time.Hour, STATUS_CLEARING, 0, 1000000, 0, 1000000, 100},
+		{"on the settlement date", "2", false, 48 * time.Hour, STATUS_CONFIRMED, 100, 0, 1000000, 0, 0},
+		{"same day", "0", false, 0, STATUS_CONFIRMED, 100, 0, 1000000, 0, 0},
+		{"buyer cannot pay the fee", "2", true, 48 * time.Hour, STATUS_SETTLE_FAILED, 0, 1000000, 0, 0, 0},
+	}
+
+	for _, tc := range tests {
+		stub := newTestStub(t)
+		stub.as("tsd01", ROLE_TSD).mustInvoke("setSettlementCycle", tc.cycle)
+
+		// investor01 spends all of its 10000.00 on the trade
+		stub.as("owner01", ROLE_ISSUER).mustInvoke("sell", "Ookbee", "investor01", "100", "100")
+		stub.as("investor01", ROLE_TRADER).mustInvoke("confirmBuy", "1", "1")
+
+		if tc.buyerFee {
+			stub.as("bot01", ROLE_BOT).mustInvoke("addMoney", "fee01", "0")
+			stub.as("admin01", ROLE_ADMIN).mustInvoke("setFee", FEE_BROKERAGE, SIDE_BUY, FEE_ANY, FEE_ANY, "25", "0", "0", "fee01")
+		}
+
+		stub.clock.advance(tc.advance)
+		stub.as("bot01", ROLE_BOT).mustInvoke("settleTrades")
+
+		if txMsg := stub.transaction(1); txMsg.Status != tc.wantStatus {
+			t.Errorf("%v: status %v, want %v", tc.name, txMsg.Status, tc.wantStatus)
+		}
+		if shares, _ := stub.balance("investor01", "Ookbee"); shares != tc.wantShares {
+			t.Errorf("%v: investor01 has %v shares, want %v", tc.name, shares, tc.wantShares)
+		}
+		if _, reserved := stub.balance("owner01", "Ookbee"); reserved != tc.wantReserve {
+			t.Errorf("%v: owner01 has %v shares reserved, want %v", tc.name, reserved, tc.wantReserve)
+		}
+		if money := stub.money("investor01"); money != tc.wantBuyer {
+			t.Errorf("%v: investor01 has %v, want %v", tc.name, formatAmount(money), formatAmount(tc.wantBuyer))
+		}
+		if money := stub.money("owner01"); money != tc.wantSeller {
+			t.Errorf("%v: owner01 has %v, want %v", tc.name, formatAmount(money), formatAmount(tc.wantSeller))
+		}
+		available, _ := actMonHandler.queryAvailable(stub, "investor01")
+		if held := stub.money("investor01") - available; held != tc.wantHeld {
+			t.Errorf("%v: investor01 has %v held, want %v", tc.name, formatAmount(held), formatAmount(tc.wantHeld))
+		}
+	}
+}
+
+func TestSettleDueOrder(t *testing.T) {
+	defer restoreClock()
+
+	stub := newTestStub(t)
+	stub.as("tsd01", ROLE_TSD).mustInvoke("setSettlementCycle", "1")
+
+	// two trades due on the same day settle, one not yet due stays in clearing
+	stub.as("owner01", ROLE_ISSUER).mustInvoke("sell", "Ookbee", "investor01", "10", "5")
+	stub.as("owner01", ROLE_ISSUER).mustInvoke("sell", "Ookbee", "investor02", "10", "7")
+	stub.as("investor01", ROLE_TRADER).mustInvoke("confirmBuy", "1", "1")
+	stub.as("investor02", ROLE_TRADER).mustInvoke("confirmBuy", "2", "1")
+	stub.clock.advance(12 * time.Hour)
+	stub.as("owner01", ROLE_ISSUER).mustInvoke("sell", "Ookbee", "investor03", "10", "9")
+	stub.as("investor03", ROLE_TRADER).mustInvoke("confirmBuy", "3", "1")
+
+	stub.clock.advance(12 * time.Hour)
+	stub.as("bot01", ROLE_BOT).mustInvoke("settleTrades")
+
+	for txID, want := range map[uint64]string{1: STATUS_CONFIRMED, 2: STATUS_CONFIRMED, 3: STATUS_CLEARING} {
+		if txMsg := stub.transaction(txID); txMsg.Status != want {
+			t.Errorf("transaction %v: status %v, want %v", txID, txMsg.Status, want)
+		}
+	}
+	if _, reserved := stub.balance("owner01", "Ookbee"); reserved != 9 {
+		t.Errorf("owner01 has %v shares reserved, want 9", reserved)
+	}
+}
@@ -19,8 +19,20 @@ const (
   columnVolume        = "Volume"
   columnStatus        = "Status"
   columnLastUpdated   = "LastUpdated"
+  columnTxType        = "TxType"
+  columnLinkedTxID    = "LinkedTxID"
+  columnExpiryTime    = "ExpiryTime"
+  columnRevision      = "Revision"
+  columnSettlementDate = "SettlementDate"
+  columnReasonCode = "ReasonCode"
+
+  tableTransactionRevision = "TransactionRevision"
+
+  tableBasketLeg = "BasketLeg"
+  columnLeg      = "Leg"
 
   tableAccountIDTransaction = "AccountIDTx"
+  tableOpenOffer = "OpenOffer"
   columnAccountID           = "AccountID"
 
   stateCurrTransactionID = "CurrTransactionID"
@@ -29,6 +41,22 @@ const (
   STATUS_CONFIRMED = "Complete"
   STATUS_CANCEL_BUYER = "Cancelled By Buyer"
   STATUS_CANCEL_SELLER = "Cancelled By Seller"
+  STATUS_EXPIRED = "Expired"
+  STATUS_CLEARING = "Pending Settlement" // confirmed, shares and cash reserved until the settlement date
+  STATUS_SETTLE_FAILED = "Settlement Failed" // could not be settled on the settlement date, reservations released
+  STATUS_REVERSED = "Reversed" // undone by the tsd, LinkedTxID is the reversal
+
+  TXTYPE_OFFER = "Offer" // posted by the seller, accepted with confirmBuy
+  TXTYPE_BID   = "Bid"   // posted by the buyer, accepted with confirmSell
+  TXTYPE_MATCH = "Match" // produced by the order book matching engine
+  TXTYPE_BASKET = "Basket" // several legs offered together, Price is the total consideration
+  TXTYPE_REVERSAL = "Reversal" // compensating entry written by the tsd, LinkedTxID is the reversed trade
+
+  // reason codes a tsd gives for a reversal
+  REVERSAL_KEYING_ERROR = "KeyingError"
+  REVERSAL_DUPLICATE = "DuplicateTrade"
+  REVERSAL_WRONG_PARTY = "WrongCounterparty"
+  REVERSAL_CLIENT_REQUEST = "ClientRequest"
 )
 
 type transactionHandler struct {
@@ -43,14 +71,89 @@ type TransactionMsg struct {
   Volume uint64
   Status string
   LastUpdated string
+  TxType string
+  LinkedTxID uint64
+  ExpiryTime string
+  Revision uint64
+  SettlementDate string
+  ReasonCode string
+  Fees []FeeMsg // not a column, read from the TransactionFee table
+}
+
+type RevisionMsg struct {
+  TransactionID uint64
+  Revision uint64
+  Price string
+  Volume uint64
+  LastUpdated string
+}
+
+type BasketLegMsg struct {
+  TransactionID uint64
+  Leg uint64
+  Symbol string
+  Price string
+  Volume uint64
 }
 
 func NewTransactionHandler() *transactionHandler {
   return &transactionHandler{}
 }
 
-func (t *transactionHandler) getCurrentTime() string {
-  return time.Now().Format(time.RFC3339Nano)
+func (t *transactionHandler) toTransactionMsg(row shim.Row) TransactionMsg {
+  return TransactionMsg{
+    row.Columns[0].GetUint64(),//txId
+    row.Columns[1].GetString_(),//symbol
+    row.Columns[2].GetString_(),//buyerID
+    row.Columns[3].GetString_(),//sellerID
+    row.Columns[4].GetString_(),//price
+    row.Columns[5].GetUint64(),//volume
+    row.Columns[6].GetString_(),//status
+    row.Columns[7].GetString_(),//lastUpdated
+    row.Columns[8].GetString_(),//txType
+    row.Columns[9].GetUint64(),//linkedTxID
+    row.Columns[10].GetString_(),//expiryTime
+    row.Columns[11].GetUint64(),//revision
+    row.Columns[12].GetString_(),//settlementDate
+    row.Columns[13].GetString_(),//reasonCode
+    nil,//fees
+  }
+}
+
+func (t *transactionHandler) getCurrentTime(stub shim.ChaincodeStubInterface) (string, error) {
+  now, err := ledgerClock.Now(stub)
+  if err != nil {
+    return "", err
+  }
+  return formatTime(now), nil
+}
+
+// isExpired reports whether a waiting transaction has passed its expiry
+// time at now. Transactions without an expiry never expire.
+func (t *transactionHandler) isExpired(txMsg *TransactionMsg, now time.Time) bool {
+  if txMsg.Status != STATUS_WAITING || txMsg.ExpiryTime == "" {
+    return false
+  }
+  expiry, err := time.Parse(time.RFC3339Nano, txMsg.ExpiryTime)
+  if err != nil {
+    myLogger.Errorf("system error %v", err)
+    return false
+  }
+  return !now.Before(expiry)
+}
+
+// isDue reports whether a cleared transaction has reached its settlement
+// date at now.
+func (t *transactionHandler) isDue(txMsg *TransactionMsg, now time.Time) bool {
+  if txMsg.Status != STATUS_CLEARING {
+    return false
+  }
+  settlementDate, err := time.Parse(time.RFC3339Nano, txMsg.SettlementDate)
+  if err != nil {
+    myLogger.Errorf("system error %v", err)
+    return false
+  }
+  return !now.Before(settlementDate)
 }
 
 func (t *transactionHandler) createTable(stub shim.ChaincodeStubInterface) error {
@@ -64,6 +167,30 @@ func (t *transactionHandler) createTable(stub shim.ChaincodeStubInterface) error
     &shim.ColumnDefinition{Name: columnVolume, Type: shim.ColumnDefinition_UINT64, Key: false},
     &shim.ColumnDefinition{Name: columnStatus, Type: shim.ColumnDefinition_STRING, Key: false},
     &shim.ColumnDefinition{Name: columnLastUpdated, Type: shim.ColumnDefinition_STRING, Key: false},
+    &shim.ColumnDefinition{Name: columnTxType, Type: shim.ColumnDefinition_STRING, Key: false},
+    &shim.ColumnDefinition{Name: columnLinkedTxID, Type: shim.ColumnDefinition_UINT64, Key: false},
+    &shim.ColumnDefinition{Name: columnExpiryTime, Type: shim.ColumnDefinition_STRING, Key: false},
+    &shim.ColumnDefinition{Name: columnRevision, Type: shim.ColumnDefinition_UINT64, Key: false},
+    &shim.ColumnDefinition{Name: columnSettlementDate, Type: shim.ColumnDefinition_STRING, Key: false},
+    &shim.ColumnDefinition{Name: columnReasonCode, Type: shim.ColumnDefinition_STRING, Key: false},
+  })
+
+  // superseded terms of amended transactions
+  stub.CreateTable(tableTransactionRevision, []*shim.ColumnDefinition{
+    &shim.ColumnDefinition{Name: columnTransactionID, Type: shim.ColumnDefinition_UINT64, Key: true},
+    &shim.ColumnDefinition{Name: columnRevision, Type: shim.ColumnDefinition_UINT64, Key: true},
+    &shim.ColumnDefinition{Name: columnPrice, Type: shim.ColumnDefinition_STRING, Key: false},
+    &shim.ColumnDefinition{Name: columnVolume, Type: shim.ColumnDefinition_UINT64, Key: false},
+    &shim.ColumnDefinition{Name: columnLastUpdated, Type: shim.ColumnDefinition_STRING, Key: false},
+  })
+
+  // symbol legs of basket transactions
+  stub.CreateTable(tableBasketLeg, []*shim.ColumnDefinition{
+    &shim.ColumnDefinition{Name: columnTransactionID, Type: shim.ColumnDefinition_UINT64, Key: true},
+    &shim.ColumnDefinition{Name: columnLeg, Type: shim.ColumnDefinition_UINT64, Key: true},
+    &shim.ColumnDefinition{Name: columnSymbol, Type: shim.ColumnDefinition_STRING, Key: false},
+    &shim.ColumnDefinition{Name: columnPrice, Type: shim.ColumnDefinition_STRING, Key: false},
+    &shim.ColumnDefinition{Name: columnVolume, Type: shim.ColumnDefinition_UINT64, Key: false},
   })
 
   stub.CreateTable(tableAccountIDTransaction, []*shim.ColumnDefinition{
@@ -72,9 +199,36 @@ func (t *transactionHandler) createTable(stub shim.ChaincodeStubInterface) error
     &shim.ColumnDefinition{Name: columnTransactionID, Type: shim.ColumnDefinition_UINT64, Key: true},
   })
 
+  // waiting offers without a named buyer, by symbol
+  stub.CreateTable(tableOpenOffer, []*shim.ColumnDefinition{
+    &shim.ColumnDefinition{Name: columnSymbol, Type: shim.ColumnDefinition_STRING, Key: true},
+    &shim.ColumnDefinition{Name: columnTransactionID, Type: shim.ColumnDefinition_UINT64, Key: true},
+  })
+
   return nil
 }
 
+func (t *transactionHandler) toRow(txMsg *TransactionMsg) shim.Row {
+  return shim.Row{
+    Columns: []*shim.Column{
+      &shim.Column{Value: &shim.Column_Uint64{Uint64: txMsg.TransactionID}},
+      &shim.Column{Value: &shim.Column_String_{String_: txMsg.Symbol}},
+      &shim.Column{Value: &shim.Column_String_{String_: txMsg.BuyerID}},
+      &shim.Column{Value: &shim.Column_String_{String_: txMsg.SellerID}},
+      // &shim.Column{Value: &shim.Column_Bytes{Bytes: price}},
+      &shim.Column{Value: &shim.Column_String_{String_: txMsg.Price}},
+      &shim.Column{Value: &shim.Column_Uint64{Uint64: txMsg.Volume}},
+      &shim.Column{Value: &shim.Column_String_{String_: txMsg.Status}},
+      &shim.Column{Value: &shim.Column_String_{String_: txMsg.LastUpdated}},
+      &shim.Column{Value: &shim.Column_String_{String_: txMsg.TxType}},
+      &shim.Column{Value: &shim.Column_Uint64{Uint64: txMsg.LinkedTxID}},
+      &shim.Column{Value: &shim.Column_String_{String_: txMsg.ExpiryTime}},
+      &shim.Column{Value: &shim.Column_Uint64{Uint64: txMsg.Revision}},
+      &shim.Column{Value: &shim.Column_String_{String_: txMsg.SettlementDate}},
+      &shim.Column{Value: &shim.Column_String_{String_: txMsg.ReasonCode}}},
+  }
+}
+
 func (t *transactionHandler) insert(stub shim.ChaincodeStubInterface,
   symbol string,
   buyerID string,
@@ -82,7 +236,25 @@ func (t *transactionHandler) insert(stub shim.ChaincodeStubInterface,
   price string,
   // price []byte,
   volume uint64,
-  status string) error {
+  status string,
+  txType string) (uint64, error) {
+
+  txMsg := TransactionMsg{
+    Symbol: symbol,
+    BuyerID: buyerID,
+    SellerID: sellerID,
+    Price: price,
+    Volume: volume,
+    Status: status,
+    TxType: txType,
+  }
+  return t.insertMsg(stub, &txMsg)
+}
+
+// insertMsg assigns the next TransactionID to txMsg, writes it and indexes
+// it under both counterparties. An offer without a BuyerID is indexed as an
+// open offer instead until a buyer takes it.
+func (t *transactionHandler) insertMsg(stub shim.ChaincodeStubInterface, txMsg *TransactionMsg) (uint64, error) {
 
   var tmpTxID int
   var txID uint64
@@ -99,46 +271,124 @@ func (t *transactionHandler) insert(stub shim.ChaincodeStubInterface,
 
   myLogger.Debugf("insert transactionID= %v", txID)
 
-  ok, err := stub.InsertRow(tableTransaction, shim.Row{
-    Columns: []*shim.Column{
-      &shim.Column{Value: &shim.Column_Uint64{Uint64: txID}},
-      &shim.Column{Value: &shim.Column_String_{String_: symbol}},
-      &shim.Column{Value: &shim.Column_String_{String_: buyerID}},
-      &shim.Column{Value: &shim.Column_String_{String_: sellerID}},
-      // &shim.Column{Value: &shim.Column_Bytes{Bytes: price}},
-      &shim.Column{Value: &shim.Column_String_{String_: price}},
-      &shim.Column{Value: &shim.Column_Uint64{Uint64: volume}},
-      &shim.Column{Value: &shim.Column_String_{String_: status}},
-      &shim.Column{Value: &shim.Column_String_{String_: t.getCurrentTime()}}},
-  })
+  txMsg.TransactionID = txID
+  if txMsg.Revision == 0 {
+    txMsg.Revision = 1
+  }
+  txMsg.LastUpdated, err = t.getCurrentTime(stub)
+  if err != nil {
+    return 0, err
+  }
+  ok, err := stub.InsertRow(tableTransaction, t.toRow(txMsg))
 
   if !ok && err == nil {
     myLogger.Errorf("system error %v", err)
-    return errors.New("Cannot insert transaction.")
+    return 0, errors.New("Cannot insert transaction.")
+  }
+
+  if txMsg.BuyerID != "" {
+    err = t.indexAccount(stub, txMsg.BuyerID, txMsg)
+  } else {
+    ok, err = stub.InsertRow(tableOpenOffer, shim.Row{
+      Columns: []*shim.Column{
+        &shim.Column{Value: &shim.Column_String_{String_: txMsg.Symbol}},
+        &shim.Column{Value: &shim.Column_Uint64{Uint64: txID}}},
+    })
+    if !ok && err == nil {
+      err = errors.New("Cannot insert open offer.")
+    }
+  }
+  if err != nil {
+    myLogger.Errorf("system error %v", err)
+    return 0, errors.New("Cannot insert transaction.")
   }
 
   ok, err = stub.InsertRow(tableAccountIDTransaction, shim.Row{
     Columns: []*shim.Column{
-      &shim.Column{Value: &shim.Column_String_{String_: buyerID}},
-      &shim.Column{Value: &shim.Column_String_{String_: symbol}},
+      &shim.Column{Value: &shim.Column_String_{String_: txMsg.SellerID}},
+      &shim.Column{Value: &shim.Column_String_{String_: txMsg.Symbol}},
       &shim.Column{Value: &shim.Column_Uint64{Uint64: txID}}},
   })
 
   if !ok && err == nil {
     myLogger.Errorf("system error %v", err)
-    return errors.New("Cannot insert transaction.")
+    return 0, errors.New("Cannot insert transaction.")
   }
 
-  ok, err = stub.InsertRow(tableAccountIDTransaction, shim.Row{
+  return txID, nil
+}
+
+func (t *transactionHandler) indexAccount(stub shim.ChaincodeStubInterface,
+  accountID string,
+  txMsg *TransactionMsg) error {
+
+  ok, err := stub.InsertRow(tableAccountIDTransaction, shim.Row{
     Columns: []*shim.Column{
-      &shim.Column{Value: &shim.Column_String_{String_: sellerID}},
-      &shim.Column{Value: &shim.Column_String_{String_: symbol}},
-      &shim.Column{Value: &shim.Column_Uint64{Uint64: txID}}},
+      &shim.Column{Value: &shim.Column_String_{String_: accountID}},
+      &shim.Column{Value: &shim.Column_String_{String_: txMsg.Symbol}},
+      &shim.Column{Value: &shim.Column_Uint64{Uint64: txMsg.TransactionID}}},
   })
 
   if !ok && err == nil {
+    return errors.New("Cannot insert transaction index.")
+  }
+  return err
+}
+
+// closeOpenOffer takes an offer off the open offer index.
+func (t *transactionHandler) closeOpenOffer(stub shim.ChaincodeStubInterface,
+  txMsg *TransactionMsg) error {
+
+  var columns []shim.Column
+  columns = append(columns, shim.Column{Value: &shim.Column_String_{String_: txMsg.Symbol}})
+  columns = append(columns, shim.Column{Value: &shim.Column_Uint64{Uint64: txMsg.TransactionID}})
+
+  err := stub.DeleteRow(tableOpenOffer, columns)
+  if err != nil {
+    myLogger.Errorf("system error %v", err)
+    return errors.New("Cannot remove open offer.")
+  }
+  return nil
+}
+
+// assignBuyer makes the account taking an open offer its buyer and moves the
+// offer from the open offer index to the buyer's transactions.
+func (t *transactionHandler) assignBuyer(stub shim.ChaincodeStubInterface,
+  txMsg *TransactionMsg,
+  buyerID string) error {
+
+  if txMsg.BuyerID != "" {
+    return errors.New("Offer already has a buyer")
+  }
+
+  txMsg.BuyerID = buyerID
+  err := t.update(stub, txMsg)
+  if err != nil {
+    return err
+  }
+
+  err = t.indexAccount(stub, buyerID, txMsg)
+  if err != nil {
+    myLogger.Errorf("system error %v", err)
+    return errors.New("Cannot update transaction.")
+  }
+
+  myLogger.Debugf("open offer [%v] taken by [%v]", txMsg.TransactionID, buyerID)
+  return t.closeOpenOffer(stub, txMsg)
+}
+
+func (t *transactionHandler) update(stub shim.ChaincodeStubInterface, txMsg *TransactionMsg) error {
+
+  lastUpdated, err := t.getCurrentTime(stub)
+  if err != nil {
+    return err
+  }
+  txMsg.LastUpdated = lastUpdated
+  ok, err := stub.ReplaceRow(tableTransaction, t.toRow(txMsg))
+
+  if !ok || err != nil {
     myLogger.Errorf("system error %v", err)
-    return errors.New("Cannot insert transaction.")
+    return errors.New("Cannot update transaction.")
   }
 
   return nil
@@ -148,41 +398,223 @@ func (t *transactionHandler) updateStatus(stub shim.ChaincodeStubInterface,
   txID uint64,
   status string) error {
 
-  var columnsTx []shim.Column
-  colTxId := shim.Column{Value: &shim.Column_Uint64{Uint64: txID}}
-  columnsTx = append(columnsTx, colTxId)
-  row, err := stub.GetRow(tableTransaction, columnsTx)
+  txMsg, err := t.getTransaction(stub, txID)
+  if err != nil || txMsg == nil {
+    return errors.New("Cannot update transaction.")
+  }
+
+  if txMsg.BuyerID == "" && status != STATUS_WAITING {
+    err = t.closeOpenOffer(stub, txMsg)
+    if err != nil {
+      return err
+    }
+  }
+
+  txMsg.Status = status
+  return t.update(stub, txMsg)
+}
+
+// split carves volume off a waiting transaction into a new transaction with
+// the same terms. The original keeps the remaining volume under a new
+// revision, and the two records point at each other through LinkedTxID. The
+// original always links to the most recent split taken from it.
+func (t *transactionHandler) split(stub shim.ChaincodeStubInterface,
+  txMsg *TransactionMsg,
+  volume uint64) (*TransactionMsg, error) {
+
+  if volume == 0 || volume >= txMsg.Volume {
+    return nil, errors.New("Invalid volume")
+  }
 
+  part := *txMsg
+  part.Volume = volume
+  part.LinkedTxID = txMsg.TransactionID
+  part.Revision = 0
+  partID, err := t.insertMsg(stub, &part)
   if err != nil {
+    return nil, err
+  }
+
+  // whoever confirms the remainder accepts it under a revision of its own
+  txMsg.LinkedTxID = partID
+  err = t.amend(stub, txMsg, txMsg.Price, txMsg.Volume - volume)
+  if err != nil {
+    return nil, err
+  }
+
+  myLogger.Debugf("split transaction [%v] into [%v]", txMsg.TransactionID, partID)
+  return &part, nil
+}
+
+// amend archives the current terms of a transaction as a revision and
+// replaces them with the new price and volume under the next revision number.
+func (t *transactionHandler) amend(stub shim.ChaincodeStubInterface,
+  txMsg *TransactionMsg,
+  price string,
+  volume uint64) error {
+
+  ok, err := stub.InsertRow(tableTransactionRevision, shim.Row{
+    Columns: []*shim.Column{
+      &shim.Column{Value: &shim.Column_Uint64{Uint64: txMsg.TransactionID}},
+      &shim.Column{Value: &shim.Column_Uint64{Uint64: txMsg.Revision}},
+      &shim.Column{Value: &shim.Column_String_{String_: txMsg.Price}},
+      &shim.Column{Value: &shim.Column_Uint64{Uint64: txMsg.Volume}},
+      &shim.Column{Value: &shim.Column_String_{String_: txMsg.LastUpdated}}},
+  })
+
+  if !ok || err != nil {
     myLogger.Errorf("system error %v", err)
-    return errors.New("Cannot update transaction.")
+    return errors.New("Cannot archive transaction revision.")
   }
 
-  if len(row.Columns) == 0 {
-		return errors.New("Cannot update transaction.")
-	}
+  txMsg.Price = price
+  txMsg.Volume = volume
+  txMsg.Revision++
 
-  ok, err := stub.ReplaceRow(tableTransaction, shim.Row{
-		Columns: []*shim.Column{
-      &shim.Column{Value: &shim.Column_Uint64{Uint64: txID}},
-      &shim.Column{Value: &shim.Column_String_{String_: row.Columns[1].GetString_()}},//symbol
-      &shim.Column{Value: &shim.Column_String_{String_: row.Columns[2].GetString_()}},//buyerID
-      &shim.Column{Value: &shim.Column_String_{String_: row.Columns[3].GetString_()}},//sellerID
-      // &shim.Column{Value: &shim.Column_Bytes{Bytes: price}},
-      &shim.Column{Value: &shim.Column_String_{String_: row.Columns[4].GetString_()}},//price
-      &shim.Column{Value: &shim.Column_Uint64{Uint64: row.Columns[5].GetUint64()}},//volume
-      &shim.Column{Value: &shim.Column_String_{String_: status}},//status
-      &shim.Column{Value: &shim.Column_String_{String_: t.getCurrentTime()}}},
-	})
-
-	if !ok && err == nil {
-		myLogger.Errorf("system error %v", err)
-		return errors.New("Cannot update transaction.")
-	}
+  myLogger.Debugf("amend transaction [%v] to revision [%v]", txMsg.TransactionID, txMsg.Revision)
+  return t.update(stub, txMsg)
+}
+
+// findRevision returns every revision of a transaction, oldest first, with
+// the current terms last.
+func (t *transactionHandler) findRevision(stub shim.ChaincodeStubInterface,
+  txMsg *TransactionMsg) ([]RevisionMsg, error) {
+
+  var columns []shim.Column
+  colTxId := shim.Column{Value: &shim.Column_Uint64{Uint64: txMsg.TransactionID}}
+  columns = append(columns, colTxId)
+
+  rowChannel, err := stub.GetRows(tableTransactionRevision, columns)
+  if err != nil {
+    myLogger.Errorf("system error %v", err)
+    return nil, errors.New("Cannot query transaction revision.")
+  }
+
+  revMsgs := make([]RevisionMsg, txMsg.Revision)
+
+  for {
+    select {
+    case row, ok := <-rowChannel:
+      if !ok {
+        rowChannel = nil
+      } else {
+        revision := row.Columns[1].GetUint64()
+        if revision >= 1 && revision < txMsg.Revision {
+          revMsgs[revision - 1] = RevisionMsg{
+            row.Columns[0].GetUint64(),//txId
+            revision,//revision
+            row.Columns[2].GetString_(),//price
+            row.Columns[3].GetUint64(),//volume
+            row.Columns[4].GetString_(),//lastUpdated
+          }
+        }
+      }
+    }
+    if rowChannel == nil {
+      break
+    }
+  }
+
+  revMsgs[txMsg.Revision - 1] = RevisionMsg{txMsg.TransactionID, txMsg.Revision, txMsg.Price, txMsg.Volume, txMsg.LastUpdated}
+
+  return revMsgs, nil
+}
+
+// insertLegs writes the legs of a basket transaction, numbered from 1.
+func (t *transactionHandler) insertLegs(stub shim.ChaincodeStubInterface,
+  txID uint64,
+  legs []BasketLegMsg) error {
+
+  for i := range legs {
+    legs[i].TransactionID = txID
+    legs[i].Leg = uint64(i + 1)
+
+    ok, err := stub.InsertRow(tableBasketLeg, shim.Row{
+      Columns: []*shim.Column{
+        &shim.Column{Value: &shim.Column_Uint64{Uint64: legs[i].TransactionID}},
+        &shim.Column{Value: &shim.Column_Uint64{Uint64: legs[i].Leg}},
+        &shim.Column{Value: &shim.Column_String_{String_: legs[i].Symbol}},
+        &shim.Column{Value: &shim.Column_String_{String_: legs[i].Price}},
+        &shim.Column{Value: &shim.Column_Uint64{Uint64: legs[i].Volume}}},
+    })
+
+    if !ok || err != nil {
+      myLogger.Errorf("system error %v", err)
+      return errors.New("Cannot insert basket leg.")
+    }
+  }
 
   return nil
 }
 
+// findLegs returns the legs of a basket transaction in leg order.
+func (t *transactionHandler) findLegs(stub shim.ChaincodeStubInterface,
+  txID uint64) ([]BasketLegMsg, error) {
+
+  var columns []shim.Column
+  colTxId := shim.Column{Value: &shim.Column_Uint64{Uint64: txID}}
+  columns = append(columns, colTxId)
+
+  rowChannel, err := stub.GetRows(tableBasketLeg, columns)
+  if err != nil {
+    myLogger.Errorf("system error %v", err)
+    return nil, errors.New("Cannot query basket leg.")
+  }
+
+  var legs []BasketLegMsg
+
+  for {
+    select {
+    case row, ok := <-rowChannel:
+      if !ok {
+        rowChannel = nil
+      } else {
+        legs = append(legs, BasketLegMsg{
+          row.Columns[0].GetUint64(),//txId
+          row.Columns[1].GetUint64(),//leg
+          row.Columns[2].GetString_(),//symbol
+          row.Columns[3].GetString_(),//price
+          row.Columns[4].GetUint64(),//volume
+        })
+      }
+    }
+    if rowChannel == nil {
+      break
+    }
+  }
+
+  ordered := make([]BasketLegMsg, len(legs))
+  for _, leg := range legs {
+    if leg.Leg < 1 || leg.Leg > uint64(len(legs)) {
+      return nil, errors.New("Invalid basket leg")
+    }
+    ordered[leg.Leg - 1] = leg
+  }
+
+  return ordered, nil
+}
+
+// findLegsOf returns the legs of a basket, or of the reversal of one, and
+// the transaction itself as a single leg for any other transaction.
+func (t *transactionHandler) findLegsOf(stub shim.ChaincodeStubInterface,
+  txMsg *TransactionMsg) ([]BasketLegMsg, error) {
+
+  legs, err := t.findLegs(stub, txMsg.TransactionID)
+  if err != nil || len(legs) > 0 {
+    return legs, err
+  }
+  return []BasketLegMsg{BasketLegMsg{txMsg.TransactionID, 1, txMsg.Symbol, txMsg.Price, txMsg.Volume}}, nil
+}
+
+// legMsg is the single-symbol trade one basket leg stands for.
+func (t *transactionHandler) legMsg(txMsg *TransactionMsg, leg BasketLegMsg) *TransactionMsg {
+  legMsg := *txMsg
+  legMsg.Symbol = leg.Symbol
+  legMsg.Price = leg.Price
+  legMsg.Volume = leg.Volume
+  return &legMsg
+}
+
 func (t *transactionHandler) getTransaction(stub shim.ChaincodeStubInterface,
   txID uint64) (*TransactionMsg, error) {
 
@@ -200,15 +632,10 @@ func (t *transactionHandler) getTransaction(stub shim.ChaincodeStubInterface,
 		return nil, nil
 	}
 
-  txMsg := TransactionMsg{
-    row.Columns[0].GetUint64(),//txId
-    row.Columns[1].GetString_(),//symbol
-    row.Columns[2].GetString_(),//buyerID
-    row.Columns[3].GetString_(),//sellerID
-    row.Columns[4].GetString_(),//price
-    row.Columns[5].GetUint64(),//volume
-    row.Columns[6].GetString_(),//status
-    row.Columns[7].GetString_(),//lastUpdated
+  txMsg := t.toTransactionMsg(row)
+  txMsg.Fees, err = feeHandler.find(stub, txMsg.TransactionID)
+  if err != nil {
+    return nil, err
   }
 
   return &txMsg, nil
@@ -245,15 +672,10 @@ func (t *transactionHandler) findTransactionByAccountID(stub shim.ChaincodeStubI
           return nil, errors.New("Cannot query transaction.")
         }
 
-        txMsg := TransactionMsg{
-          rowTx.Columns[0].GetUint64(),//txId
-          rowTx.Columns[1].GetString_(),//symbol
-          rowTx.Columns[2].GetString_(),//buyerID
-          rowTx.Columns[3].GetString_(),//sellerID
-          rowTx.Columns[4].GetString_(),//price
-          rowTx.Columns[5].GetUint64(),//volume
-          rowTx.Columns[6].GetString_(),//status
-          rowTx.Columns[7].GetString_(),//lastUpdated
+        txMsg := t.toTransactionMsg(rowTx)
+        txMsg.Fees, err = feeHandler.find(stub, txMsg.TransactionID)
+        if err != nil {
+          return nil, err
         }
         txMsgs = append(txMsgs, txMsg)
 
@@ -302,15 +724,10 @@ func (t *transactionHandler) findTransactionByAccountIDSymbol(stub shim.Chaincod
           return nil, errors.New("Cannot query transaction.")
         }
 
-        txMsg := TransactionMsg{
-          rowTx.Columns[0].GetUint64(),//txId
-          rowTx.Columns[1].GetString_(),//symbol
-          rowTx.Columns[2].GetString_(),//buyerID
-          rowTx.Columns[3].GetString_(),//sellerID
-          rowTx.Columns[4].GetString_(),//price
-          rowTx.Columns[5].GetUint64(),//volume
-          rowTx.Columns[6].GetString_(),//status
-          rowTx.Columns[7].GetString_(),//lastUpdated
+        txMsg := t.toTransactionMsg(rowTx)
+        txMsg.Fees, err = feeHandler.find(stub, txMsg.TransactionID)
+        if err != nil {
+          return nil, err
         }
         txMsgs = append(txMsgs, txMsg)
 
@@ -325,6 +742,100 @@ func (t *transactionHandler) findTransactionByAccountIDSymbol(stub shim.Chaincod
   return txMsgs, nil
 }
 
+// findOpenOffer returns the open offers of a symbol that can still be taken.
+func (t *transactionHandler) findOpenOffer(stub shim.ChaincodeStubInterface,
+  symbol string) ([]TransactionMsg, error) {
+
+  now, err := ledgerClock.Now(stub)
+  if err != nil {
+    return nil, err
+  }
+
+  var columns []shim.Column
+  colSymbol := shim.Column{Value: &shim.Column_String_{String_: symbol}}
+  columns = append(columns, colSymbol)
+
+  rowChannel, err := stub.GetRows(tableOpenOffer, columns)
+  if err != nil {
+    myLogger.Errorf("system error %v", err)
+    return nil, errors.New("Cannot query open offer.")
+  }
+
+  var txMsgs []TransactionMsg
+
+  for {
+    select {
+    case row, ok := <-rowChannel:
+      if !ok {
+        rowChannel = nil
+      } else {
+        txMsg, err := t.getTransaction(stub, row.Columns[1].GetUint64())
+        if err != nil || txMsg == nil {
+          return nil, errors.New("Cannot query transaction.")
+        }
+        if txMsg.Status == STATUS_WAITING && txMsg.BuyerID == "" && !t.isExpired(txMsg, now) {
+          txMsgs = append(txMsgs, *txMsg)
+        }
+      }
+    }
+    if rowChannel == nil {
+      break
+    }
+  }
+
+  return txMsgs, nil
+}
+
+// findExpiredTransaction scans every transaction for waiting offers whose
+// expiry time has passed.
+func (t *transactionHandler) findExpiredTransaction(stub shim.ChaincodeStubInterface) ([]TransactionMsg, error) {
+  return t.findTransactionAt(stub, t.isExpired)
+}
+
+func (t *transactionHandler) findDueTransaction(stub shim.ChaincodeStubInterface) ([]TransactionMsg, error) {
+  return t.findTransactionAt(stub, t.isDue)
+}
+
+// findTransactionAt scans every transaction and returns those for which
+// match holds at the current ledger time.
+func (t *transactionHandler) findTransactionAt(stub shim.ChaincodeStubInterface,
+  match func(txMsg *TransactionMsg, now time.Time) bool) ([]TransactionMsg, error) {
+
+  now, err := ledgerClock.Now(stub)
+  if err != nil {
+    return nil, err
+  }
+
+  var columns []shim.Column
+
+  rowChannel, err := stub.GetRows(tableTransaction, columns)
+  if err != nil {
+    myLogger.Errorf("system error %v", err)
+    return nil, errors.New("Cannot query transaction.")
+  }
+
+  var txMsgs []TransactionMsg
+
+  for {
+    select {
+    case row, ok := <-rowChannel:
+      if !ok {
+        rowChannel = nil
+      } else {
+        txMsg := t.toTransactionMsg(row)
+        if match(&txMsg, now) {
+          txMsgs = append(txMsgs, txMsg)
+        }
+      }
+    }
+    if rowChannel == nil {
+      break
+    }
+  }
+
+  return txMsgs, nil
+}
+
 func (t *transactionHandler) query(stub shim.ChaincodeStubInterface,
   accountid string) ([]byte, error) {
 
@@ -356,15 +867,10 @@ func (t *transactionHandler) query(stub shim.ChaincodeStubInterface,
           return nil, errors.New("Cannot query transaction.")
         }
 
-        txMsg := TransactionMsg{
-          rowTx.Columns[0].GetUint64(),//txId
-          rowTx.Columns[1].GetString_(),//symbol
-          rowTx.Columns[2].GetString_(),//buyerID
-          rowTx.Columns[3].GetString_(),//sellerID
-          rowTx.Columns[4].GetString_(),//price
-          rowTx.Columns[5].GetUint64(),//volume
-          rowTx.Columns[6].GetString_(),//status
-          rowTx.Columns[7].GetString_(),//lastUpdated
+        txMsg := t.toTransactionMsg(rowTx)
+        txMsg.Fees, err = feeHandler.find(stub, txMsg.TransactionID)
+        if err != nil {
+          return nil, err
         }
         txMsgs = append(txMsgs, txMsg)
 
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpireOffers(t *testing.T) {
+	defer restoreClock()
+
+	tests := []struct {
+		name         string
+		expiry       time.Duration // from testEpoch, 0 for an offer that never expires
+		advance      time.Duration
+		wantStatus   string
+		wantReserved uint64
+	}{
+		{"before expiry", time.Hour, 59 * time.Minute, STATUS_WAITING, 10},
+		{"at expiry", time.Hour, time.Hour, STATUS_EXPIRED, 0},
+		{"after expiry", time.Hour, 25 * time.Hour, STATUS_EXPIRED, 0},
+		{"no expiry", 0, 1000 * time.Hour, STATUS_WAITING, 10},
+	}
+
+	for _, tc := range tests {
+		stub := newTestStub(t)
+
+		args := []string{"Ookbee", "investor01", "1", "10"}
+		if tc.expiry != 0 {
+			args = append(args, formatTime(testEpoch.Add(tc.expiry)))
+		}
+		stub.as("owner01", ROLE_ISSUER).mustInvoke("sell", args...)
+
+		stub.clock.advance(tc.advance)
+		stub.as("bot01", ROLE_BOT).mustInvoke("expireOffers")
+
+		if txMsg := stub.transaction(1); txMsg.Status != tc.wantStatus {
+			t.Errorf("%v: status %v, want %v", tc.name, txMsg.Status, tc.wantStatus)
+		}
+		if _, reserved := stub.balance("owner01", "Ookbee"); reserved != tc.wantReserved {
+			t.Errorf("%v: reserved %v, want %v", tc.name, reserved, tc.wantReserved)
+		}
+	}
+}
+
+func TestConfirmExpiredOffer(t *testing.T) {
+	defer restoreClock()
+
+	stub := newTestStub(t)
+	stub.as("owner01", ROLE_ISSUER).mustInvoke("sell", "Ookbee", "investor01", "1", "10", formatTime(testEpoch.Add(time.Hour)))
+
+	// the offer cannot be taken once its expiry has passed, swept or not
+	stub.clock.advance(time.Hour)
+	if err := stub.as("investor01", ROLE_TRADER).invoke("confirmBuy", "1", "1"); err == nil {
+		t.Errorf("confirmBuy on an expired offer succeeded")
+	}
+}
+
+func TestSellExpiryInThePast(t *testing.T) {
+	defer restoreClock()
+
+	stub := newTestStub(t)
+	for _, expiry := range []time.Time{testEpoch, testEpoch.Add(-time.Second)} {
+		err := stub.as("owner01", ROLE_ISSUER).invoke("sell", "Ookbee", "investor01", "1", "10", formatTime(expiry))
+		if err == nil {
+			t.Errorf("sell expiring at %v succeeded", formatTime(expiry))
+		}
+	}
+}